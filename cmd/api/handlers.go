@@ -2,9 +2,15 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	json "encoding/json"
+	"errors"
 	fmt "fmt"
+	"io"
+	"log"
 	"net/http"
+	"strconv"
 	time "time"
 
 	uuid "github.com/google/uuid"
@@ -13,14 +19,30 @@ import (
 	"github.com/mnhsh/time-capsule/internal/config"
 	"github.com/mnhsh/time-capsule/internal/database"
 	response "github.com/mnhsh/time-capsule/internal/response"
+	"github.com/mnhsh/time-capsule/internal/storage"
+)
+
+const (
+	accessTokenTTL = 15 * time.Minute
+	// refreshTokenTTL is how long a refresh token stays valid. Each refresh
+	// issues a new one, so an active session doesn't expire.
+	refreshTokenTTL = 60 * 24 * time.Hour
 )
 
 type API struct {
 	cfg *config.Config
+	// now is the clock TOTP codes and resend limits are checked against.
+	now func() time.Time
+	// emails sends the account emails that go out after the response.
+	emails *mailQueue
 }
 
 func newAPI(cfg *config.Config) *API {
-	return &API{cfg: cfg}
+	return &API{
+		cfg:    cfg,
+		now:    time.Now,
+		emails: newMailQueue(mailWorkers, mailQueueSize, mailJobTimeout),
+	}
 }
 
 func (a *API) handlerCreateCapsule(w http.ResponseWriter, r *http.Request) {
@@ -29,47 +51,121 @@ func (a *API) handlerCreateCapsule(w http.ResponseWriter, r *http.Request) {
 		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
 		return
 	}
-	const maxMemory = 1 << 30
-	err := r.ParseMultipartForm(maxMemory)
-	if err != nil {
-		response.RespondWithError(w, http.StatusBadRequest, "file too large", err)
+	if !a.requireVerifiedEmail(w, r, userID) {
 		return
 	}
-	file, _, err := r.FormFile("capsule_file")
+
+	// Leave room for the text fields and multipart framing around the file.
+	const formOverhead = 1 << 20
+	r.Body = http.MaxBytesReader(w, r.Body, a.cfg.MaxUploadSize+formOverhead)
+
+	reader, err := r.MultipartReader()
 	if err != nil {
-		response.RespondWithError(w, http.StatusBadRequest, "error retrieving file", err)
+		response.RespondWithError(w, http.StatusBadRequest, "expected a multipart/form-data body", err)
 		return
 	}
-	defer file.Close()
-	title := r.FormValue("title")
-	unlockAtStr := r.FormValue("unlock_at")
 
-	unlockAt, err := time.Parse(time.RFC3339, unlockAtStr)
-	if err != nil {
-		response.RespondWithError(w, http.StatusBadRequest, "invalid date format", err)
-		return
+	// Parts are handled as they arrive so the file goes straight to S3. The
+	// unlock_at field must therefore precede capsule_file.
+	var (
+		title       string
+		unlockAt    time.Time
+		s3Key       string
+		contentType string
+		sealed      sealedContent
+		saved       bool
+	)
+	// Nothing references the object until the capsule row exists, so every
+	// failure after the file has been stored must remove it again.
+	defer func() {
+		if s3Key != "" && !saved {
+			a.discardObject(r.Context(), s3Key)
+		}
+	}()
+	for {
+		// NextPart wraps io.EOF when the body ends before the closing
+		// boundary, so only the bare value means the form is complete.
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+
+		switch part.FormName() {
+		case "title":
+			title, err = readFormField(part)
+		case "unlock_at":
+			var value string
+			value, err = readFormField(part)
+			if err == nil {
+				unlockAt, err = time.Parse(time.RFC3339, value)
+				if err != nil {
+					part.Close()
+					response.RespondWithError(w, http.StatusBadRequest, "invalid date format", err)
+					return
+				}
+			}
+		case "capsule_file":
+			if unlockAt.IsZero() {
+				part.Close()
+				response.RespondWithError(w, http.StatusBadRequest, "unlock_at must be sent before capsule_file", nil)
+				return
+			}
+			if s3Key != "" {
+				part.Close()
+				response.RespondWithError(w, http.StatusBadRequest, "only one capsule_file is allowed", nil)
+				return
+			}
+			s3Key = fmt.Sprintf("%s/%s", userID, uuid.New().String())
+			contentType = part.Header.Get("Content-Type")
+			sealed, err = a.storeEncrypted(
+				r.Context(),
+				s3Key,
+				contentType,
+				&limitedReader{r: part, remaining: a.cfg.MaxUploadSize},
+			)
+		}
+		part.Close()
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
 	}
 
-	s3Key := fmt.Sprintf("%s/%s", userID, uuid.New().String())
-	err = a.cfg.Storage.Upload(r.Context(), s3Key, file)
-	if err != nil {
-		response.RespondWithError(w, http.StatusInternalServerError, "failed to upload file", err)
+	if unlockAt.IsZero() {
+		response.RespondWithError(w, http.StatusBadRequest, "unlock_at is required", nil)
+		return
+	}
+	if s3Key == "" {
+		response.RespondWithError(w, http.StatusBadRequest, "capsule_file is required", nil)
 		return
 	}
+
 	capsuleID := uuid.New()
 	err = a.cfg.DB.CreateCapsuleWithOutbox(r.Context(), database.CreateCapsuleParams{
-		ID:         capsuleID,
-		UserID:     userID,
-		Title:      sql.NullString{String: title, Valid: title != ""},
-		CreatedAt:  time.Now().UTC(),
-		S3key:      s3Key,
-		UnlockAt:   unlockAt.UTC(),
-		IsUnlocked: sql.NullBool{Bool: false, Valid: true},
+		ID:           capsuleID,
+		UserID:       userID,
+		Title:        sql.NullString{String: title, Valid: title != ""},
+		CreatedAt:    time.Now().UTC(),
+		S3key:        s3Key,
+		UnlockAt:     unlockAt.UTC(),
+		IsUnlocked:   sql.NullBool{Bool: false, Valid: true},
+		UploadStatus: database.UploadStatusComplete,
+		SizeBytes:    sql.NullInt64{Int64: sealed.digest.Size, Valid: true},
+		Sha256:       sql.NullString{String: sealed.digest.SHA256, Valid: true},
+		WrappedKey:   sealed.key.wrapped,
+		EscrowedKey:  sealed.key.escrowed,
+		ContentType:  sql.NullString{String: contentType, Valid: contentType != ""},
+		ObjectSha256: sql.NullString{String: sealed.objectSHA256, Valid: true},
 	})
 	if err != nil {
 		response.RespondWithError(w, http.StatusInternalServerError, "failed to save capsule metadata", err)
 		return
 	}
+	saved = true
 	response.RespondWithJSON(w, http.StatusCreated, map[string]uuid.UUID{
 		"id": capsuleID,
 	})
@@ -77,11 +173,14 @@ func (a *API) handlerCreateCapsule(w http.ResponseWriter, r *http.Request) {
 
 func (a *API) handlerGetCapsule(w http.ResponseWriter, r *http.Request) {
 	type Capsule struct {
-		ID         string    `json:"id"`
-		Title      string    `json:"title"`
-		CreatedAt  time.Time `json:"created_at"`
-		UnlockAt   time.Time `json:"unlock_at"`
-		IsUnlocked bool      `json:"is_unlocked"`
+		ID          string    `json:"id"`
+		Title       string    `json:"title"`
+		CreatedAt   time.Time `json:"created_at"`
+		UnlockAt    time.Time `json:"unlock_at"`
+		IsUnlocked  bool      `json:"is_unlocked"`
+		SizeBytes   *int64    `json:"size_bytes,omitempty"`
+		SHA256      string    `json:"sha256,omitempty"`
+		ContentType string    `json:"content_type,omitempty"`
 	}
 
 	type CapsulesResponse struct {
@@ -102,11 +201,14 @@ func (a *API) handlerGetCapsule(w http.ResponseWriter, r *http.Request) {
 	capsules := make([]Capsule, 0, len(dbCapsules))
 	for _, c := range dbCapsules {
 		capsules = append(capsules, Capsule{
-			ID:         c.ID.String(),
-			Title:      c.Title.String,
-			CreatedAt:  c.CreatedAt,
-			UnlockAt:   c.UnlockAt,
-			IsUnlocked: c.IsUnlocked.Bool,
+			ID:          c.ID.String(),
+			Title:       c.Title.String,
+			CreatedAt:   c.CreatedAt,
+			UnlockAt:    c.UnlockAt,
+			IsUnlocked:  c.IsUnlocked.Bool,
+			SizeBytes:   nullInt64Ptr(c.SizeBytes),
+			SHA256:      c.Sha256.String,
+			ContentType: c.ContentType.String,
 		})
 	}
 	response.RespondWithJSON(w, http.StatusOK, CapsulesResponse{
@@ -114,11 +216,237 @@ func (a *API) handlerGetCapsule(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (a *API) handlerGetCapsuleByID(w http.ResponseWriter, r *http.Request) {
+	type Capsule struct {
+		ID            string    `json:"id"`
+		Title         string    `json:"title"`
+		CreatedAt     time.Time `json:"created_at"`
+		UnlockAt      time.Time `json:"unlock_at"`
+		IsUnlocked    bool      `json:"is_unlocked"`
+		TimeRemaining int64     `json:"time_remaining"` // seconds until unlock_at
+		SizeBytes     *int64    `json:"size_bytes,omitempty"`
+		SHA256        string    `json:"sha256,omitempty"`
+		ContentType   string    `json:"content_type,omitempty"`
+	}
+
+	type LockedResponse struct {
+		Error   string  `json:"error"`
+		Code    string  `json:"code"`
+		Capsule Capsule `json:"capsule"`
+	}
+
+	c, ok := a.getCompleteCapsule(w, r)
+	if !ok {
+		return
+	}
+
+	remaining := time.Until(c.UnlockAt)
+	if remaining < 0 {
+		remaining = 0
+	}
+	capsule := Capsule{
+		ID:            c.ID.String(),
+		Title:         c.Title.String,
+		CreatedAt:     c.CreatedAt,
+		UnlockAt:      c.UnlockAt,
+		IsUnlocked:    c.IsUnlocked.Bool,
+		TimeRemaining: int64(remaining / time.Second),
+		SizeBytes:     nullInt64Ptr(c.SizeBytes),
+		SHA256:        c.Sha256.String,
+		ContentType:   c.ContentType.String,
+	}
+
+	if capsuleSealed(c) {
+		response.RespondWithJSON(w, http.StatusLocked, LockedResponse{
+			Error:   "capsule is still sealed",
+			Code:    "capsule_locked",
+			Capsule: capsule,
+		})
+		return
+	}
+	response.RespondWithJSON(w, http.StatusOK, capsule)
+}
+
+func (a *API) handlerGetCapsuleContent(w http.ResponseWriter, r *http.Request) {
+	const presignExpiry = 5 * time.Minute
+
+	c, ok := a.getCompleteCapsule(w, r)
+	if !ok {
+		return
+	}
+	if capsuleSealed(c) {
+		response.RespondWithError(w, http.StatusLocked, "capsule is still sealed", nil)
+		return
+	}
+
+	// The worker restores archived content ahead of unlock, so this only
+	// happens if it fell behind.
+	if storage.StorageClass(c.StorageClass).Archived() {
+		respondArchived(w, nil)
+		return
+	}
+
+	// By default hand the client a short-lived S3 URL so the bytes don't pass
+	// through the API; ?mode=stream proxies the object instead. Backends that
+	// can't presign always stream, and so do encrypted capsules, which only
+	// the API can decrypt.
+	if r.URL.Query().Get("mode") != "stream" && c.WrappedKey == nil {
+		url, err := a.cfg.Storage.PresignGet(r.Context(), c.S3key, presignExpiry)
+		if err == nil {
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			return
+		}
+		if !errors.Is(err, storage.ErrPresignUnsupported) {
+			response.RespondWithError(w, http.StatusInternalServerError, "couldn't create download link", err)
+			return
+		}
+	}
+
+	obj, err := a.cfg.Storage.Get(r.Context(), c.S3key)
+	if errors.Is(err, storage.ErrArchived) {
+		respondArchived(w, err)
+		return
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't read capsule content", err)
+		return
+	}
+	defer obj.Body.Close()
+
+	var body io.Reader = obj.Body
+	contentLength := obj.ContentLength
+	if c.WrappedKey != nil {
+		dataKey, err := a.cfg.Keys.UnwrapDataKey(r.Context(), c.WrappedKey)
+		if err != nil {
+			response.RespondWithError(w, http.StatusInternalServerError, "couldn't unwrap capsule key", err)
+			return
+		}
+		body, err = storage.DecryptReader(obj.Body, dataKey)
+		if err != nil {
+			response.RespondWithError(w, http.StatusInternalServerError, "couldn't decrypt capsule content", err)
+			return
+		}
+		contentLength = c.SizeBytes.Int64
+	}
+
+	// Capsules sealed before checksums were recorded are served unverified.
+	if c.Sha256.Valid && c.SizeBytes.Valid {
+		want := storage.Digest{Size: c.SizeBytes.Int64, SHA256: c.Sha256.String}
+		body = storage.VerifyingReader(body, want)
+		if sum, err := hex.DecodeString(c.Sha256.String); err == nil {
+			w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+		}
+	}
+
+	contentType := c.ContentType.String
+	if contentType == "" {
+		contentType = obj.ContentType
+	}
+	if contentType == "" {
+		contentType = defaultMediaType
+	}
+	w.Header().Set("Content-Type", contentType)
+	if contentLength > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	// A decryption or checksum failure midway can only cut the response
+	// short; the client sees fewer bytes than Content-Length promised, and
+	// never the final byte of content that doesn't match its checksum.
+	if _, err := io.Copy(w, body); err != nil {
+		if errors.Is(err, storage.ErrChecksumMismatch) {
+			log.Printf("capsule %s failed its integrity check: %v", c.ID, err)
+			return
+		}
+		log.Printf("couldn't stream capsule %s: %v", c.ID, err)
+	}
+}
+
+func respondArchived(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", "3600")
+	response.RespondWithError(w, http.StatusServiceUnavailable, "capsule content is being restored from archive storage", err)
+}
+
+func nullInt64Ptr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// capsuleSealed reports whether the capsule's content must still be withheld.
+// The worker may lag behind unlock_at, so the time itself is authoritative,
+// except for time-locked capsules, which can't be read before the worker has
+// released their key.
+func capsuleSealed(c database.Capsule) bool {
+	if c.EscrowedKey != nil {
+		return true
+	}
+	return !c.IsUnlocked.Bool && time.Now().Before(c.UnlockAt)
+}
+
+// getOwnedCapsule loads the capsule named by the {id} path value. Capsules
+// that belong to someone else are reported as not found so their existence
+// isn't leaked.
+func (a *API) getOwnedCapsule(w http.ResponseWriter, r *http.Request) (database.Capsule, bool) {
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return database.Capsule{}, false
+	}
+
+	capsuleID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "invalid capsule id", err)
+		return database.Capsule{}, false
+	}
+
+	c, err := a.cfg.DB.GetCapsuleByIDForUser(r.Context(), database.GetCapsuleByIDForUserParams{
+		ID:     capsuleID,
+		UserID: userID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, http.StatusNotFound, "capsule not found", nil)
+		return database.Capsule{}, false
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't get capsule", err)
+		return database.Capsule{}, false
+	}
+	return c, true
+}
+
+// getCompleteCapsule is getOwnedCapsule for capsules whose content has been
+// stored and verified. A direct upload that hasn't been finalized is reported
+// as not found, as it is left out of the capsule list; its object is whatever
+// the client has put there so far.
+func (a *API) getCompleteCapsule(w http.ResponseWriter, r *http.Request) (database.Capsule, bool) {
+	c, ok := a.getOwnedCapsule(w, r)
+	if !ok {
+		return database.Capsule{}, false
+	}
+	if c.UploadStatus != database.UploadStatusComplete {
+		response.RespondWithError(w, http.StatusNotFound, "capsule not found", nil)
+		return database.Capsule{}, false
+	}
+	return c, true
+}
+
+// handlerUsers registers an account and emails a token to confirm its
+// address. Capsules can't be created until it's confirmed.
 func (a *API) handlerUsers(w http.ResponseWriter, r *http.Request) {
 	type request struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 	}
+	type User struct {
+		ID            uuid.UUID `json:"id"`
+		CreatedAt     time.Time `json:"created_at"`
+		UpdatedAt     time.Time `json:"updated_at"`
+		Email         string    `json:"email"`
+		EmailVerified bool      `json:"email_verified"`
+	}
 
 	decoder := json.NewDecoder(r.Body)
 	req := request{}
@@ -132,6 +460,11 @@ func (a *API) handlerUsers(w http.ResponseWriter, r *http.Request) {
 		response.RespondWithError(w, http.StatusBadRequest, "email and password are required", nil)
 		return
 	}
+	email, err := parseEmail(req.Email)
+	if err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "invalid email address", err)
+		return
+	}
 
 	hashedPassword, err := auth.HashPassword(req.Password)
 	if err != nil {
@@ -139,26 +472,39 @@ func (a *API) handlerUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	now := time.Now().UTC()
 	user, err := a.cfg.DB.CreateUser(r.Context(), database.CreateUserParams{
-		Email:          req.Email,
+		ID:             uuid.New(),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Email:          email,
 		HashedPassword: hashedPassword,
 	})
 	if err != nil {
 		response.RespondWithError(w, http.StatusInternalServerError, "couldn't create user", err)
 		return
 	}
-	response.RespondWithJSON(w, http.StatusCreated, user)
+
+	// The account exists either way; the user can ask for another email.
+	if err := a.sendVerification(r.Context(), user); err != nil {
+		log.Printf("couldn't send verification email to user %s: %v", user.ID, err)
+	}
+
+	response.RespondWithJSON(w, http.StatusCreated, User{
+		ID:            user.ID,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerifiedAt.Valid,
+	})
 }
 
 func (a *API) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	type request struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
-	}
-	type res struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		ExpiresIn    int    `json:"expires_in"`
+		// DeviceName labels the session in GET /v1/sessions, e.g. "Pixel 8".
+		DeviceName string `json:"device_name"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	req := request{}
@@ -167,7 +513,16 @@ func (a *API) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		response.RespondWithError(w, http.StatusInternalServerError, "couldn't decode request", err)
 		return
 	}
-	user, err := a.cfg.DB.GetUserByEmail(r.Context(), req.Email)
+	if !checkDeviceName(w, req.DeviceName) {
+		return
+	}
+	// Addresses are stored the way parseEmail returns them at registration.
+	email, err := parseEmail(req.Email)
+	if err != nil {
+		response.RespondWithError(w, http.StatusUnauthorized, "incorrect email or password", err)
+		return
+	}
+	user, err := a.cfg.DB.GetUserByEmail(r.Context(), email)
 	if err != nil {
 		response.RespondWithError(w, http.StatusInternalServerError, "incorrect email or password", err)
 		return
@@ -181,68 +536,95 @@ func (a *API) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		response.RespondWithError(w, http.StatusUnauthorized, "incorrect email or password", nil)
 		return
 	}
-	accessToken, err := auth.MakeJwt(
-		user.ID,
-		a.cfg.JWTSecret,
-		time.Minute*15,
-	)
+
+	// With TOTP on, the password only earns an mfa_token, which
+	// POST /v1/login/mfa exchanges for a session along with a code.
+	mfa, err := a.totpEnabled(r.Context(), user.ID)
 	if err != nil {
-		response.RespondWithError(w, http.StatusInternalServerError, "couldn't create access JWT", err)
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't check two-factor authentication", err)
 		return
 	}
-
-	refreshToken, err := auth.MakeRefreshToken()
-	if err != nil {
-		response.RespondWithError(w, http.StatusInternalServerError, "couldn't create refresh JWT", err)
+	if mfa {
+		challenge, err := a.startMFAChallenge(r.Context(), user.ID, req.DeviceName)
+		if err != nil {
+			response.RespondWithError(w, http.StatusInternalServerError, "couldn't start login challenge", err)
+			return
+		}
+		response.RespondWithJSON(w, http.StatusOK, challenge)
 		return
 	}
 
-	_, err = a.cfg.DB.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{
-		Token:     refreshToken,
-		UserID:    user.ID,
-		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
-	})
+	tokens, err := a.startSession(r, user.ID, req.DeviceName)
 	if err != nil {
-		response.RespondWithError(w, http.StatusInternalServerError, "couldn't save refresh token", err)
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't start session", err)
 		return
 	}
-
-	response.RespondWithJSON(w, http.StatusOK, res{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    900,
-	})
+	response.RespondWithJSON(w, http.StatusOK, tokens)
 }
 
+// handlerRefreshToken exchanges a refresh token for a new access token and a
+// new refresh token. The old refresh token stops working, and presenting it
+// again signs out every session descended from the same login.
 func (a *API) handlerRefreshToken(w http.ResponseWriter, r *http.Request) {
-	type res struct {
-		AccessToken string `json:"access_token"`
-	}
-
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		response.RespondWithError(w, http.StatusBadRequest, "Couldn't find token", err)
 		return
 	}
 
-	user, err := a.cfg.DB.GetUserByRefreshToken(r.Context(), refreshToken)
+	newRefreshToken, err := auth.MakeRefreshToken()
 	if err != nil {
-		response.RespondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't create refresh token", err)
 		return
 	}
 
+	expiresAt := time.Now().UTC().Add(refreshTokenTTL)
+	issued, err := a.cfg.DB.RotateRefreshToken(r.Context(), auth.HashRefreshToken(refreshToken), database.CreateRefreshTokenParams{
+		TokenHash: auth.HashRefreshToken(newRefreshToken),
+		ExpiresAt: expiresAt,
+	})
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		log.Printf("refresh token reuse detected; revoked its token family")
+		response.RespondWithError(w, http.StatusUnauthorized, "refresh token was already used; sign in again", err)
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, http.StatusUnauthorized, "invalid or expired refresh token", err)
+		return
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't rotate refresh token", err)
+		return
+	}
+
+	// The session's details are only informational, so failing to update
+	// them doesn't fail the refresh.
+	ua, ip := userAgent(r), a.clientIP(r)
+	err = a.cfg.DB.TouchSession(r.Context(), database.TouchSessionParams{
+		ID:        issued.FamilyID,
+		ExpiresAt: expiresAt,
+		UserAgent: sql.NullString{String: ua, Valid: ua != ""},
+		Ip:        sql.NullString{String: ip, Valid: ip != ""},
+	})
+	if err != nil {
+		log.Printf("couldn't update session %s: %v", issued.FamilyID, err)
+	}
+
 	accessToken, err := auth.MakeJwt(
-		user.ID,
+		issued.UserID,
+		issued.FamilyID,
 		a.cfg.JWTSecret,
-		time.Minute*15,
+		accessTokenTTL,
 	)
 	if err != nil {
-		response.RespondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't create access JWT", err)
 		return
 	}
 
-	response.RespondWithJSON(w, http.StatusOK, res{
-		AccessToken: accessToken,
+	response.RespondWithJSON(w, http.StatusOK, tokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: newRefreshToken,
+		ExpiresIn:    int(accessTokenTTL / time.Second),
 	})
 }
 
@@ -253,11 +635,22 @@ func (a *API) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = a.cfg.DB.RevokeRefreshToken(r.Context(), refreshToken)
+	// Revoking the token ends the whole session it belongs to, so access
+	// tokens issued alongside it stop working too.
+	token, err := a.cfg.DB.GetRefreshToken(r.Context(), auth.HashRefreshToken(refreshToken))
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	if err != nil {
 		response.RespondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
 		return
 	}
+	err = a.cfg.DB.EndSession(r.Context(), token.UserID, token.FamilyID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
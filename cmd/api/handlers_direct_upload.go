@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/auth"
+	"github.com/mnhsh/time-capsule/internal/database"
+	response "github.com/mnhsh/time-capsule/internal/response"
+	"github.com/mnhsh/time-capsule/internal/storage"
+)
+
+const (
+	uploadURLExpiry = time.Hour
+	// Larger files are uploaded in parts; S3 caps a single PUT at 5 GiB.
+	singlePutLimit   = 512 << 20
+	directPartSize   = 64 << 20
+	maxUploadParts   = 10000
+	sha256HexLength  = 64
+	defaultMediaType = "application/octet-stream"
+)
+
+type presignedRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func toPresignedRequest(req *storage.PresignedRequest) presignedRequest {
+	headers := make(map[string]string, len(req.Header))
+	for k := range req.Header {
+		if k == "Host" {
+			continue
+		}
+		headers[k] = req.Header.Get(k)
+	}
+	return presignedRequest{Method: req.Method, URL: req.URL, Headers: headers}
+}
+
+// handlerInitiateUpload creates a capsule in the pending_upload state and
+// returns presigned URLs the client uploads to directly. Nothing is scheduled
+// until handlerFinalizeUpload has verified the object.
+func (a *API) handlerInitiateUpload(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Title       string    `json:"title"`
+		UnlockAt    time.Time `json:"unlock_at"`
+		Size        int64     `json:"size"`
+		SHA256      string    `json:"sha256"` // hex, optional
+		ContentType string    `json:"content_type"`
+	}
+	type part struct {
+		Number  int32            `json:"number"`
+		Size    int64            `json:"size"`
+		Request presignedRequest `json:"request"`
+	}
+	type res struct {
+		ID        uuid.UUID         `json:"id"`
+		ExpiresAt time.Time         `json:"expires_at"`
+		Upload    *presignedRequest `json:"upload,omitempty"`
+		Parts     []part            `json:"parts,omitempty"`
+	}
+
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+	if !a.requireVerifiedEmail(w, r, userID) {
+		return
+	}
+
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "couldn't decode request", err)
+		return
+	}
+	if req.UnlockAt.IsZero() {
+		response.RespondWithError(w, http.StatusBadRequest, "unlock_at is required", nil)
+		return
+	}
+	if req.Size <= 0 {
+		response.RespondWithError(w, http.StatusBadRequest, "size must be positive", nil)
+		return
+	}
+	if req.Size > a.cfg.MaxUploadSize {
+		response.RespondWithError(w, http.StatusRequestEntityTooLarge, "file too large", nil)
+		return
+	}
+	var checksum string
+	if req.SHA256 != "" {
+		req.SHA256 = strings.ToLower(req.SHA256)
+		sum, err := hex.DecodeString(req.SHA256)
+		if err != nil || len(req.SHA256) != sha256HexLength {
+			response.RespondWithError(w, http.StatusBadRequest, "sha256 must be 64 hex characters", err)
+			return
+		}
+		checksum = base64.StdEncoding.EncodeToString(sum)
+	}
+	if req.ContentType == "" {
+		req.ContentType = defaultMediaType
+	}
+
+	capsuleID := uuid.New()
+	s3Key := fmt.Sprintf("%s/%s", userID, uuid.New().String())
+	out := res{
+		ID:        capsuleID,
+		ExpiresAt: time.Now().UTC().Add(uploadURLExpiry),
+	}
+
+	var uploadID string
+	// abortUpload releases the parts of a multipart upload we won't hand out.
+	abortUpload := func() {
+		if uploadID == "" {
+			return
+		}
+		if err := a.cfg.Storage.AbortMultipartUpload(context.WithoutCancel(r.Context()), s3Key, uploadID); err != nil {
+			log.Printf("couldn't abort multipart upload %s: %v", uploadID, err)
+		}
+	}
+
+	if req.Size <= singlePutLimit {
+		presigned, err := a.cfg.Storage.PresignPut(r.Context(), s3Key, req.ContentType, req.Size, checksum, uploadURLExpiry)
+		if errors.Is(err, storage.ErrPresignUnsupported) {
+			response.RespondWithError(w, http.StatusNotImplemented, "direct uploads aren't supported by this storage backend", err)
+			return
+		}
+		if err != nil {
+			response.RespondWithError(w, http.StatusInternalServerError, "couldn't create upload URL", err)
+			return
+		}
+		upload := toPresignedRequest(presigned)
+		out.Upload = &upload
+	} else {
+		partSize := int64(directPartSize)
+		if minSize := (req.Size + maxUploadParts - 1) / maxUploadParts; minSize > partSize {
+			partSize = minSize
+		}
+
+		var err error
+		uploadID, err = a.cfg.Storage.CreateMultipartUpload(r.Context(), s3Key, req.ContentType)
+		if err != nil {
+			response.RespondWithError(w, http.StatusInternalServerError, "couldn't start multipart upload", err)
+			return
+		}
+		for number, offset := int32(1), int64(0); offset < req.Size; number, offset = number+1, offset+partSize {
+			size := min(partSize, req.Size-offset)
+			presigned, err := a.cfg.Storage.PresignUploadPart(r.Context(), s3Key, uploadID, number, size, uploadURLExpiry)
+			if errors.Is(err, storage.ErrPresignUnsupported) {
+				abortUpload()
+				response.RespondWithError(w, http.StatusNotImplemented, "direct uploads aren't supported by this storage backend", err)
+				return
+			}
+			if err != nil {
+				abortUpload()
+				response.RespondWithError(w, http.StatusInternalServerError, "couldn't create upload URL", err)
+				return
+			}
+			out.Parts = append(out.Parts, part{Number: number, Size: size, Request: toPresignedRequest(presigned)})
+		}
+	}
+
+	_, err := a.cfg.DB.CreateCapsule(r.Context(), database.CreateCapsuleParams{
+		ID:           capsuleID,
+		UserID:       userID,
+		Title:        sql.NullString{String: req.Title, Valid: req.Title != ""},
+		CreatedAt:    time.Now().UTC(),
+		S3key:        s3Key,
+		UnlockAt:     req.UnlockAt.UTC(),
+		IsUnlocked:   sql.NullBool{Bool: false, Valid: true},
+		UploadStatus: database.UploadStatusPending,
+		SizeBytes:    sql.NullInt64{Int64: req.Size, Valid: true},
+		Sha256:       sql.NullString{String: req.SHA256, Valid: req.SHA256 != ""},
+		UploadID:     sql.NullString{String: uploadID, Valid: uploadID != ""},
+		ContentType:  sql.NullString{String: req.ContentType, Valid: true},
+	})
+	if err != nil {
+		abortUpload()
+		response.RespondWithError(w, http.StatusInternalServerError, "failed to save capsule metadata", err)
+		return
+	}
+	response.RespondWithJSON(w, http.StatusCreated, out)
+}
+
+// handlerFinalizeUpload checks that the object announced by
+// handlerInitiateUpload really is in the bucket, with the promised size and
+// checksum, before the capsule is sealed and its unlock scheduled.
+func (a *API) handlerFinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Parts []struct {
+			Number int32  `json:"number"`
+			ETag   string `json:"etag"`
+		} `json:"parts"`
+	}
+
+	c, ok := a.getOwnedCapsule(w, r)
+	if !ok {
+		return
+	}
+	if c.UploadStatus != database.UploadStatusPending {
+		response.RespondWithError(w, http.StatusConflict, "capsule upload is already finalized", nil)
+		return
+	}
+
+	if c.UploadID.Valid {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.RespondWithError(w, http.StatusBadRequest, "couldn't decode request", err)
+			return
+		}
+		if len(req.Parts) == 0 {
+			response.RespondWithError(w, http.StatusBadRequest, "parts are required for a multipart upload", nil)
+			return
+		}
+		parts := make([]storage.Part, 0, len(req.Parts))
+		for _, p := range req.Parts {
+			parts = append(parts, storage.Part{Number: p.Number, ETag: p.ETag})
+		}
+		err := a.cfg.Storage.CompleteMultipartUpload(r.Context(), c.S3key, c.UploadID.String, parts)
+		if err != nil {
+			response.RespondWithError(w, http.StatusBadRequest, "couldn't complete multipart upload", err)
+			return
+		}
+	}
+
+	info, err := a.cfg.Storage.Head(r.Context(), c.S3key)
+	if errors.Is(err, storage.ErrNotFound) {
+		response.RespondWithError(w, http.StatusConflict, "file has not been uploaded", nil)
+		return
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't verify upload", err)
+		return
+	}
+
+	if msg := verifyUpload(c, info); msg != "" {
+		// The object can't be trusted, so don't leave it behind.
+		if err := a.cfg.Storage.Delete(r.Context(), c.S3key); err != nil {
+			response.RespondWithError(w, http.StatusInternalServerError, "couldn't discard invalid upload", err)
+			return
+		}
+		a.discardPendingCapsule(r.Context(), c)
+		response.RespondWithError(w, http.StatusUnprocessableEntity, msg+"; start a new upload", nil)
+		return
+	}
+
+	// The client uploaded plaintext, so the capsule is pointed at an
+	// encrypted copy and the original is removed once that's recorded.
+	encryptedKey, sealed, err := a.encryptStoredObject(r.Context(), c.S3key)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't encrypt capsule content", err)
+		return
+	}
+	// Multipart uploads could only be checked part by part, so this is the
+	// first time their declared sha256 is compared against the content.
+	if c.Sha256.Valid && sealed.digest.SHA256 != c.Sha256.String {
+		a.discardObject(r.Context(), encryptedKey)
+		a.discardObject(r.Context(), c.S3key)
+		a.discardPendingCapsule(r.Context(), c)
+		response.RespondWithError(w, http.StatusUnprocessableEntity, "uploaded file does not match declared sha256; start a new upload", nil)
+		return
+	}
+
+	err = a.cfg.DB.FinalizeCapsuleUpload(r.Context(), database.MarkCapsuleUploadedParams{
+		ID:           c.ID,
+		UserID:       c.UserID,
+		WrappedKey:   sealed.key.wrapped,
+		S3key:        encryptedKey,
+		EscrowedKey:  sealed.key.escrowed,
+		Sha256:       sql.NullString{String: sealed.digest.SHA256, Valid: true},
+		ObjectSha256: sql.NullString{String: sealed.objectSHA256, Valid: true},
+	})
+	if err != nil {
+		a.discardObject(r.Context(), encryptedKey)
+	}
+	if errors.Is(err, database.ErrNoPendingUpload) {
+		response.RespondWithError(w, http.StatusConflict, "capsule upload is already finalized", nil)
+		return
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "failed to finalize capsule", err)
+		return
+	}
+	a.discardObject(r.Context(), c.S3key)
+	response.RespondWithJSON(w, http.StatusOK, map[string]uuid.UUID{
+		"id": c.ID,
+	})
+}
+
+// verifyUpload compares the stored object against what the client declared and
+// returns a client-facing message describing the first mismatch.
+func verifyUpload(c database.Capsule, info *storage.ObjectInfo) string {
+	if c.SizeBytes.Valid && info.Size != c.SizeBytes.Int64 {
+		return fmt.Sprintf("uploaded size %d does not match declared size %d", info.Size, c.SizeBytes.Int64)
+	}
+	// Multipart objects carry a checksum of part checksums, not of the content.
+	if c.Sha256.Valid && !c.UploadID.Valid {
+		sum, err := base64.StdEncoding.DecodeString(info.ChecksumSHA256)
+		if err != nil || hex.EncodeToString(sum) != c.Sha256.String {
+			return "uploaded file does not match declared sha256"
+		}
+	}
+	return ""
+}
+
+// discardPendingCapsule deletes the row of a direct upload whose object was
+// thrown away, so it doesn't linger as pending_upload pointing at nothing.
+// Failures are only logged; the row never becomes visible either way.
+func (a *API) discardPendingCapsule(ctx context.Context, c database.Capsule) {
+	_, err := a.cfg.DB.DeletePendingCapsule(context.WithoutCancel(ctx), database.DeletePendingCapsuleParams{
+		ID:     c.ID,
+		UserID: c.UserID,
+	})
+	if err != nil {
+		log.Printf("couldn't delete pending capsule %s: %v", c.ID, err)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	uuid "github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/auth"
+	"github.com/mnhsh/time-capsule/internal/database"
+	response "github.com/mnhsh/time-capsule/internal/response"
+)
+
+const (
+	// totpIssuer names the account in authenticator apps.
+	totpIssuer = "Time Capsule"
+	// mfaChallengeTTL is how long the second step of a login may take, and
+	// maxMFAAttempts how many codes may be tried in it.
+	mfaChallengeTTL = 5 * time.Minute
+	maxMFAAttempts  = 5
+	// maxTOTPDisableAttempts is how many codes a user may try at turning
+	// TOTP off within totpDisableWindow.
+	maxTOTPDisableAttempts = 5
+	totpDisableWindow      = 15 * time.Minute
+)
+
+type mfaResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// handlerEnrollTOTP starts TOTP enrollment with a new key. It stays inactive
+// until handlerConfirmTOTP sees a code generated from it, so a key that never
+// made it into an authenticator app can't lock the user out.
+func (a *API) handlerEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	type res struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauth_uri"`
+	}
+
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+
+	user, err := a.cfg.DB.GetUserByID(r.Context(), userID)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't get user", err)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't generate TOTP key", err)
+		return
+	}
+	wrapped, err := a.cfg.Keys.WrapDataKey(r.Context(), secret)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't wrap TOTP key", err)
+		return
+	}
+
+	n, err := a.cfg.DB.UpsertUserTOTP(r.Context(), database.UpsertUserTOTPParams{
+		UserID:        userID,
+		WrappedSecret: wrapped,
+	})
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't save TOTP key", err)
+		return
+	}
+	if n == 0 {
+		response.RespondWithError(w, http.StatusConflict, "two-factor authentication is already enabled", nil)
+		return
+	}
+
+	response.RespondWithJSON(w, http.StatusOK, res{
+		Secret:     auth.EncodeTOTPSecret(secret),
+		OtpauthURI: auth.TOTPURI(secret, totpIssuer, user.Email),
+	})
+}
+
+// handlerConfirmTOTP turns two-factor login on once the user proves their
+// authenticator has the key, and returns recovery codes. This is the only
+// time the codes are shown.
+func (a *API) handlerConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Code string `json:"code"`
+	}
+	type res struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "couldn't decode request", err)
+		return
+	}
+
+	totp, err := a.cfg.DB.GetUserTOTP(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, http.StatusNotFound, "no TOTP enrollment in progress", nil)
+		return
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't get TOTP key", err)
+		return
+	}
+	if totp.ConfirmedAt.Valid {
+		response.RespondWithError(w, http.StatusConflict, "two-factor authentication is already enabled", nil)
+		return
+	}
+
+	secret, err := a.cfg.Keys.UnwrapDataKey(r.Context(), totp.WrappedSecret)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't unwrap TOTP key", err)
+		return
+	}
+	step, ok := auth.ValidateTOTP(secret, req.Code, a.now())
+	if !ok {
+		response.RespondWithError(w, http.StatusBadRequest, "invalid code", nil)
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes()
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't generate recovery codes", err)
+		return
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, auth.HashRecoveryCode(code))
+	}
+
+	err = a.cfg.DB.ConfirmTOTP(r.Context(), userID, step, hashes)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, http.StatusConflict, "two-factor authentication is already enabled", err)
+		return
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't enable two-factor authentication", err)
+		return
+	}
+
+	response.RespondWithJSON(w, http.StatusOK, res{
+		RecoveryCodes: codes,
+	})
+}
+
+// handlerDisableTOTP turns two-factor login off. It takes a current code or
+// a recovery code, so a stolen access token alone can't do it, and only
+// maxTOTPDisableAttempts of them per totpDisableWindow.
+func (a *API) handlerDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "couldn't decode request", err)
+		return
+	}
+
+	// As with logins, the attempt is used up before the code is checked.
+	now := a.now().UTC()
+	n, err := a.cfg.DB.ClaimTOTPDisableAttempt(r.Context(), database.ClaimTOTPDisableAttemptParams{
+		WindowStart: now.Add(-totpDisableWindow),
+		Now:         now,
+		UserID:      userID,
+		MaxAttempts: maxTOTPDisableAttempts,
+	})
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't check code", err)
+		return
+	}
+	if n == 0 {
+		enabled, err := a.totpEnabled(r.Context(), userID)
+		if err != nil {
+			response.RespondWithError(w, http.StatusInternalServerError, "couldn't check code", err)
+			return
+		}
+		if enabled {
+			w.Header().Set("Retry-After", strconv.Itoa(int(totpDisableWindow/time.Second)))
+			response.RespondWithError(w, http.StatusTooManyRequests, "too many attempts; try again later", nil)
+			return
+		}
+		response.RespondWithError(w, http.StatusForbidden, "invalid code", nil)
+		return
+	}
+
+	ok, err = a.checkSecondFactor(r.Context(), userID, req.Code, req.RecoveryCode)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't check code", err)
+		return
+	}
+	if !ok {
+		response.RespondWithError(w, http.StatusForbidden, "invalid code", nil)
+		return
+	}
+
+	if err := a.cfg.DB.DisableTOTP(r.Context(), userID); err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't disable two-factor authentication", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerLoginMFA is the second step of a login for accounts with TOTP: it
+// trades the mfa_token from handlerLogin and a code for a session.
+func (a *API) handlerLoginMFA(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "couldn't decode request", err)
+		return
+	}
+
+	userID, challengeID, err := auth.ValidateSingleUseToken(req.MFAToken, auth.TokenTypeMFAPending, a.cfg.JWTSecret)
+	if err != nil {
+		response.RespondWithError(w, http.StatusUnauthorized, "invalid or expired mfa_token", err)
+		return
+	}
+
+	// The attempt is used up before the code is checked, so concurrent
+	// guesses can't get past the limit.
+	challenge, err := a.cfg.DB.ClaimMFAChallengeAttempt(r.Context(), database.ClaimMFAChallengeAttemptParams{
+		ID:          challengeID,
+		UserID:      userID,
+		MaxAttempts: maxMFAAttempts,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, http.StatusUnauthorized, "login expired or had too many attempts; sign in again", nil)
+		return
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't check login", err)
+		return
+	}
+
+	ok, err := a.checkSecondFactor(r.Context(), userID, req.Code, req.RecoveryCode)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't check code", err)
+		return
+	}
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "invalid code", nil)
+		return
+	}
+
+	n, err := a.cfg.DB.UseMFAChallenge(r.Context(), database.UseMFAChallengeParams{
+		ID:     challengeID,
+		UserID: userID,
+	})
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't complete login", err)
+		return
+	}
+	if n == 0 {
+		response.RespondWithError(w, http.StatusUnauthorized, "login was already completed; sign in again", nil)
+		return
+	}
+
+	tokens, err := a.startSession(r, userID, challenge.DeviceName.String)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't start session", err)
+		return
+	}
+	response.RespondWithJSON(w, http.StatusOK, tokens)
+}
+
+// startMFAChallenge records the first step of a login for an account with
+// TOTP and returns the token that stands for it.
+func (a *API) startMFAChallenge(ctx context.Context, userID uuid.UUID, deviceName string) (mfaResponse, error) {
+	challenge, err := a.cfg.DB.CreateMFAChallenge(ctx, database.CreateMFAChallengeParams{
+		ID:         uuid.New(),
+		UserID:     userID,
+		ExpiresAt:  time.Now().UTC().Add(mfaChallengeTTL),
+		DeviceName: sql.NullString{String: deviceName, Valid: deviceName != ""},
+	})
+	if err != nil {
+		return mfaResponse{}, fmt.Errorf("couldn't save login challenge: %w", err)
+	}
+
+	token, err := auth.MakeSingleUseToken(auth.TokenTypeMFAPending, userID, challenge.ID, a.cfg.JWTSecret, mfaChallengeTTL)
+	if err != nil {
+		return mfaResponse{}, fmt.Errorf("couldn't sign mfa_token: %w", err)
+	}
+	return mfaResponse{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int(mfaChallengeTTL / time.Second),
+	}, nil
+}
+
+// totpEnabled reports whether logins to the account need a second factor.
+func (a *API) totpEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	totp, err := a.cfg.DB.GetUserTOTP(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return totp.ConfirmedAt.Valid, nil
+}
+
+// checkSecondFactor checks a TOTP code or, if one is given, a recovery code,
+// and uses it up. A TOTP code is only accepted once, even within the period
+// it's valid for.
+func (a *API) checkSecondFactor(ctx context.Context, userID uuid.UUID, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		n, err := a.cfg.DB.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+			UserID:   userID,
+			CodeHash: auth.HashRecoveryCode(recoveryCode),
+		})
+		if err != nil {
+			return false, fmt.Errorf("couldn't use recovery code: %w", err)
+		}
+		return n > 0, nil
+	}
+
+	totp, err := a.cfg.DB.GetUserTOTP(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("couldn't get TOTP key: %w", err)
+	}
+	if !totp.ConfirmedAt.Valid {
+		return false, nil
+	}
+	secret, err := a.cfg.Keys.UnwrapDataKey(ctx, totp.WrappedSecret)
+	if err != nil {
+		return false, fmt.Errorf("couldn't unwrap TOTP key: %w", err)
+	}
+
+	step, ok := auth.ValidateTOTP(secret, code, a.now())
+	if !ok {
+		return false, nil
+	}
+	n, err := a.cfg.DB.UseTOTPStep(ctx, database.UseTOTPStepParams{
+		UserID:       userID,
+		LastUsedStep: sql.NullInt64{Int64: step, Valid: true},
+	})
+	if err != nil {
+		return false, fmt.Errorf("couldn't record TOTP code: %w", err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mnhsh/time-capsule/internal/auth"
+	"github.com/mnhsh/time-capsule/internal/database"
+)
+
+// newMFATestAPI returns an API whose TOTP clock reads now, the store behind
+// it, and a user with TOTP on along with their secret.
+func newMFATestAPI(t *testing.T, now time.Time) (*API, *memStore, database.User, []byte) {
+	t.Helper()
+	a, store := newTestAPI(t)
+	a.now = func() time.Time { return now }
+	user := store.addUser(t, testEmail, testPassword)
+	secret := store.addTOTP(t, user.ID, now.Add(-24*time.Hour))
+	return a, store, user, secret
+}
+
+// login runs the password step and returns the mfa_token it hands out.
+func login(t *testing.T, a *API) string {
+	t.Helper()
+	rec := post(t, a.handlerLogin, map[string]string{"email": testEmail, "password": testPassword})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", rec.Code, rec.Body)
+	}
+	var res mfaResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.MFARequired || res.MFAToken == "" {
+		t.Fatalf("login didn't ask for a second factor: %s", rec.Body)
+	}
+	return res.MFAToken
+}
+
+func TestLoginMFAIssuesSessionForCurrentCode(t *testing.T) {
+	now := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+	a, store, _, secret := newMFATestAPI(t, now)
+
+	token := login(t, a)
+	if len(store.sessions) != 0 {
+		t.Fatal("the password alone started a session")
+	}
+
+	code := auth.TOTPCode(secret, auth.TOTPStep(now))
+	rec := post(t, a.handlerLoginMFA, map[string]string{"mfa_token": token, "code": code})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login/mfa: status %d: %s", rec.Code, rec.Body)
+	}
+	var tokens tokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Errorf("missing tokens: %s", rec.Body)
+	}
+	if len(store.sessions) != 1 {
+		t.Errorf("started %d sessions, want 1", len(store.sessions))
+	}
+}
+
+func TestLoginMFARejectsStaleCode(t *testing.T) {
+	now := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+	a, store, _, secret := newMFATestAPI(t, now)
+
+	token := login(t, a)
+	code := auth.TOTPCode(secret, auth.TOTPStep(now.Add(-2*time.Minute)))
+	rec := post(t, a.handlerLoginMFA, map[string]string{"mfa_token": token, "code": code})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if len(store.sessions) != 0 {
+		t.Error("a stale code started a session")
+	}
+}
+
+func TestLoginMFARejectsReplayedCode(t *testing.T) {
+	now := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+	a, store, _, secret := newMFATestAPI(t, now)
+	code := auth.TOTPCode(secret, auth.TOTPStep(now))
+
+	rec := post(t, a.handlerLoginMFA, map[string]string{"mfa_token": login(t, a), "code": code})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first login/mfa: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// Seconds later the code is still within the allowed skew, but it has
+	// been used.
+	a.now = func() time.Time { return now.Add(10 * time.Second) }
+	rec = post(t, a.handlerLoginMFA, map[string]string{"mfa_token": login(t, a), "code": code})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("replay: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if len(store.sessions) != 1 {
+		t.Errorf("started %d sessions, want 1", len(store.sessions))
+	}
+}
+
+func TestLoginMFALimitsAttempts(t *testing.T) {
+	now := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+	a, store, _, secret := newMFATestAPI(t, now)
+	token := login(t, a)
+
+	for range maxMFAAttempts {
+		rec := post(t, a.handlerLoginMFA, map[string]string{"mfa_token": token, "code": "000000"})
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	code := auth.TOTPCode(secret, auth.TOTPStep(now))
+	rec := post(t, a.handlerLoginMFA, map[string]string{"mfa_token": token, "code": code})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("right code after the limit: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if len(store.sessions) != 0 {
+		t.Error("a session was started after the attempt limit")
+	}
+}
+
+func TestDisableTOTPLimitsAttempts(t *testing.T) {
+	now := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+	a, store, user, secret := newMFATestAPI(t, now)
+
+	disable := func(code string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/", strings.NewReader(`{"code":"`+code+`"}`))
+		rec := httptest.NewRecorder()
+		a.handlerDisableTOTP(rec, asUser(req, user.ID))
+		return rec.Code
+	}
+
+	for range maxTOTPDisableAttempts {
+		if status := disable("000000"); status != http.StatusForbidden {
+			t.Fatalf("wrong code: status = %d, want %d", status, http.StatusForbidden)
+		}
+	}
+	if status := disable(auth.TOTPCode(secret, auth.TOTPStep(now))); status != http.StatusTooManyRequests {
+		t.Fatalf("right code after the limit: status = %d, want %d", status, http.StatusTooManyRequests)
+	}
+	if _, ok := store.totp[user.ID]; !ok {
+		t.Fatal("TOTP was disabled after the attempt limit")
+	}
+
+	later := now.Add(totpDisableWindow + time.Minute)
+	a.now = func() time.Time { return later }
+	if status := disable(auth.TOTPCode(secret, auth.TOTPStep(later))); status != http.StatusNoContent {
+		t.Errorf("right code in a new window: status = %d, want %d", status, http.StatusNoContent)
+	}
+	if _, ok := store.totp[user.ID]; ok {
+		t.Error("TOTP is still enabled")
+	}
+}
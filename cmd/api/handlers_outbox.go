@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	uuid "github.com/google/uuid"
+
+	response "github.com/mnhsh/time-capsule/internal/response"
+)
+
+func (a *API) handlerListDeadEvents(w http.ResponseWriter, r *http.Request) {
+	type Event struct {
+		ID        string          `json:"id"`
+		Payload   json.RawMessage `json:"payload"`
+		CreatedAt time.Time       `json:"created_at"`
+		Attempts  int32           `json:"attempts"`
+		LastError string          `json:"last_error"`
+	}
+
+	type EventsResponse struct {
+		Events []Event `json:"events"`
+	}
+
+	limit := int32(100)
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || n <= 0 {
+			response.RespondWithError(w, http.StatusBadRequest, "invalid limit", err)
+			return
+		}
+		limit = int32(n)
+	}
+
+	dbEvents, err := a.cfg.DB.ListDeadOutboxEvents(r.Context(), limit)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't list dead events", err)
+		return
+	}
+	events := make([]Event, 0, len(dbEvents))
+	for _, e := range dbEvents {
+		events = append(events, Event{
+			ID:        e.ID.String(),
+			Payload:   e.Payload,
+			CreatedAt: e.CreatedAt,
+			Attempts:  e.Attempts,
+			LastError: e.LastError.String,
+		})
+	}
+	response.RespondWithJSON(w, http.StatusOK, EventsResponse{
+		Events: events,
+	})
+}
+
+func (a *API) handlerRedriveEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "invalid event id", err)
+		return
+	}
+
+	n, err := a.cfg.DB.RedriveOutboxEvent(r.Context(), id)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't redrive event", err)
+		return
+	}
+	if n == 0 {
+		response.RespondWithError(w, http.StatusNotFound, "no dead event with that id", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
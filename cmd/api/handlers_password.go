@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	uuid "github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/auth"
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/mail"
+	response "github.com/mnhsh/time-capsule/internal/response"
+)
+
+const passwordResetTTL = time.Hour
+
+// handlerRequestPasswordReset emails a reset token to the account's address.
+// It answers the same way whether or not the account exists, so it can't be
+// used to find out who has one: the lookup and the email happen after the
+// response, so its timing doesn't depend on them either.
+func (a *API) handlerRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Email string `json:"email"`
+	}
+
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "couldn't decode request", err)
+		return
+	}
+	if req.Email == "" {
+		response.RespondWithError(w, http.StatusBadRequest, "email is required", nil)
+		return
+	}
+	email, err := parseEmail(req.Email)
+	if err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "invalid email address", err)
+		return
+	}
+
+	queued := a.emails.enqueue(func(ctx context.Context) {
+		a.requestPasswordReset(ctx, email)
+	})
+	if !queued {
+		log.Printf("mail queue is full; dropped a password reset request")
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// requestPasswordReset sends a reset to the account registered to email, if
+// there is one. Nobody is waiting on it, so failures are only logged.
+func (a *API) requestPasswordReset(ctx context.Context, email string) {
+	user, err := a.cfg.DB.GetUserByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't look up account for password reset: %v", err)
+		return
+	}
+	if err := a.sendPasswordReset(ctx, user); err != nil {
+		log.Printf("couldn't send password reset to user %s: %v", user.ID, err)
+	}
+}
+
+// handlerResetPassword sets a new password with an emailed reset token and
+// signs the account out everywhere.
+func (a *API) handlerResetPassword(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "couldn't decode request", err)
+		return
+	}
+	if req.Password == "" {
+		response.RespondWithError(w, http.StatusBadRequest, "password is required", nil)
+		return
+	}
+
+	userID, resetID, err := auth.ValidateSingleUseToken(req.Token, auth.TokenTypePasswordReset, a.cfg.JWTSecret)
+	if err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "invalid or expired reset token", err)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(req.Password)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't hash password", err)
+		return
+	}
+
+	err = a.cfg.DB.ResetPassword(r.Context(), userID, resetID, hashedPassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, http.StatusBadRequest, "reset token was already used or has expired", err)
+		return
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't reset password", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerChangePassword replaces the signed-in user's password. Every
+// session, including this one, is signed out, and the caller gets tokens for
+// a new session in return.
+func (a *API) handlerChangePassword(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+		DeviceName      string `json:"device_name"`
+	}
+
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "couldn't decode request", err)
+		return
+	}
+	if req.NewPassword == "" {
+		response.RespondWithError(w, http.StatusBadRequest, "new_password is required", nil)
+		return
+	}
+	if !checkDeviceName(w, req.DeviceName) {
+		return
+	}
+
+	user, err := a.cfg.DB.GetUserByID(r.Context(), userID)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't get user", err)
+		return
+	}
+	match, err := auth.CheckPasswordHash(req.CurrentPassword, user.HashedPassword)
+	if err != nil || !match {
+		response.RespondWithError(w, http.StatusForbidden, "current password is incorrect", err)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't hash password", err)
+		return
+	}
+	if err := a.cfg.DB.ChangePassword(r.Context(), userID, hashedPassword); err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't change password", err)
+		return
+	}
+
+	tokens, err := a.startSession(r, userID, req.DeviceName)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "password changed, but couldn't start a new session", err)
+		return
+	}
+	response.RespondWithJSON(w, http.StatusOK, tokens)
+}
+
+// sendPasswordReset records a reset for the user and emails its token. Resets
+// over the resend limits are dropped silently.
+func (a *API) sendPasswordReset(ctx context.Context, user database.User) error {
+	err := a.claimAccountEmail(ctx, user.ID, database.AccountEmailPasswordReset)
+	if errors.Is(err, errResendLimited) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	reset, err := a.cfg.DB.CreatePasswordReset(ctx, database.CreatePasswordResetParams{
+		ID:        uuid.New(),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().UTC().Add(passwordResetTTL),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't save password reset: %w", err)
+	}
+
+	token, err := auth.MakeSingleUseToken(auth.TokenTypePasswordReset, user.ID, reset.ID, a.cfg.JWTSecret, passwordResetTTL)
+	if err != nil {
+		return fmt.Errorf("couldn't sign reset token: %w", err)
+	}
+
+	return a.cfg.Mailer.Send(ctx, passwordResetEmail(user.Email, a.cfg.AppURL, token))
+}
+
+func passwordResetEmail(to, appURL, token string) mail.Message {
+	action := "Set a new one by sending this token to POST /v1/password-reset/confirm:\n\n" + token
+	if appURL != "" {
+		action = "Set a new one by opening this link:\n\n" + appURL + "/reset-password?token=" + url.QueryEscape(token)
+	}
+	return mail.Message{
+		To:      to,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password of your time capsule account.\n\n%s\n\nThe token expires in %d minutes and signs out all your devices. If you didn't ask for this, ignore this email; your password hasn't changed.\n",
+			action, int(passwordResetTTL/time.Minute),
+		),
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mnhsh/time-capsule/internal/mail"
+)
+
+const newPassword = "tr0ub4dor&3"
+
+func requestPasswordReset(t *testing.T, a *API, email string) {
+	t.Helper()
+	rec := post(t, a.handlerRequestPasswordReset, map[string]string{"email": email})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("request reset: status %d: %s", rec.Code, rec.Body)
+	}
+	flushEmails(t, a)
+}
+
+func TestPasswordResetTokenWorksOnce(t *testing.T) {
+	a, store := newTestAPI(t)
+	store.addUser(t, testEmail, testPassword)
+	session := signIn(t, a)
+
+	requestPasswordReset(t, a, testEmail)
+	token := mailedToken(t, a, testEmail)
+
+	rec := post(t, a.handlerResetPassword, map[string]string{"token": token, "password": newPassword})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("reset: status %d: %s", rec.Code, rec.Body)
+	}
+	rec = post(t, a.handlerResetPassword, map[string]string{"token": token, "password": "something else"})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("second use: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	if authorized(a, session.AccessToken) {
+		t.Error("a session from before the reset is still signed in")
+	}
+	rec = post(t, a.handlerLogin, map[string]string{"email": testEmail, "password": newPassword})
+	if rec.Code != http.StatusOK {
+		t.Errorf("login with the new password: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestPasswordResetRejectsVerificationToken(t *testing.T) {
+	a, _ := newTestAPI(t)
+	rec := post(t, a.handlerUsers, map[string]string{"email": testEmail, "password": testPassword})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register: status %d: %s", rec.Code, rec.Body)
+	}
+
+	token := mailedToken(t, a, testEmail)
+	rec = post(t, a.handlerResetPassword, map[string]string{"token": token, "password": newPassword})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPasswordResetRequestsAreRateLimited(t *testing.T) {
+	a, store := newTestAPI(t)
+	store.addUser(t, testEmail, testPassword)
+
+	requestPasswordReset(t, a, testEmail)
+	requestPasswordReset(t, a, testEmail)
+	requestPasswordReset(t, a, "nobody@example.com")
+
+	if sent := a.cfg.Mailer.(*mail.MemoryMailer).Sent(); len(sent) != 1 {
+		t.Errorf("sent %d emails, want 1", len(sent))
+	}
+}
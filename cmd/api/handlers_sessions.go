@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	uuid "github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/auth"
+	"github.com/mnhsh/time-capsule/internal/database"
+	response "github.com/mnhsh/time-capsule/internal/response"
+)
+
+// maxUserAgentLength and maxDeviceNameLength keep a hostile client from
+// filling the sessions table. The device name is counted in characters, the
+// user agent in bytes.
+const (
+	maxUserAgentLength  = 512
+	maxDeviceNameLength = 100
+)
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// startSession signs the user in on the device making the request. Every
+// session starts a new refresh token family, whose id is the session's.
+func (a *API) startSession(r *http.Request, userID uuid.UUID, deviceName string) (tokenResponse, error) {
+	refreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("couldn't create refresh token: %w", err)
+	}
+
+	expiresAt := time.Now().UTC().Add(refreshTokenTTL)
+	ua, ip := userAgent(r), a.clientIP(r)
+	session, err := a.cfg.DB.StartSession(r.Context(), database.CreateSessionParams{
+		ID:         uuid.New(),
+		UserID:     userID,
+		ExpiresAt:  expiresAt,
+		DeviceName: sql.NullString{String: deviceName, Valid: deviceName != ""},
+		UserAgent:  sql.NullString{String: ua, Valid: ua != ""},
+		Ip:         sql.NullString{String: ip, Valid: ip != ""},
+	}, database.CreateRefreshTokenParams{
+		TokenHash: auth.HashRefreshToken(refreshToken),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("couldn't save refresh token: %w", err)
+	}
+
+	accessToken, err := auth.MakeJwt(userID, session.ID, a.cfg.JWTSecret, accessTokenTTL)
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("couldn't create access JWT: %w", err)
+	}
+	return tokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL / time.Second),
+	}, nil
+}
+
+func (a *API) handlerListSessions(w http.ResponseWriter, r *http.Request) {
+	type Session struct {
+		ID         string    `json:"id"`
+		DeviceName string    `json:"device_name,omitempty"`
+		UserAgent  string    `json:"user_agent,omitempty"`
+		IP         string    `json:"ip,omitempty"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastUsedAt time.Time `json:"last_used_at"`
+		ExpiresAt  time.Time `json:"expires_at"`
+		// Current marks the session the request was made from.
+		Current bool `json:"current"`
+	}
+
+	type SessionsResponse struct {
+		Sessions []Session `json:"sessions"`
+	}
+
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+	current, _ := r.Context().Value(auth.SessionIDKey).(uuid.UUID)
+
+	dbSessions, err := a.cfg.DB.ListActiveSessions(r.Context(), userID)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't list sessions", err)
+		return
+	}
+	sessions := make([]Session, 0, len(dbSessions))
+	for _, s := range dbSessions {
+		sessions = append(sessions, Session{
+			ID:         s.ID.String(),
+			DeviceName: s.DeviceName.String,
+			UserAgent:  s.UserAgent.String,
+			IP:         s.Ip.String,
+			CreatedAt:  s.CreatedAt,
+			LastUsedAt: s.LastUsedAt,
+			ExpiresAt:  s.ExpiresAt,
+			Current:    s.ID == current,
+		})
+	}
+	response.RespondWithJSON(w, http.StatusOK, SessionsResponse{
+		Sessions: sessions,
+	})
+}
+
+// handlerRevokeSession signs one device out. Its refresh token stops working
+// and so do access tokens already issued to it.
+func (a *API) handlerRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "invalid session id", err)
+		return
+	}
+
+	err = a.cfg.DB.EndSession(r.Context(), userID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, http.StatusNotFound, "no active session with that id", nil)
+		return
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't revoke session", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerRevokeAllSessions signs the user out everywhere, including the
+// session making the request.
+func (a *API) handlerRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+
+	if err := a.cfg.DB.EndAllSessions(r.Context(), userID); err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't revoke sessions", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clientIP returns the address the request came from. X-Forwarded-For is
+// only believed when the API is configured to run behind a proxy.
+func (a *API) clientIP(r *http.Request) string {
+	if a.cfg.TrustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// userAgent returns the request's User-Agent as valid UTF-8, cut on a rune
+// boundary to at most maxUserAgentLength bytes.
+func userAgent(r *http.Request) string {
+	ua := strings.ToValidUTF8(r.UserAgent(), "")
+	if len(ua) <= maxUserAgentLength {
+		return ua
+	}
+	n := maxUserAgentLength
+	for n > 0 && !utf8.RuneStart(ua[n]) {
+		n--
+	}
+	return ua[:n]
+}
+
+// checkDeviceName responds with 400 and returns false if name is too long
+// to label a session with.
+func checkDeviceName(w http.ResponseWriter, name string) bool {
+	if utf8.RuneCountInString(name) > maxDeviceNameLength {
+		response.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("device_name must be at most %d characters", maxDeviceNameLength), nil)
+		return false
+	}
+	return true
+}
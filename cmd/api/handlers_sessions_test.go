@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/mnhsh/time-capsule/internal/auth"
+)
+
+// serveWithToken runs handler behind the auth middleware, as the router does.
+func serveWithToken(a *API, accessToken string, handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rec := httptest.NewRecorder()
+	auth.WithAuthMiddleware(a.cfg, handler).ServeHTTP(rec, req)
+	return rec
+}
+
+type listedSession struct {
+	ID         string `json:"id"`
+	DeviceName string `json:"device_name"`
+	Current    bool   `json:"current"`
+}
+
+func listSessions(t *testing.T, a *API, accessToken string) []listedSession {
+	t.Helper()
+	rec := serveWithToken(a, accessToken, a.handlerListSessions, httptest.NewRequest(http.MethodGet, "/v1/sessions", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list sessions: status %d: %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		Sessions []listedSession `json:"sessions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Sessions
+}
+
+// signInOn is signIn with a device name for the session.
+func signInOn(t *testing.T, a *API, device string) tokenResponse {
+	t.Helper()
+	rec := post(t, a.handlerLogin, map[string]string{"email": testEmail, "password": testPassword, "device_name": device})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", rec.Code, rec.Body)
+	}
+	var tokens tokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestLoginCapsDeviceName(t *testing.T) {
+	a, store := newTestAPI(t)
+	store.addUser(t, testEmail, testPassword)
+
+	// The cap counts characters, so a name of multi-byte ones fits.
+	signInOn(t, a, strings.Repeat("é", maxDeviceNameLength))
+
+	rec := post(t, a.handlerLogin, map[string]string{
+		"email":       testEmail,
+		"password":    testPassword,
+		"device_name": strings.Repeat("a", maxDeviceNameLength+1),
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if len(store.sessions) != 1 {
+		t.Errorf("%d sessions started, want 1", len(store.sessions))
+	}
+}
+
+func TestUserAgentIsCutOnRuneBoundary(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "x"+strings.Repeat("€", maxUserAgentLength))
+
+	ua := userAgent(req)
+	if len(ua) > maxUserAgentLength {
+		t.Errorf("user agent is %d bytes, want at most %d", len(ua), maxUserAgentLength)
+	}
+	if !utf8.ValidString(ua) {
+		t.Error("user agent was cut inside a character")
+	}
+}
+
+func TestListSessionsMarksCurrentDevice(t *testing.T) {
+	a, store := newTestAPI(t)
+	store.addUser(t, testEmail, testPassword)
+	laptop := signInOn(t, a, "laptop")
+	signInOn(t, a, "phone")
+
+	sessions := listSessions(t, a, laptop.AccessToken)
+	if len(sessions) != 2 {
+		t.Fatalf("listed %d sessions, want 2", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Current != (s.DeviceName == "laptop") {
+			t.Errorf("session on %s has current = %t", s.DeviceName, s.Current)
+		}
+	}
+}
+
+func TestRevokeSessionSignsDeviceOut(t *testing.T) {
+	a, store := newTestAPI(t)
+	store.addUser(t, testEmail, testPassword)
+	laptop := signInOn(t, a, "laptop")
+	phone := signInOn(t, a, "phone")
+
+	var phoneID string
+	for _, s := range listSessions(t, a, laptop.AccessToken) {
+		if s.DeviceName == "phone" {
+			phoneID = s.ID
+		}
+	}
+
+	revoke := func() int {
+		req := httptest.NewRequest(http.MethodDelete, "/v1/sessions/"+phoneID, nil)
+		req.SetPathValue("id", phoneID)
+		return serveWithToken(a, laptop.AccessToken, a.handlerRevokeSession, req).Code
+	}
+	if status := revoke(); status != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", status)
+	}
+	if status := revoke(); status != http.StatusNotFound {
+		t.Errorf("second revoke: status = %d, want %d", status, http.StatusNotFound)
+	}
+
+	if authorized(a, phone.AccessToken) {
+		t.Error("the revoked session's access token still works")
+	}
+	if rec, _ := refresh(t, a, phone.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh of the revoked session: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if sessions := listSessions(t, a, laptop.AccessToken); len(sessions) != 1 {
+		t.Errorf("listed %d sessions after the revoke, want 1", len(sessions))
+	}
+}
+
+func TestRevokeAllSessionsSignsEveryDeviceOut(t *testing.T) {
+	a, store := newTestAPI(t)
+	store.addUser(t, testEmail, testPassword)
+	laptop := signInOn(t, a, "laptop")
+	phone := signInOn(t, a, "phone")
+
+	rec := serveWithToken(a, laptop.AccessToken, a.handlerRevokeAllSessions, httptest.NewRequest(http.MethodDelete, "/v1/sessions", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke all: status %d: %s", rec.Code, rec.Body)
+	}
+	for device, tokens := range map[string]tokenResponse{"laptop": laptop, "phone": phone} {
+		if authorized(a, tokens.AccessToken) {
+			t.Errorf("the %s is still signed in", device)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/auth"
+)
+
+// capsuleForm builds a POST /v1/capsules body holding file.
+func capsuleForm(t *testing.T, file []byte) ([]byte, string) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("title", "letter"); err != nil {
+		t.Fatal(err)
+	}
+	if err := form.WriteField("unlock_at", "2030-01-01T00:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	part, err := form.CreateFormFile("capsule_file", "letter.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body.Bytes(), form.FormDataContentType()
+}
+
+func createCapsule(a *API, userID uuid.UUID, body []byte, contentType string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/capsules", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	a.handlerCreateCapsule(rec, asUser(req, userID))
+	return rec
+}
+
+func TestCreateCapsuleStoresEncryptedFile(t *testing.T) {
+	a, store := newTestAPI(t)
+	user := store.addUser(t, testEmail, testPassword)
+	file := bytes.Repeat([]byte("dear future me "), 1000)
+
+	body, contentType := capsuleForm(t, file)
+	rec := createCapsule(a, user.ID, body, contentType)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	if len(store.capsules) != 1 {
+		t.Fatalf("saved %d capsules, want 1", len(store.capsules))
+	}
+	for _, c := range store.capsules {
+		sum := sha256.Sum256(file)
+		if c.SizeBytes.Int64 != int64(len(file)) {
+			t.Errorf("size = %d, want %d", c.SizeBytes.Int64, len(file))
+		}
+		if c.Sha256.String != hex.EncodeToString(sum[:]) {
+			t.Errorf("sha256 = %s, want that of the file", c.Sha256.String)
+		}
+		obj, err := a.cfg.Storage.Get(t.Context(), c.S3key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stored bytes.Buffer
+		if _, err := stored.ReadFrom(obj.Body); err != nil {
+			t.Fatal(err)
+		}
+		obj.Body.Close()
+		if bytes.Contains(stored.Bytes(), file[:64]) {
+			t.Error("the file was stored in plaintext")
+		}
+	}
+}
+
+func TestCreateCapsuleRejectsTruncatedBody(t *testing.T) {
+	a, store := newTestAPI(t)
+	user := store.addUser(t, testEmail, testPassword)
+
+	body, contentType := capsuleForm(t, bytes.Repeat([]byte("x"), 4096))
+	// Cut the body inside the file, before the closing boundary.
+	rec := createCapsule(a, user.ID, body[:len(body)-1024], contentType)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if len(store.capsules) != 0 {
+		t.Error("a capsule was saved for a truncated file")
+	}
+	if keys := storedKeys(t, a, user.ID.String()+"/"); len(keys) != 0 {
+		t.Errorf("objects left behind: %v", keys)
+	}
+}
+
+func TestCreateCapsuleRejectsFileOverLimit(t *testing.T) {
+	a, store := newTestAPI(t)
+	user := store.addUser(t, testEmail, testPassword)
+
+	body, contentType := capsuleForm(t, bytes.Repeat([]byte("x"), int(a.cfg.MaxUploadSize)+1))
+	rec := createCapsule(a, user.ID, body, contentType)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if len(store.capsules) != 0 {
+		t.Error("a capsule was saved for a file over the limit")
+	}
+	if keys := storedKeys(t, a, user.ID.String()+"/"); len(keys) != 0 {
+		t.Errorf("objects left behind: %v", keys)
+	}
+}
+
+// signIn logs in with the test credentials and returns the session's tokens.
+func signIn(t *testing.T, a *API) tokenResponse {
+	t.Helper()
+	return signInOn(t, a, "")
+}
+
+func refresh(t *testing.T, a *API, refreshToken string) (*httptest.ResponseRecorder, tokenResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+refreshToken)
+	rec := httptest.NewRecorder()
+	a.handlerRefreshToken(rec, req)
+	var tokens tokenResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &tokens); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec, tokens
+}
+
+// authorized reports whether the auth middleware lets accessToken through.
+func authorized(a *API, accessToken string) bool {
+	req := httptest.NewRequest(http.MethodGet, "/v1/capsules", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rec := httptest.NewRecorder()
+	ok := false
+	auth.WithAuthMiddleware(a.cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok = true
+	})).ServeHTTP(rec, req)
+	return ok
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	a, store := newTestAPI(t)
+	store.addUser(t, testEmail, testPassword)
+	first := signIn(t, a)
+
+	rec, second := refresh(t, a, first.RefreshToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: status %d: %s", rec.Code, rec.Body)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("refresh handed back the same refresh token")
+	}
+	if !authorized(a, second.AccessToken) {
+		t.Error("the new access token is refused")
+	}
+
+	rec, _ = refresh(t, a, second.RefreshToken)
+	if rec.Code != http.StatusOK {
+		t.Errorf("refresh with the rotated token: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	a, store := newTestAPI(t)
+	store.addUser(t, testEmail, testPassword)
+	stolen := signIn(t, a)
+	other := signIn(t, a)
+
+	rec, rotated := refresh(t, a, stolen.RefreshToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec, _ = refresh(t, a, stolen.RefreshToken)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reuse: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	// Whoever holds the newer token is signed out too.
+	if rec, _ := refresh(t, a, rotated.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after reuse: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if authorized(a, rotated.AccessToken) {
+		t.Error("an access token of the revoked session still works")
+	}
+
+	// Other logins have families of their own.
+	if rec, _ := refresh(t, a, other.RefreshToken); rec.Code != http.StatusOK {
+		t.Errorf("refresh of another session: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestLoginNormalisesEmail(t *testing.T) {
+	a, store := newTestAPI(t)
+	store.addUser(t, testEmail, testPassword)
+
+	rec := post(t, a.handlerLogin, map[string]string{"email": "  " + testEmail + "\n", "password": testPassword})
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/auth"
+	"github.com/mnhsh/time-capsule/internal/database"
+	response "github.com/mnhsh/time-capsule/internal/response"
+	"github.com/mnhsh/time-capsule/internal/storage"
+)
+
+// Resumable uploads implement tus 1.0.0 (https://tus.io/protocols/resumable-upload)
+// with the creation and termination extensions. Upload-Metadata must carry
+// unlock_at (RFC 3339) and may carry title; once the last byte arrives the
+// capsule is created exactly like a regular POST /v1/capsules.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	tusPartSize   = 8 << 20
+	// uploadCompletionTimeout bounds assembling and encrypting a finished
+	// upload, which reads the whole object back.
+	uploadCompletionTimeout = 30 * time.Minute
+)
+
+var errChunkTooLarge = errors.New("chunk exceeds Upload-Length")
+
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// checkTusVersion rejects requests from clients speaking another protocol
+// version, as the spec requires.
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		response.RespondWithError(w, http.StatusPreconditionFailed, "unsupported tus version", nil)
+		return false
+	}
+	return true
+}
+
+func (a *API) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(a.cfg.MaxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+	if !a.requireVerifiedEmail(w, r, userID) {
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		response.RespondWithError(w, http.StatusBadRequest, "deferred upload length is not supported", nil)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		response.RespondWithError(w, http.StatusBadRequest, "invalid Upload-Length", err)
+		return
+	}
+	if length > a.cfg.MaxUploadSize {
+		response.RespondWithError(w, http.StatusRequestEntityTooLarge, "file too large", nil)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "invalid Upload-Metadata", err)
+		return
+	}
+	unlockAt, err := time.Parse(time.RFC3339, metadata["unlock_at"])
+	if err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "Upload-Metadata must include unlock_at in RFC 3339 format", err)
+		return
+	}
+	title := metadata["title"]
+
+	s3Key := fmt.Sprintf("%s/%s", userID, uuid.New().String())
+	cu, err := storage.StartChunkedUpload(r.Context(), a.cfg.Storage, s3Key, metadata["filetype"])
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't start upload", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	upload, err := a.cfg.DB.CreateUpload(r.Context(), database.CreateUploadParams{
+		ID:           uuid.New(),
+		UserID:       userID,
+		CapsuleID:    uuid.New(),
+		S3key:        s3Key,
+		S3UploadID:   cu.UploadID,
+		UploadLength: length,
+		Title:        sql.NullString{String: title, Valid: title != ""},
+		UnlockAt:     unlockAt.UTC(),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	})
+	if err != nil {
+		if err := storage.AbortChunkedUpload(context.WithoutCancel(r.Context()), a.cfg.Storage, cu); err != nil {
+			log.Printf("couldn't abort upload %s: %v", cu.UploadID, err)
+		}
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't save upload", err)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/uploads/"+upload.ID.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (a *API) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	upload, ok := a.getOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.UploadLength, 10))
+	if upload.CompletedAt.Valid {
+		w.Header().Set("Capsule-Id", upload.CapsuleID.String())
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *API) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		response.RespondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+
+	owned, ok := a.getOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "invalid Upload-Offset", err)
+		return
+	}
+
+	var (
+		upload    database.Upload
+		cu        *storage.ChunkedUpload
+		newOffset int64
+		appendErr error
+	)
+	// The upload stays locked while the chunk is stored, so an overlapping
+	// PATCH is turned away instead of writing the same parts. Progress is
+	// saved even if the client hangs up midway.
+	ctx := context.WithoutCancel(r.Context())
+	err = a.cfg.DB.WriteUpload(ctx, owned.ID, owned.UserID, func(q database.Querier, u database.Upload) error {
+		upload = u
+		newOffset = u.UploadOffset
+		if offset != u.UploadOffset || u.CompletedAt.Valid {
+			return nil
+		}
+
+		remaining := u.UploadLength - u.UploadOffset
+		if r.ContentLength > remaining {
+			return errChunkTooLarge
+		}
+
+		cu = &storage.ChunkedUpload{
+			Key:      u.S3key,
+			UploadID: u.S3UploadID,
+			TailSize: u.TailSize,
+		}
+		if err := json.Unmarshal(u.Parts, &cu.Parts); err != nil {
+			return fmt.Errorf("couldn't read upload state: %w", err)
+		}
+
+		// Whatever arrived before a dropped connection is kept; the client
+		// picks up from the recorded offset on its next PATCH.
+		var written int64
+		written, appendErr = storage.AppendChunk(r.Context(), a.cfg.Storage, cu, io.LimitReader(r.Body, remaining), tusPartSize)
+		newOffset += written
+		if written == 0 && cu.TailSize == u.TailSize {
+			return nil
+		}
+
+		parts, err := json.Marshal(cu.Parts)
+		if err != nil {
+			return fmt.Errorf("couldn't encode upload state: %w", err)
+		}
+		n, err := q.UpdateUploadProgress(ctx, database.UpdateUploadProgressParams{
+			ID:             u.ID,
+			UploadOffset:   newOffset,
+			TailSize:       cu.TailSize,
+			Parts:          parts,
+			ExpectedOffset: u.UploadOffset,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't save upload progress: %w", err)
+		}
+		if n == 0 {
+			return database.ErrUploadBusy
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, database.ErrUploadBusy):
+		response.RespondWithError(w, http.StatusConflict, "upload is being written by another request", nil)
+		return
+	case errors.Is(err, errChunkTooLarge):
+		response.RespondWithError(w, http.StatusRequestEntityTooLarge, "chunk exceeds Upload-Length", nil)
+		return
+	case err != nil:
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't save upload progress", err)
+		return
+	}
+
+	if offset != upload.UploadOffset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+		response.RespondWithError(w, http.StatusConflict, "Upload-Offset does not match the current offset", nil)
+		return
+	}
+	if upload.CompletedAt.Valid {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+		w.Header().Set("Capsule-Id", upload.CapsuleID.String())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if appendErr != nil {
+		respondWithUploadError(w, appendErr)
+		return
+	}
+
+	if newOffset == upload.UploadLength {
+		if err := a.completeUpload(r.Context(), upload, cu); err != nil {
+			// Everything but a corrupt assembly is kept, and the client
+			// retries with an empty PATCH at the final offset.
+			response.RespondWithError(w, http.StatusInternalServerError, "couldn't complete upload", err)
+			return
+		}
+		w.Header().Set("Capsule-Id", upload.CapsuleID.String())
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload assembles the object, encrypts it and creates the capsule it
+// belongs to. It runs detached from the request, since a client that hangs up
+// after its last chunk would otherwise cut it short. It is safe to retry: an
+// object assembled by an earlier attempt that died before the capsule was
+// saved is used as is.
+func (a *API) completeUpload(ctx context.Context, upload database.Upload, cu *storage.ChunkedUpload) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), uploadCompletionTimeout)
+	defer cancel()
+
+	_, err := a.cfg.Storage.Head(ctx, upload.S3key)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		if err := storage.FinishChunkedUpload(ctx, a.cfg.Storage, cu); err != nil {
+			return err
+		}
+	case err != nil:
+		return fmt.Errorf("couldn't check for assembled upload: %w", err)
+	}
+
+	encryptedKey, sealed, err := a.encryptStoredObject(ctx, upload.S3key)
+	if err != nil {
+		return err
+	}
+	if sealed.digest.Size != upload.UploadLength {
+		// The assembled object is wrong and the multipart upload can't be
+		// resumed any more, so the client has to start over.
+		a.discardObject(ctx, encryptedKey)
+		a.discardObject(ctx, upload.S3key)
+		if err := a.cfg.DB.DeleteUpload(ctx, upload.ID); err != nil {
+			log.Printf("couldn't delete upload %s: %v", upload.ID, err)
+		}
+		return fmt.Errorf("assembled upload %s has %d bytes, expected %d", upload.ID, sealed.digest.Size, upload.UploadLength)
+	}
+
+	err = a.cfg.DB.CompleteUpload(ctx, upload.ID, database.CreateCapsuleParams{
+		ID:           upload.CapsuleID,
+		UserID:       upload.UserID,
+		Title:        upload.Title,
+		CreatedAt:    time.Now().UTC(),
+		S3key:        encryptedKey,
+		UnlockAt:     upload.UnlockAt,
+		IsUnlocked:   sql.NullBool{Bool: false, Valid: true},
+		UploadStatus: database.UploadStatusComplete,
+		SizeBytes:    sql.NullInt64{Int64: sealed.digest.Size, Valid: true},
+		Sha256:       sql.NullString{String: sealed.digest.SHA256, Valid: true},
+		WrappedKey:   sealed.key.wrapped,
+		EscrowedKey:  sealed.key.escrowed,
+		ObjectSha256: sql.NullString{String: sealed.objectSHA256, Valid: true},
+	})
+	if err != nil {
+		// Either a concurrent PATCH finished first and its capsule owns the
+		// assembled object, or the next attempt encrypts it again.
+		a.discardObject(ctx, encryptedKey)
+	}
+	if errors.Is(err, database.ErrUploadCompleted) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a.discardObject(ctx, upload.S3key)
+	return nil
+}
+
+func (a *API) handlerTusTerminate(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	upload, ok := a.getOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+	if upload.CompletedAt.Valid {
+		response.RespondWithError(w, http.StatusConflict, "upload is complete; delete the capsule instead", nil)
+		return
+	}
+
+	cu := &storage.ChunkedUpload{
+		Key:      upload.S3key,
+		UploadID: upload.S3UploadID,
+		TailSize: upload.TailSize,
+	}
+	if err := storage.AbortChunkedUpload(r.Context(), a.cfg.Storage, cu); err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't discard upload", err)
+		return
+	}
+	if err := a.cfg.DB.DeleteUpload(r.Context(), upload.ID); err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't delete upload", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) getOwnedUpload(w http.ResponseWriter, r *http.Request) (database.Upload, bool) {
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return database.Upload{}, false
+	}
+
+	uploadID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		response.RespondWithError(w, http.StatusNotFound, "upload not found", err)
+		return database.Upload{}, false
+	}
+
+	upload, err := a.cfg.DB.GetUploadForUser(r.Context(), database.GetUploadForUserParams{
+		ID:     uploadID,
+		UserID: userID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, http.StatusNotFound, "upload not found", nil)
+		return database.Upload{}, false
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't get upload", err)
+		return database.Upload{}, false
+	}
+	return upload, true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// "key base64value" pairs, where the value may be omitted.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("metadata %q: %w", fields[0], err)
+			}
+			metadata[fields[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("malformed metadata pair %q", pair)
+		}
+	}
+	return metadata, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/database"
+)
+
+// createTusUpload starts a resumable upload of length bytes and returns its id.
+func createTusUpload(t *testing.T, a *API, userID uuid.UUID, length int) uuid.UUID {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/uploads", nil)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", "unlock_at "+base64.StdEncoding.EncodeToString([]byte("2030-01-01T00:00:00Z")))
+	rec := httptest.NewRecorder()
+	a.handlerTusCreate(rec, asUser(req, userID))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+	}
+	id, err := uuid.Parse(path.Base(rec.Header().Get("Location")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func tusRequest(method string, id, userID uuid.UUID, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, "/v1/uploads/"+id.String(), body)
+	req.SetPathValue("id", id.String())
+	req.Header.Set("Tus-Resumable", tusVersion)
+	return asUser(req, userID)
+}
+
+func patchUpload(a *API, id, userID uuid.UUID, offset int, body io.Reader) *httptest.ResponseRecorder {
+	req := tusRequest(http.MethodPatch, id, userID, body)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	rec := httptest.NewRecorder()
+	a.handlerTusPatch(rec, req)
+	return rec
+}
+
+func uploadOffset(t *testing.T, a *API, id, userID uuid.UUID) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	a.handlerTusHead(rec, tusRequest(http.MethodHead, id, userID, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("head: status %d", rec.Code)
+	}
+	return rec.Header().Get("Upload-Offset")
+}
+
+// droppedConnection yields its data and then fails, like a request body
+// whose client went away mid-upload.
+type droppedConnection struct {
+	data []byte
+}
+
+func (d *droppedConnection) Read(p []byte) (int, error) {
+	if len(d.data) == 0 {
+		return 0, errors.New("connection reset by peer")
+	}
+	n := copy(p, d.data)
+	d.data = d.data[n:]
+	return n, nil
+}
+
+func TestTusPatchRejectsOffsetMismatch(t *testing.T) {
+	a, store := newTestAPI(t)
+	user := store.addUser(t, testEmail, testPassword)
+	id := createTusUpload(t, a, user.ID, 100)
+
+	if rec := patchUpload(a, id, user.ID, 0, strings.NewReader("0123456789")); rec.Code != http.StatusNoContent {
+		t.Fatalf("first patch: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec := patchUpload(a, id, user.ID, 0, strings.NewReader("0123456789"))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if got := rec.Header().Get("Upload-Offset"); got != "10" {
+		t.Errorf("Upload-Offset = %q, want the current offset 10", got)
+	}
+	if got := uploadOffset(t, a, id, user.ID); got != "10" {
+		t.Errorf("offset after the rejected patch = %s, want 10", got)
+	}
+}
+
+func TestTusPatchTurnsAwayConcurrentWrite(t *testing.T) {
+	a, store := newTestAPI(t)
+	user := store.addUser(t, testEmail, testPassword)
+	id := createTusUpload(t, a, user.ID, 100)
+
+	// Another PATCH holds the upload.
+	store.writing[id] = true
+	rec := patchUpload(a, id, user.ID, 0, strings.NewReader("0123456789"))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if got := store.uploads[id].UploadOffset; got != 0 {
+		t.Errorf("offset = %d, want 0", got)
+	}
+}
+
+func TestTusPatchResumesAfterInterruption(t *testing.T) {
+	a, store := newTestAPI(t)
+	user := store.addUser(t, testEmail, testPassword)
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	id := createTusUpload(t, a, user.ID, len(content))
+
+	rec := patchUpload(a, id, user.ID, 0, &droppedConnection{data: content[:40]})
+	if rec.Code == http.StatusNoContent {
+		t.Fatal("an interrupted patch succeeded")
+	}
+	if got := uploadOffset(t, a, id, user.ID); got != "40" {
+		t.Fatalf("offset after the interruption = %s, want 40", got)
+	}
+
+	rec = patchUpload(a, id, user.ID, 40, bytes.NewReader(content[40:]))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("resumed patch: status %d: %s", rec.Code, rec.Body)
+	}
+	capsuleID, err := uuid.Parse(rec.Header().Get("Capsule-Id"))
+	if err != nil {
+		t.Fatalf("no Capsule-Id after the last byte: %v", err)
+	}
+
+	c, ok := store.capsules[capsuleID]
+	if !ok {
+		t.Fatal("the capsule wasn't saved")
+	}
+	sum := sha256.Sum256(content)
+	if c.SizeBytes.Int64 != int64(len(content)) || c.Sha256.String != hex.EncodeToString(sum[:]) {
+		t.Errorf("capsule has %d bytes with sha256 %s, want the whole upload", c.SizeBytes.Int64, c.Sha256.String)
+	}
+	if c.UploadStatus != database.UploadStatusComplete {
+		t.Errorf("upload status = %s, want %s", c.UploadStatus, database.UploadStatusComplete)
+	}
+	// Only the encrypted object is left: the tail and the plaintext are gone.
+	if keys := storedKeys(t, a, user.ID.String()+"/"); len(keys) != 1 || keys[0] != c.S3key {
+		t.Errorf("stored objects = %v, want only %s", keys, c.S3key)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/auth"
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/mail"
+	response "github.com/mnhsh/time-capsule/internal/response"
+)
+
+const (
+	emailVerificationTTL = 48 * time.Hour
+	// A user can be sent an account email of each kind once per
+	// resendInterval, and at most maxResendsPerDay times a day.
+	resendInterval   = time.Minute
+	maxResendsPerDay = 5
+)
+
+// errResendLimited means the user has been sent as many account emails of a
+// kind as the resend limits allow for now.
+var errResendLimited = errors.New("too many account emails")
+
+// handlerVerifyEmail confirms the address a verification token was sent to.
+// It needs no access token, so the link works on any device.
+func (a *API) handlerVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Token string `json:"token"`
+	}
+
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "couldn't decode request", err)
+		return
+	}
+
+	userID, verificationID, err := auth.ValidateSingleUseToken(req.Token, auth.TokenTypeEmailVerification, a.cfg.JWTSecret)
+	if err != nil {
+		response.RespondWithError(w, http.StatusBadRequest, "invalid or expired verification token", err)
+		return
+	}
+
+	err = a.cfg.DB.VerifyEmail(r.Context(), userID, verificationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, http.StatusBadRequest, "verification token was already used or has expired", err)
+		return
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't verify email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerResendVerification emails the signed-in user a new verification
+// token. Earlier tokens stay valid until they expire.
+func (a *API) handlerResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserIDKey).(uuid.UUID)
+	if !ok {
+		response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+
+	user, err := a.cfg.DB.GetUserByID(r.Context(), userID)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't get user", err)
+		return
+	}
+	if user.EmailVerifiedAt.Valid {
+		response.RespondWithError(w, http.StatusConflict, "email is already verified", nil)
+		return
+	}
+
+	err = a.sendVerification(r.Context(), user)
+	if errors.Is(err, errResendLimited) {
+		retryAfter, err := a.resendRetryAfter(r.Context(), userID, database.AccountEmailVerification)
+		if err != nil {
+			response.RespondWithError(w, http.StatusInternalServerError, "couldn't check verification emails", err)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		response.RespondWithError(w, http.StatusTooManyRequests, "too many verification emails; try again later", nil)
+		return
+	}
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't send verification email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendVerification records a new verification for the user's address and
+// emails its token. It returns errResendLimited if the user has been sent too
+// many already.
+func (a *API) sendVerification(ctx context.Context, user database.User) error {
+	if err := a.claimAccountEmail(ctx, user.ID, database.AccountEmailVerification); err != nil {
+		return err
+	}
+
+	v, err := a.cfg.DB.CreateEmailVerification(ctx, database.CreateEmailVerificationParams{
+		ID:        uuid.New(),
+		UserID:    user.ID,
+		Email:     user.Email,
+		ExpiresAt: time.Now().UTC().Add(emailVerificationTTL),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't save verification: %w", err)
+	}
+
+	token, err := auth.MakeSingleUseToken(auth.TokenTypeEmailVerification, user.ID, v.ID, a.cfg.JWTSecret, emailVerificationTTL)
+	if err != nil {
+		return fmt.Errorf("couldn't sign verification token: %w", err)
+	}
+
+	return a.cfg.Mailer.Send(ctx, verificationEmail(user.Email, a.cfg.AppURL, token))
+}
+
+func verificationEmail(to, appURL, token string) mail.Message {
+	action := "Confirm it by sending this token to POST /v1/users/verify:\n\n" + token
+	if appURL != "" {
+		action = "Confirm it by opening this link:\n\n" + appURL + "/verify-email?token=" + url.QueryEscape(token)
+	}
+	return mail.Message{
+		To:      to,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf(
+			"Your capsules will be delivered to this address, so we need to know it works.\n\n%s\n\nThe token expires in %d hours. If you didn't create an account, ignore this email.\n",
+			action, int(emailVerificationTTL/time.Hour),
+		),
+	}
+}
+
+// claimAccountEmail counts an account email of kind that is about to be sent
+// to the user. It returns errResendLimited if the resend limits don't allow
+// one now.
+func (a *API) claimAccountEmail(ctx context.Context, userID uuid.UUID, kind string) error {
+	now := a.now().UTC()
+	n, err := a.cfg.DB.ClaimAccountEmail(ctx, database.ClaimAccountEmailParams{
+		UserID:      userID,
+		Kind:        kind,
+		Now:         now,
+		WindowStart: now.Add(-24 * time.Hour),
+		ResendAfter: now.Add(-resendInterval),
+		MaxSends:    maxResendsPerDay,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't check resend limits: %w", err)
+	}
+	if n == 0 {
+		return errResendLimited
+	}
+	return nil
+}
+
+// resendRetryAfter returns how long the user has to wait before they can be
+// sent another account email of kind.
+func (a *API) resendRetryAfter(ctx context.Context, userID uuid.UUID, kind string) (time.Duration, error) {
+	sends, err := a.cfg.DB.GetAccountEmailSends(ctx, database.GetAccountEmailSendsParams{
+		UserID: userID,
+		Kind:   kind,
+	})
+	if err != nil {
+		return 0, err
+	}
+	now := a.now().UTC()
+	wait := sends.LastSentAt.Add(resendInterval).Sub(now)
+	if sends.SentInWindow >= maxResendsPerDay {
+		wait = max(wait, sends.WindowStartedAt.Add(24*time.Hour).Sub(now))
+	}
+	return max(wait, time.Second), nil
+}
+
+// requireVerifiedEmail responds with 403 and returns false unless the user
+// has confirmed their address.
+func (a *API) requireVerifiedEmail(w http.ResponseWriter, r *http.Request, userID uuid.UUID) bool {
+	user, err := a.cfg.DB.GetUserByID(r.Context(), userID)
+	if err != nil {
+		response.RespondWithError(w, http.StatusInternalServerError, "couldn't get user", err)
+		return false
+	}
+	if !user.EmailVerifiedAt.Valid {
+		response.RespondWithError(w, http.StatusForbidden, "verify your email address before creating capsules", nil)
+		return false
+	}
+	return true
+}
+
+// parseEmail accepts a bare address such as jane@example.com, without a
+// display name, and returns it trimmed.
+func parseEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 254 {
+		return "", errors.New("address is too long")
+	}
+	addr, err := netmail.ParseAddress(s)
+	if err != nil {
+		return "", err
+	}
+	if addr.Address != s {
+		return "", errors.New("expected a bare address")
+	}
+	return addr.Address, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mnhsh/time-capsule/internal/mail"
+)
+
+var mailedJWT = regexp.MustCompile(`eyJ[\w-]+\.[\w-]+\.[\w-]+`)
+
+// mailedToken returns the token in the last email the API sent to to.
+func mailedToken(t *testing.T, a *API, to string) string {
+	t.Helper()
+	sent := a.cfg.Mailer.(*mail.MemoryMailer).Sent()
+	for i := len(sent) - 1; i >= 0; i-- {
+		if sent[i].To != to {
+			continue
+		}
+		token := mailedJWT.FindString(sent[i].Body)
+		if token == "" {
+			t.Fatalf("no token in email %q", sent[i].Subject)
+		}
+		return token
+	}
+	t.Fatalf("no email was sent to %s", to)
+	return ""
+}
+
+func TestVerificationTokenWorksOnce(t *testing.T) {
+	a, store := newTestAPI(t)
+	rec := post(t, a.handlerUsers, map[string]string{"email": testEmail, "password": testPassword})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register: status %d: %s", rec.Code, rec.Body)
+	}
+	token := mailedToken(t, a, testEmail)
+
+	if rec := post(t, a.handlerVerifyEmail, map[string]string{"token": token}); rec.Code != http.StatusNoContent {
+		t.Fatalf("verify: status %d: %s", rec.Code, rec.Body)
+	}
+	user, err := store.GetUserByEmail(t.Context(), testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerifiedAt.Valid {
+		t.Error("the address isn't marked verified")
+	}
+
+	if rec := post(t, a.handlerVerifyEmail, map[string]string{"token": token}); rec.Code != http.StatusBadRequest {
+		t.Errorf("second use: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestUnverifiedUserCantCreateCapsules(t *testing.T) {
+	a, store := newTestAPI(t)
+	rec := post(t, a.handlerUsers, map[string]string{"email": testEmail, "password": testPassword})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register: status %d: %s", rec.Code, rec.Body)
+	}
+	user, err := store.GetUserByEmail(t.Context(), testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, contentType := capsuleForm(t, []byte("hello"))
+	if rec := createCapsule(a, user.ID, body, contentType); rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if len(store.capsules) != 0 {
+		t.Error("an unverified user created a capsule")
+	}
+}
+
+func TestResendVerificationIsRateLimited(t *testing.T) {
+	a, store := newTestAPI(t)
+	now := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+	a.now = func() time.Time { return now }
+	rec := post(t, a.handlerUsers, map[string]string{"email": testEmail, "password": testPassword})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register: status %d: %s", rec.Code, rec.Body)
+	}
+	user, err := store.GetUserByEmail(t.Context(), testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resend := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.handlerResendVerification(rec, asUser(httptest.NewRequest(http.MethodPost, "/v1/users/verify/resend", nil), user.ID))
+		return rec
+	}
+
+	// Registration sent the first email a moment ago.
+	rec = resend()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("immediate resend: status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+
+	for i := 1; i < maxResendsPerDay; i++ {
+		now = now.Add(resendInterval)
+		if rec := resend(); rec.Code != http.StatusAccepted {
+			t.Fatalf("resend %d: status %d: %s", i, rec.Code, rec.Body)
+		}
+	}
+	now = now.Add(resendInterval)
+	rec = resend()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("resend over the daily limit: status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	wantWait := 24*time.Hour - time.Duration(maxResendsPerDay)*resendInterval
+	if got := rec.Header().Get("Retry-After"); got != strconv.Itoa(int(wantWait.Seconds())) {
+		t.Errorf("Retry-After = %q, want %d", got, int(wantWait.Seconds()))
+	}
+	if sent := len(a.cfg.Mailer.(*mail.MemoryMailer).Sent()); sent != maxResendsPerDay {
+		t.Errorf("sent %d emails, want %d", sent, maxResendsPerDay)
+	}
+}
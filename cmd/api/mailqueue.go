@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// Account emails that are sent after the response, like password resets,
+	// go through a mailQueue with this many senders and this much room.
+	mailWorkers   = 4
+	mailQueueSize = 256
+	// mailJobTimeout bounds each of them, lookups included.
+	mailJobTimeout = time.Minute
+)
+
+// mailQueue runs jobs that nobody waits on, on a fixed number of goroutines.
+// When it's full, new jobs are turned away instead of piling up goroutines.
+type mailQueue struct {
+	jobs    chan func(context.Context)
+	timeout time.Duration
+	// ctx is cancelled when close gives up waiting for the queue to drain.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newMailQueue(workers, size int, timeout time.Duration) *mailQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &mailQueue{
+		jobs:    make(chan func(context.Context), size),
+		timeout: timeout,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	q.wg.Add(workers)
+	for range workers {
+		go q.work()
+	}
+	return q
+}
+
+func (q *mailQueue) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		ctx, cancel := context.WithTimeout(q.ctx, q.timeout)
+		job(ctx)
+		cancel()
+	}
+}
+
+// enqueue schedules job and reports whether there was room for it. It must
+// not be called once close has been.
+func (q *mailQueue) enqueue(job func(context.Context)) bool {
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops taking jobs and waits for the queued ones to finish. If ctx is
+// done first, the remaining jobs are cancelled and ctx's error is returned.
+func (q *mailQueue) close(ctx context.Context) error {
+	close(q.jobs)
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -3,18 +3,29 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	_ "github.com/lib/pq"
 
 	"github.com/mnhsh/time-capsule/internal/auth"
 	"github.com/mnhsh/time-capsule/internal/config"
 	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/mail"
 	"github.com/mnhsh/time-capsule/internal/storage"
 )
 
+// shutdownTimeout bounds how long a stopping API waits for requests in
+// flight and queued emails.
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	db, err := sql.Open("postgres", os.Getenv("DB_URL"))
 	if err != nil {
@@ -24,15 +35,66 @@ func main() {
 
 	store := database.NewStore(db)
 
-	s3Storage, err := storage.NewS3Storage(context.Background(), "capsule-bucket", "us-east-1", true)
+	backend, err := storage.New(context.Background(), storage.Options{
+		Driver:   os.Getenv("STORAGE_DRIVER"),
+		Bucket:   envOr("S3_BUCKET", "capsule-bucket"),
+		Region:   envOr("AWS_REGION", "us-east-1"),
+		Endpoint: os.Getenv("S3_ENDPOINT"),
+		Dir:      envOr("STORAGE_DIR", "data"),
+	})
+	if err != nil {
+		log.Fatalf("couldn't create storage backend: %v", err)
+	}
+
+	// Capsule content is encrypted with per-capsule keys wrapped by this
+	// master key; generate one with `openssl rand -hex 32`.
+	keys, err := storage.NewLocalKeyManager(os.Getenv("KMS_KEY_FILE"))
+	if err != nil {
+		log.Fatalf("couldn't load KMS_KEY_FILE: %v", err)
+	}
+
+	// With ESCROW_PUBLIC_KEY_FILE set, new capsules are time-locked: their
+	// keys are sealed to the worker's escrow key and only it can release them.
+	var escrow *storage.EscrowSealer
+	if path := os.Getenv("ESCROW_PUBLIC_KEY_FILE"); path != "" {
+		escrow, err = storage.NewEscrowSealer(path)
+		if err != nil {
+			log.Fatalf("couldn't load ESCROW_PUBLIC_KEY_FILE: %v", err)
+		}
+	}
+
+	maxUploadSize := int64(1 << 30)
+	if v := os.Getenv("MAX_UPLOAD_BYTES"); v != "" {
+		maxUploadSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxUploadSize <= 0 {
+			log.Fatalf("invalid MAX_UPLOAD_BYTES %q", v)
+		}
+	}
+
+	mailer, err := mail.New(mail.Options{
+		Driver:   os.Getenv("MAIL_DRIVER"),
+		From:     envOr("MAIL_FROM", "no-reply@timecapsule.local"),
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		Dir:      envOr("MAIL_DIR", "mail"),
+	})
 	if err != nil {
-		log.Fatalf("couldn't create S3 client: %v", err)
+		log.Fatalf("couldn't create mailer: %v", err)
 	}
 
 	cfg := &config.Config{
-		DB:        store,
-		JWTSecret: os.Getenv("JWT_SECRET"),
-		Storage:   *s3Storage,
+		DB:            store,
+		JWTSecret:     os.Getenv("JWT_SECRET"),
+		Storage:       backend,
+		Keys:          keys,
+		Escrow:        escrow,
+		AdminAPIKey:   os.Getenv("ADMIN_API_KEY"),
+		MaxUploadSize: maxUploadSize,
+		TrustProxy:    os.Getenv("TRUST_PROXY") == "true",
+		Mailer:        mailer,
+		AppURL:        strings.TrimSuffix(os.Getenv("APP_URL"), "/"),
 	}
 
 	app := newAPI(cfg)
@@ -40,17 +102,70 @@ func main() {
 
 	// Public routes
 	mux.HandleFunc("POST /v1/users", app.handlerUsers)
+	mux.HandleFunc("POST /v1/users/verify", app.handlerVerifyEmail)
+	mux.HandleFunc("POST /v1/password-reset", app.handlerRequestPasswordReset)
+	mux.HandleFunc("POST /v1/password-reset/confirm", app.handlerResetPassword)
 	mux.HandleFunc("POST /v1/login", app.handlerLogin)
+	mux.HandleFunc("POST /v1/login/mfa", app.handlerLoginMFA)
 	mux.HandleFunc("POST /v1/refresh", app.handlerRefreshToken)
 	mux.HandleFunc("POST /v1/revoke", app.handlerRevoke)
 
 	// Protected routes
+	mux.Handle("POST /v1/users/verify/resend", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerResendVerification)))
+	mux.Handle("POST /v1/users/password", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerChangePassword)))
+	mux.Handle("POST /v1/users/mfa/totp", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerEnrollTOTP)))
+	mux.Handle("POST /v1/users/mfa/totp/confirm", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerConfirmTOTP)))
+	mux.Handle("DELETE /v1/users/mfa/totp", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerDisableTOTP)))
 	mux.Handle("POST /v1/capsules", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerCreateCapsule)))
+	mux.Handle("POST /v1/capsules/uploads", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerInitiateUpload)))
+	mux.Handle("POST /v1/capsules/{id}/finalize", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerFinalizeUpload)))
 	mux.Handle("GET /v1/capsules", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerGetCapsule)))
+	mux.Handle("GET /v1/capsules/{id}", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerGetCapsuleByID)))
+	mux.Handle("GET /v1/capsules/{id}/content", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerGetCapsuleContent)))
+	mux.Handle("GET /v1/sessions", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerListSessions)))
+	mux.Handle("DELETE /v1/sessions", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerRevokeAllSessions)))
+	mux.Handle("DELETE /v1/sessions/{id}", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerRevokeSession)))
+
+	mux.HandleFunc("OPTIONS /v1/uploads", app.handlerTusOptions)
+	mux.Handle("POST /v1/uploads", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerTusCreate)))
+	mux.Handle("HEAD /v1/uploads/{id}", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerTusHead)))
+	mux.Handle("PATCH /v1/uploads/{id}", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerTusPatch)))
+	mux.Handle("DELETE /v1/uploads/{id}", auth.WithAuthMiddleware(cfg, http.HandlerFunc(app.handlerTusTerminate)))
+
+	// Admin routes
+	mux.Handle("GET /admin/outbox/dead", auth.WithAPIKeyMiddleware(cfg, http.HandlerFunc(app.handlerListDeadEvents)))
+	mux.Handle("POST /admin/outbox/{id}/redrive", auth.WithAPIKeyMiddleware(cfg, http.HandlerFunc(app.handlerRedriveEvent)))
+
+	// Wrap with CORS and request id middleware
+	handler := auth.CORSMiddleware(auth.RequestIDMiddleware(mux))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Wrap with CORS middleware
-	handler := auth.CORSMiddleware(mux)
+	server := &http.Server{Addr: ":8081", Handler: handler}
+	go func() {
+		log.Println("Server starting on :8081")
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
 
-	log.Println("Server starting on :8081")
-	log.Fatal(http.ListenAndServe(":8081", handler))
+	// Requests in flight are answered and queued emails sent before exiting.
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("couldn't finish in-flight requests: %v", err)
+	}
+	if err := app.emails.close(shutdownCtx); err != nil {
+		log.Printf("gave up on queued emails: %v", err)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
 }
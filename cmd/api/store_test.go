@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/auth"
+	"github.com/mnhsh/time-capsule/internal/config"
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/mail"
+	"github.com/mnhsh/time-capsule/internal/storage"
+)
+
+const (
+	testEmail    = "ada@example.com"
+	testPassword = "correct horse battery staple"
+)
+
+// memStore keeps the tables the handler tests touch in maps and applies the
+// same conditions as the queries behind each method. Calling a method it
+// doesn't define hits the nil database.Store it embeds and panics, which
+// names the method a new test still has to add.
+type memStore struct {
+	database.Store
+	mu       sync.Mutex
+	users    map[uuid.UUID]database.User
+	capsules map[uuid.UUID]database.CreateCapsuleParams
+	uploads  map[uuid.UUID]database.Upload
+	// writing holds the uploads a WriteUpload call has locked.
+	writing  map[uuid.UUID]bool
+	sessions map[uuid.UUID]database.Session
+	// tokens are keyed by their hash, as refresh tokens are stored.
+	tokens        map[string]database.RefreshToken
+	verifications map[uuid.UUID]database.EmailVerification
+	emailSends    map[emailSendKey]database.AccountEmailSend
+	resets        map[uuid.UUID]database.PasswordReset
+	totp          map[uuid.UUID]database.UserTotp
+	challenges    map[uuid.UUID]database.MfaChallenge
+}
+
+type emailSendKey struct {
+	userID uuid.UUID
+	kind   string
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		users:    map[uuid.UUID]database.User{},
+		capsules: map[uuid.UUID]database.CreateCapsuleParams{},
+		uploads:  map[uuid.UUID]database.Upload{},
+		writing:  map[uuid.UUID]bool{},
+		sessions: map[uuid.UUID]database.Session{},
+		tokens:   map[string]database.RefreshToken{},
+
+		verifications: map[uuid.UUID]database.EmailVerification{},
+		emailSends:    map[emailSendKey]database.AccountEmailSend{},
+		resets:        map[uuid.UUID]database.PasswordReset{},
+		totp:          map[uuid.UUID]database.UserTotp{},
+		challenges:    map[uuid.UUID]database.MfaChallenge{},
+	}
+}
+
+// addUser registers a user whose address is already verified.
+func (s *memStore) addUser(t *testing.T, email, password string) database.User {
+	t.Helper()
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	u := database.User{
+		ID:              uuid.New(),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		Email:           email,
+		HashedPassword:  hash,
+		EmailVerifiedAt: sql.NullTime{Time: now, Valid: true},
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.ID] = u
+	return u
+}
+
+func (s *memStore) CreateUser(ctx context.Context, arg database.CreateUserParams) (database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Email == arg.Email {
+			return database.User{}, errors.New("duplicate key value violates unique constraint")
+		}
+	}
+	u := database.User{
+		ID:             arg.ID,
+		CreatedAt:      arg.CreatedAt,
+		UpdatedAt:      arg.UpdatedAt,
+		Email:          arg.Email,
+		HashedPassword: arg.HashedPassword,
+	}
+	s.users[u.ID] = u
+	return u, nil
+}
+
+func (s *memStore) GetUserByID(ctx context.Context, id uuid.UUID) (database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return database.User{}, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+func (s *memStore) GetUserByEmail(ctx context.Context, email string) (database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return database.User{}, sql.ErrNoRows
+}
+
+// addTOTP turns on TOTP for userID, confirmed at confirmedAt, and returns
+// the secret.
+func (s *memStore) addTOTP(t *testing.T, userID uuid.UUID, confirmedAt time.Time) []byte {
+	t.Helper()
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// plainKeys leaves the secret as it is when wrapping it.
+	s.totp[userID] = database.UserTotp{
+		UserID:        userID,
+		WrappedSecret: secret,
+		CreatedAt:     confirmedAt,
+		ConfirmedAt:   sql.NullTime{Time: confirmedAt, Valid: true},
+	}
+	return secret
+}
+
+func (s *memStore) GetUserTOTP(ctx context.Context, userID uuid.UUID) (database.UserTotp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totp, ok := s.totp[userID]
+	if !ok {
+		return database.UserTotp{}, sql.ErrNoRows
+	}
+	return totp, nil
+}
+
+func (s *memStore) UseTOTPStep(ctx context.Context, arg database.UseTOTPStepParams) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totp, ok := s.totp[arg.UserID]
+	if !ok || !totp.ConfirmedAt.Valid || (totp.LastUsedStep.Valid && totp.LastUsedStep.Int64 >= arg.LastUsedStep.Int64) {
+		return 0, nil
+	}
+	totp.LastUsedStep = arg.LastUsedStep
+	s.totp[arg.UserID] = totp
+	return 1, nil
+}
+
+// UseRecoveryCode matches nothing: the tests don't hand out recovery codes.
+func (s *memStore) UseRecoveryCode(ctx context.Context, arg database.UseRecoveryCodeParams) (int64, error) {
+	return 0, nil
+}
+
+func (s *memStore) ClaimTOTPDisableAttempt(ctx context.Context, arg database.ClaimTOTPDisableAttemptParams) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totp, ok := s.totp[arg.UserID]
+	if !ok || !totp.ConfirmedAt.Valid {
+		return 0, nil
+	}
+	started := totp.DisableWindowStartedAt
+	if started.Valid && started.Time.After(arg.WindowStart) {
+		if totp.DisableAttempts >= arg.MaxAttempts {
+			return 0, nil
+		}
+		totp.DisableAttempts++
+	} else {
+		totp.DisableAttempts = 1
+		totp.DisableWindowStartedAt = sql.NullTime{Time: arg.Now, Valid: true}
+	}
+	s.totp[arg.UserID] = totp
+	return 1, nil
+}
+
+func (s *memStore) DisableTOTP(ctx context.Context, userID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.totp, userID)
+	return nil
+}
+
+func (s *memStore) CreateMFAChallenge(ctx context.Context, arg database.CreateMFAChallengeParams) (database.MfaChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := database.MfaChallenge{
+		ID:         arg.ID,
+		UserID:     arg.UserID,
+		CreatedAt:  time.Now().UTC(),
+		ExpiresAt:  arg.ExpiresAt,
+		DeviceName: arg.DeviceName,
+	}
+	s.challenges[c.ID] = c
+	return c, nil
+}
+
+func (s *memStore) ClaimMFAChallengeAttempt(ctx context.Context, arg database.ClaimMFAChallengeAttemptParams) (database.MfaChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.challenges[arg.ID]
+	if !ok || c.UserID != arg.UserID || c.UsedAt.Valid || !c.ExpiresAt.After(time.Now()) || c.Attempts >= arg.MaxAttempts {
+		return database.MfaChallenge{}, sql.ErrNoRows
+	}
+	c.Attempts++
+	s.challenges[c.ID] = c
+	return c, nil
+}
+
+func (s *memStore) UseMFAChallenge(ctx context.Context, arg database.UseMFAChallengeParams) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.challenges[arg.ID]
+	if !ok || c.UserID != arg.UserID || c.UsedAt.Valid {
+		return 0, nil
+	}
+	c.UsedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	s.challenges[c.ID] = c
+	return 1, nil
+}
+
+func (s *memStore) ClaimAccountEmail(ctx context.Context, arg database.ClaimAccountEmailParams) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := emailSendKey{arg.UserID, arg.Kind}
+	sends, ok := s.emailSends[key]
+	switch {
+	case !ok || !sends.WindowStartedAt.After(arg.WindowStart):
+		if ok && sends.LastSentAt.After(arg.ResendAfter) {
+			return 0, nil
+		}
+		sends = database.AccountEmailSend{UserID: arg.UserID, Kind: arg.Kind, WindowStartedAt: arg.Now}
+	case sends.LastSentAt.After(arg.ResendAfter), sends.SentInWindow >= arg.MaxSends:
+		return 0, nil
+	}
+	sends.LastSentAt = arg.Now
+	sends.SentInWindow++
+	s.emailSends[key] = sends
+	return 1, nil
+}
+
+func (s *memStore) GetAccountEmailSends(ctx context.Context, arg database.GetAccountEmailSendsParams) (database.AccountEmailSend, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sends, ok := s.emailSends[emailSendKey{arg.UserID, arg.Kind}]
+	if !ok {
+		return database.AccountEmailSend{}, sql.ErrNoRows
+	}
+	return sends, nil
+}
+
+func (s *memStore) CreateEmailVerification(ctx context.Context, arg database.CreateEmailVerificationParams) (database.EmailVerification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := database.EmailVerification{
+		ID:        arg.ID,
+		UserID:    arg.UserID,
+		Email:     arg.Email,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: arg.ExpiresAt,
+	}
+	s.verifications[v.ID] = v
+	return v, nil
+}
+
+func (s *memStore) VerifyEmail(ctx context.Context, userID, verificationID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.verifications[verificationID]
+	if !ok || v.UserID != userID || v.UsedAt.Valid || !v.ExpiresAt.After(time.Now()) {
+		return sql.ErrNoRows
+	}
+	u := s.users[userID]
+	if u.Email != v.Email {
+		return sql.ErrNoRows
+	}
+
+	now := sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	v.UsedAt = now
+	s.verifications[v.ID] = v
+	u.EmailVerifiedAt = now
+	s.users[userID] = u
+	return nil
+}
+
+func (s *memStore) CreatePasswordReset(ctx context.Context, arg database.CreatePasswordResetParams) (database.PasswordReset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reset := database.PasswordReset{
+		ID:        arg.ID,
+		UserID:    arg.UserID,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: arg.ExpiresAt,
+	}
+	s.resets[reset.ID] = reset
+	return reset, nil
+}
+
+func (s *memStore) ResetPassword(ctx context.Context, userID, resetID uuid.UUID, hashedPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reset, ok := s.resets[resetID]
+	if !ok || reset.UserID != userID || reset.UsedAt.Valid || !reset.ExpiresAt.After(time.Now()) {
+		return sql.ErrNoRows
+	}
+
+	u := s.users[userID]
+	u.HashedPassword = hashedPassword
+	s.users[userID] = u
+	// Every outstanding reset is voided along with the one used, and every
+	// session is signed out.
+	for id, r := range s.resets {
+		if r.UserID == userID && !r.UsedAt.Valid {
+			r.UsedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+			s.resets[id] = r
+		}
+	}
+	for id, session := range s.sessions {
+		if session.UserID == userID {
+			s.endSession(userID, id)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) CreateCapsuleWithOutbox(ctx context.Context, arg database.CreateCapsuleParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capsules[arg.ID] = arg
+	return nil
+}
+
+func (s *memStore) CreateUpload(ctx context.Context, arg database.CreateUploadParams) (database.Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := database.Upload{
+		ID:           arg.ID,
+		UserID:       arg.UserID,
+		CapsuleID:    arg.CapsuleID,
+		S3key:        arg.S3key,
+		S3UploadID:   arg.S3UploadID,
+		UploadLength: arg.UploadLength,
+		Parts:        []byte("[]"),
+		Title:        arg.Title,
+		UnlockAt:     arg.UnlockAt,
+		CreatedAt:    arg.CreatedAt,
+		UpdatedAt:    arg.UpdatedAt,
+	}
+	s.uploads[u.ID] = u
+	return u, nil
+}
+
+func (s *memStore) GetUploadForUser(ctx context.Context, arg database.GetUploadForUserParams) (database.Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[arg.ID]
+	if !ok || u.UserID != arg.UserID {
+		return database.Upload{}, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+// WriteUpload turns away a second writer the way FOR UPDATE SKIP LOCKED
+// does. Unlike the SQL store it doesn't roll back what fn did on failure.
+func (s *memStore) WriteUpload(ctx context.Context, id, userID uuid.UUID, fn func(database.Querier, database.Upload) error) error {
+	s.mu.Lock()
+	u, ok := s.uploads[id]
+	if !ok || u.UserID != userID || s.writing[id] {
+		s.mu.Unlock()
+		return database.ErrUploadBusy
+	}
+	s.writing[id] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.writing, id)
+		s.mu.Unlock()
+	}()
+	return fn(s, u)
+}
+
+func (s *memStore) UpdateUploadProgress(ctx context.Context, arg database.UpdateUploadProgressParams) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[arg.ID]
+	if !ok || u.UploadOffset != arg.ExpectedOffset {
+		return 0, nil
+	}
+	u.UploadOffset = arg.UploadOffset
+	u.TailSize = arg.TailSize
+	u.Parts = arg.Parts
+	s.uploads[u.ID] = u
+	return 1, nil
+}
+
+func (s *memStore) CompleteUpload(ctx context.Context, uploadID uuid.UUID, capParams database.CreateCapsuleParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.uploads[uploadID]
+	if u.CompletedAt.Valid {
+		return database.ErrUploadCompleted
+	}
+	u.CompletedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	s.uploads[uploadID] = u
+	s.capsules[capParams.ID] = capParams
+	return nil
+}
+
+func (s *memStore) DeleteUpload(ctx context.Context, id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, id)
+	return nil
+}
+
+func (s *memStore) StartSession(ctx context.Context, session database.CreateSessionParams, token database.CreateRefreshTokenParams) (database.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	created := database.Session{
+		ID:         session.ID,
+		UserID:     session.UserID,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  session.ExpiresAt,
+		DeviceName: session.DeviceName,
+		UserAgent:  session.UserAgent,
+		Ip:         session.Ip,
+	}
+	s.sessions[created.ID] = created
+	token.UserID = session.UserID
+	token.FamilyID = session.ID
+	s.createRefreshToken(token)
+	return created, nil
+}
+
+func (s *memStore) GetSession(ctx context.Context, id uuid.UUID) (database.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return database.Session{}, sql.ErrNoRows
+	}
+	return session, nil
+}
+
+func (s *memStore) ListActiveSessions(ctx context.Context, userID uuid.UUID) ([]database.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var active []database.Session
+	for _, session := range s.sessions {
+		if session.UserID == userID && !session.RevokedAt.Valid && session.ExpiresAt.After(time.Now()) {
+			active = append(active, session)
+		}
+	}
+	slices.SortFunc(active, func(a, b database.Session) int {
+		return b.LastUsedAt.Compare(a.LastUsedAt)
+	})
+	return active, nil
+}
+
+func (s *memStore) EndSession(ctx context.Context, userID, sessionID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.endSession(userID, sessionID) {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *memStore) EndAllSessions(ctx context.Context, userID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.UserID == userID {
+			s.endSession(userID, id)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) TouchSession(ctx context.Context, arg database.TouchSessionParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[arg.ID]
+	if !ok {
+		return nil
+	}
+	session.LastUsedAt = time.Now().UTC()
+	session.ExpiresAt = arg.ExpiresAt
+	session.UserAgent = arg.UserAgent
+	session.Ip = arg.Ip
+	s.sessions[arg.ID] = session
+	return nil
+}
+
+// RotateRefreshToken follows the SQL store: an expired token is unknown,
+// and one that was already exchanged revokes its family.
+func (s *memStore) RotateRefreshToken(ctx context.Context, oldHash string, next database.CreateRefreshTokenParams) (database.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.tokens[oldHash]
+	if !ok {
+		return database.RefreshToken{}, sql.ErrNoRows
+	}
+	if old.RevokedAt.Valid {
+		s.endSession(old.UserID, old.FamilyID)
+		return database.RefreshToken{}, database.ErrRefreshTokenReused
+	}
+	if !old.ExpiresAt.After(time.Now()) {
+		return database.RefreshToken{}, sql.ErrNoRows
+	}
+	old.RevokedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	s.tokens[oldHash] = old
+
+	next.UserID = old.UserID
+	next.FamilyID = old.FamilyID
+	return s.createRefreshToken(next), nil
+}
+
+func (s *memStore) createRefreshToken(arg database.CreateRefreshTokenParams) database.RefreshToken {
+	now := time.Now().UTC()
+	token := database.RefreshToken{
+		TokenHash: arg.TokenHash,
+		CreatedAt: now,
+		UpdatedAt: now,
+		UserID:    arg.UserID,
+		ExpiresAt: arg.ExpiresAt,
+		FamilyID:  arg.FamilyID,
+	}
+	s.tokens[token.TokenHash] = token
+	return token
+}
+
+// endSession revokes a session and every refresh token in its family, and
+// reports whether the session was still active.
+func (s *memStore) endSession(userID, sessionID uuid.UUID) bool {
+	now := sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	session, ok := s.sessions[sessionID]
+	active := ok && session.UserID == userID && !session.RevokedAt.Valid
+	if active {
+		session.RevokedAt = now
+		s.sessions[sessionID] = session
+	}
+	for hash, token := range s.tokens {
+		if token.FamilyID == sessionID && !token.RevokedAt.Valid {
+			token.RevokedAt = now
+			s.tokens[hash] = token
+		}
+	}
+	return active
+}
+
+// newTestAPI returns an API backed by a memStore, in-memory storage and a
+// mailer that keeps what it sends.
+func newTestAPI(t *testing.T) (*API, *memStore) {
+	t.Helper()
+	store := newMemStore()
+	a := newAPI(&config.Config{
+		DB:            store,
+		JWTSecret:     "test-secret",
+		Keys:          plainKeys{},
+		Storage:       storage.NewMemoryStorage(),
+		Mailer:        mail.NewMemoryMailer(),
+		MaxUploadSize: 1 << 20,
+	})
+	t.Cleanup(func() { a.emails.close(context.Background()) })
+	return a, store
+}
+
+// flushEmails waits until the emails queued so far have been sent.
+func flushEmails(t *testing.T, a *API) {
+	t.Helper()
+	if err := a.emails.close(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	a.emails = newMailQueue(mailWorkers, mailQueueSize, mailJobTimeout)
+}
+
+// plainKeys "wraps" keys by copying them, which is enough for handlers that
+// only need to get back what they stored.
+type plainKeys struct{}
+
+func (plainKeys) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	key := make([]byte, 32)
+	return key, key, nil
+}
+
+func (plainKeys) WrapDataKey(ctx context.Context, key []byte) ([]byte, error) {
+	return append([]byte(nil), key...), nil
+}
+
+func (plainKeys) UnwrapDataKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return append([]byte(nil), wrapped...), nil
+}
+
+// post sends body as JSON to handler.
+func post(t *testing.T, handler http.HandlerFunc, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data)))
+	return rec
+}
+
+// asUser makes r look like it passed the auth middleware for userID.
+func asUser(r *http.Request, userID uuid.UUID) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), auth.UserIDKey, userID))
+}
+
+// storedKeys lists every object the API has left in storage under prefix.
+func storedKeys(t *testing.T, a *API, prefix string) []string {
+	t.Helper()
+	objects, err := a.cfg.Storage.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(objects))
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	return keys
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+
+	uuid "github.com/google/uuid"
+
+	response "github.com/mnhsh/time-capsule/internal/response"
+	"github.com/mnhsh/time-capsule/internal/storage"
+)
+
+const maxFieldSize = 1 << 10
+
+var (
+	errFileTooLarge  = errors.New("file exceeds the maximum upload size")
+	errFieldTooLarge = errors.New("form field exceeds the maximum size")
+)
+
+// limitedReader fails with errFileTooLarge once more than remaining bytes
+// have been read, instead of silently truncating like io.LimitReader.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errFileTooLarge
+	}
+	// Read one byte past the limit so an exactly-full file still succeeds.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errFileTooLarge
+	}
+	return n, err
+}
+
+func readFormField(part *multipart.Part) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxFieldSize {
+		return "", fmt.Errorf("%w: %s", errFieldTooLarge, part.FormName())
+	}
+	return string(data), nil
+}
+
+func respondWithUploadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errFileTooLarge), errors.As(err, &maxBytesErr):
+		response.RespondWithError(w, http.StatusRequestEntityTooLarge, "file too large", err)
+	case errors.Is(err, errFieldTooLarge):
+		response.RespondWithError(w, http.StatusBadRequest, err.Error(), err)
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		// The body was cut off, either inside a part or before the
+		// closing boundary.
+		response.RespondWithError(w, http.StatusBadRequest, "malformed multipart body", err)
+	default:
+		response.RespondWithError(w, http.StatusInternalServerError, "failed to upload file", err)
+	}
+}
+
+// discardObject deletes an uploaded object that no capsule will point to.
+// Failures are only logged; the worker's storage GC collects what's left.
+func (a *API) discardObject(ctx context.Context, key string) {
+	if err := a.cfg.Storage.Delete(context.WithoutCancel(ctx), key); err != nil {
+		log.Printf("couldn't delete orphaned object %s: %v", key, err)
+	}
+}
+
+// capsuleKey is a capsule's data key as stored on its row: wrapped by the
+// KeyManager, or in time-lock mode sealed to the escrow key until the worker
+// releases it at unlock.
+type capsuleKey struct {
+	wrapped  []byte
+	escrowed []byte
+}
+
+// newDataKey creates the data key for a new capsule. In time-lock mode the
+// API can't unwrap it again once it has forgotten the plaintext key.
+func (a *API) newDataKey(ctx context.Context) ([]byte, capsuleKey, error) {
+	if a.cfg.Escrow != nil {
+		dataKey, err := storage.NewDataKey()
+		if err != nil {
+			return nil, capsuleKey{}, err
+		}
+		escrowed, err := a.cfg.Escrow.Seal(dataKey)
+		if err != nil {
+			return nil, capsuleKey{}, err
+		}
+		return dataKey, capsuleKey{escrowed: escrowed}, nil
+	}
+	dataKey, wrapped, err := a.cfg.Keys.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, capsuleKey{}, err
+	}
+	return dataKey, capsuleKey{wrapped: wrapped}, nil
+}
+
+// sealedContent describes an encrypted object written for a capsule.
+type sealedContent struct {
+	// digest is of the plaintext the user sealed.
+	digest storage.Digest
+	// objectSHA256 is the hex SHA-256 of the stored ciphertext, which can be
+	// checked without the data key.
+	objectSHA256 string
+	key          capsuleKey
+}
+
+// storeEncrypted writes body to key encrypted under a fresh data key.
+// Read errors from body are returned unchanged.
+func (a *API) storeEncrypted(ctx context.Context, key, contentType string, body io.Reader) (sealedContent, error) {
+	dataKey, ck, err := a.newDataKey(ctx)
+	if err != nil {
+		return sealedContent{}, fmt.Errorf("couldn't generate data key: %w", err)
+	}
+	plain := storage.NewDigestReader(body)
+	encrypted, err := storage.EncryptReader(plain, dataKey)
+	if err != nil {
+		return sealedContent{}, err
+	}
+	sealed := storage.NewDigestReader(encrypted)
+	if _, err := a.cfg.Storage.Put(ctx, key, contentType, sealed); err != nil {
+		return sealedContent{}, err
+	}
+	return sealedContent{
+		digest:       plain.Digest(),
+		objectSHA256: sealed.Digest().SHA256,
+		key:          ck,
+	}, nil
+}
+
+// encryptStoredObject encrypts content that was uploaded straight to storage
+// into a new object next to it, and returns the new key. The plaintext
+// object is left for the caller to discard.
+func (a *API) encryptStoredObject(ctx context.Context, key string) (string, sealedContent, error) {
+	dataKey, ck, err := a.newDataKey(ctx)
+	if err != nil {
+		return "", sealedContent{}, fmt.Errorf("couldn't generate data key: %w", err)
+	}
+	encryptedKey := path.Dir(key) + "/" + uuid.New().String()
+	plain, sealed, err := storage.EncryptObject(ctx, a.cfg.Storage, key, encryptedKey, dataKey)
+	if err != nil {
+		return "", sealedContent{}, fmt.Errorf("couldn't encrypt object: %w", err)
+	}
+	return encryptedKey, sealedContent{
+		digest:       plain,
+		objectSHA256: sealed.SHA256,
+		key:          ck,
+	}, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/storage"
+)
+
+// keyReleaser takes time-locked capsules' data keys out of escrow when they
+// unlock, re-wrapping them with the KeyManager the API uses. The worker is the
+// only process holding the escrow private key.
+type keyReleaser struct {
+	escrow *storage.EscrowOpener
+	keys   storage.KeyManager
+	now    func() time.Time
+}
+
+// newKeyReleaser loads ESCROW_PRIVATE_KEY_FILE and KMS_KEY_FILE. It returns
+// nil when time-lock mode isn't configured.
+func newKeyReleaser() (*keyReleaser, error) {
+	path := os.Getenv("ESCROW_PRIVATE_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	escrow, err := storage.NewEscrowOpener(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := storage.NewLocalKeyManager(os.Getenv("KMS_KEY_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load KMS_KEY_FILE: %w", err)
+	}
+	return &keyReleaser{escrow: escrow, keys: keys, now: time.Now}, nil
+}
+
+func (k *keyReleaser) release(ctx context.Context, q database.Querier, c database.Capsule) error {
+	// Callers only hand over due capsules; this check is what makes the
+	// guarantee independent of them.
+	if k.now().Before(c.UnlockAt) {
+		return fmt.Errorf("refusing to release key of capsule %s before %s", c.ID, c.UnlockAt.UTC().Format(time.RFC3339))
+	}
+
+	dataKey, err := k.escrow.Open(c.EscrowedKey)
+	if err != nil {
+		return fmt.Errorf("couldn't open escrowed key of capsule %s: %w", c.ID, err)
+	}
+	wrapped, err := k.keys.WrapDataKey(ctx, dataKey)
+	if err != nil {
+		return fmt.Errorf("couldn't wrap key of capsule %s: %w", c.ID, err)
+	}
+	err = q.ReleaseCapsuleKey(ctx, database.ReleaseCapsuleKeyParams{
+		ID:         c.ID,
+		WrappedKey: wrapped,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't release key of capsule %s: %w", c.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/storage"
+)
+
+// storageGC removes objects that no capsule or upload points to, which is
+// what's left behind when the API stores a file but can't save its row and
+// the compensating delete fails too.
+type storageGC struct {
+	db       database.Store
+	storage  storage.Backend
+	interval time.Duration
+	// grace protects objects whose row is still being written: uploads store
+	// the file before the capsule row exists.
+	grace time.Duration
+	// dryRun only reports what would be deleted.
+	dryRun bool
+	now    func() time.Time
+}
+
+type gcReport struct {
+	scanned      int
+	orphaned     int
+	orphanedSize int64
+	deleted      int
+}
+
+func newStorageGC(db database.Store, backend storage.Backend, grace time.Duration, dryRun bool) *storageGC {
+	return &storageGC{
+		db:       db,
+		storage:  backend,
+		interval: time.Hour,
+		grace:    grace,
+		dryRun:   dryRun,
+		now:      time.Now,
+	}
+}
+
+func (g *storageGC) run(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := g.collect(ctx)
+		if err != nil {
+			log.Printf("storage gc: %v", err)
+		}
+		if report.orphaned > 0 {
+			if g.dryRun {
+				log.Printf("storage gc (dry run): scanned %d objects, %d orphaned (%d bytes) would be deleted",
+					report.scanned, report.orphaned, report.orphanedSize)
+			} else {
+				log.Printf("storage gc: scanned %d objects, deleted %d of %d orphaned (%d bytes)",
+					report.scanned, report.deleted, report.orphaned, report.orphanedSize)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect walks every user's prefix once. A failure for one user is logged
+// and doesn't stop the others.
+func (g *storageGC) collect(ctx context.Context) (gcReport, error) {
+	var report gcReport
+	cutoff := g.now().Add(-g.grace)
+
+	userIDs, err := g.db.ListUserIDs(ctx)
+	if err != nil {
+		return report, fmt.Errorf("couldn't list users: %w", err)
+	}
+
+	for _, userID := range userIDs {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		// List before loading the keys: a row committed in between is then
+		// seen, and anything uploaded after the listing isn't considered.
+		objects, err := g.storage.List(ctx, userID.String()+"/")
+		if err != nil {
+			log.Printf("storage gc: couldn't list objects for user %s: %v", userID, err)
+			continue
+		}
+		if len(objects) == 0 {
+			continue
+		}
+		// Abandoned direct uploads don't keep their objects alive, in case
+		// the expiry sweep couldn't delete them itself.
+		keys, err := g.db.ListStorageKeysForUser(ctx, database.ListStorageKeysForUserParams{
+			UserID:    userID,
+			CreatedAt: g.now().Add(-pendingUploadExpiry).UTC(),
+		})
+		if err != nil {
+			log.Printf("storage gc: couldn't load keys for user %s: %v", userID, err)
+			continue
+		}
+		referenced := make(map[string]bool, len(keys))
+		for _, k := range keys {
+			referenced[k] = true
+		}
+
+		for _, o := range objects {
+			report.scanned++
+			// Resumable uploads park partial parts in "<key>.tail".
+			if referenced[o.Key] || referenced[strings.TrimSuffix(o.Key, ".tail")] {
+				continue
+			}
+			if o.LastModified.After(cutoff) {
+				continue
+			}
+
+			report.orphaned++
+			report.orphanedSize += o.Size
+			if g.dryRun {
+				log.Printf("storage gc (dry run): would delete %s (%d bytes, modified %s)",
+					o.Key, o.Size, o.LastModified.UTC().Format(time.RFC3339))
+				continue
+			}
+			if err := g.storage.Delete(ctx, o.Key); err != nil {
+				log.Printf("storage gc: couldn't delete %s: %v", o.Key, err)
+				continue
+			}
+			report.deleted++
+		}
+	}
+	return report, nil
+}
@@ -1,5 +1,250 @@
 package main
 
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"github.com/mnhsh/time-capsule/internal/broker"
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/mail"
+	"github.com/mnhsh/time-capsule/internal/storage"
+)
+
 func main() {
-	// TODO: Implement worker for processing outbox events
+	dbURL := os.Getenv("DB_URL")
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		log.Fatalf("couldn't open database: %v", err)
+	}
+	defer db.Close()
+
+	store := database.NewStore(db)
+
+	mailer, err := newMailer()
+	if err != nil {
+		log.Fatalf("couldn't create mailer: %v", err)
+	}
+
+	keys, err := newKeyReleaser()
+	if err != nil {
+		log.Fatalf("couldn't load escrow keys: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	spawn := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+
+	// The relay wakes on NOTIFY from outbox writers; without it, it just polls.
+	outboxNotifier, err := database.Listen(ctx, dbURL, database.OutboxPendingChannel)
+	if err != nil {
+		log.Printf("couldn't listen for outbox events, polling instead: %v", err)
+		outboxNotifier = nil
+	}
+
+	// WORKER_MODE=postgres runs the whole unlock pipeline without RabbitMQ.
+	switch mode := os.Getenv("WORKER_MODE"); mode {
+	case "", "broker":
+		rabbit, err := broker.NewRabbitMQ(os.Getenv("RABBITMQ_URL"))
+		if err != nil {
+			log.Fatalf("couldn't connect to RabbitMQ: %v", err)
+		}
+		defer rabbit.Close()
+
+		u := newUnlocker(store, mailer, rabbit, keys)
+		spawn(func() { newRelay(store, rabbit, outboxNotifier, workerID()).run(ctx) })
+		spawn(func() { newSweeper(store, u).run(ctx) })
+		spawn(func() {
+			if err := rabbit.Consume(ctx, u.handleMessage); err != nil {
+				log.Printf("consumer stopped: %v", err)
+				stop()
+			}
+		})
+	case "postgres":
+		var capsuleNotifier *database.Notifier
+		if os.Getenv("SCHEDULER_LISTEN") != "false" {
+			capsuleNotifier, err = database.Listen(ctx, dbURL, database.CapsuleScheduledChannel)
+			if err != nil {
+				log.Fatalf("couldn't listen for scheduled capsules: %v", err)
+			}
+		}
+
+		u := newUnlocker(store, mailer, discardPublisher{}, keys)
+		spawn(func() { newRelay(store, discardPublisher{}, outboxNotifier, workerID()).run(ctx) })
+		spawn(func() { newScheduler(store, u, capsuleNotifier).run(ctx) })
+	default:
+		log.Fatalf("unknown WORKER_MODE %q", mode)
+	}
+
+	// STORAGE_GC=false turns the orphaned object collector and the expiry of
+	// abandoned direct uploads off, and STORAGE_SCRUB=false the integrity
+	// scrubber, e.g. when several workers share a bucket and one of them is
+	// enough.
+	gcEnabled := os.Getenv("STORAGE_GC") != "false"
+	scrubEnabled := os.Getenv("STORAGE_SCRUB") != "false"
+	// Tiering is off unless the deployment sets a policy.
+	tiers := os.Getenv("STORAGE_TIERS")
+	var backend storage.Backend
+	if gcEnabled || scrubEnabled || tiers != "" {
+		backend, err = newStorage(ctx)
+		if err != nil {
+			log.Fatalf("couldn't create storage backend: %v", err)
+		}
+	}
+	if gcEnabled {
+		grace := 24 * time.Hour
+		if v := os.Getenv("STORAGE_GC_GRACE"); v != "" {
+			grace, err = time.ParseDuration(v)
+			if err != nil || grace <= 0 {
+				log.Fatalf("invalid STORAGE_GC_GRACE %q", v)
+			}
+		}
+		dryRun := os.Getenv("STORAGE_GC_DRY_RUN") == "true"
+		spawn(func() { newStorageGC(store, backend, grace, dryRun).run(ctx) })
+		spawn(func() { newUploadExpirer(store, backend).run(ctx) })
+	}
+	if scrubEnabled {
+		s, err := newScrubberFromEnv(store, backend, keys, mailer)
+		if err != nil {
+			log.Fatalf("couldn't configure scrubber: %v", err)
+		}
+		spawn(func() { s.run(ctx) })
+	}
+	if tiers != "" {
+		lead := 7 * 24 * time.Hour
+		if v := os.Getenv("STORAGE_RESTORE_LEAD"); v != "" {
+			lead, err = time.ParseDuration(v)
+			if err != nil || lead <= 0 {
+				log.Fatalf("invalid STORAGE_RESTORE_LEAD %q", v)
+			}
+		}
+		policy, err := storage.ParseTieringPolicy(tiers, lead)
+		if err != nil {
+			log.Fatalf("invalid STORAGE_TIERS: %v", err)
+		}
+		spawn(func() { newTierer(store, backend, policy).run(ctx) })
+	}
+
+	log.Println("Worker starting")
+	wg.Wait()
+	log.Println("Worker stopped")
+}
+
+// workerID identifies this process in outbox leases. WORKER_ID overrides the
+// default of hostname and pid.
+func workerID() string {
+	if id := os.Getenv("WORKER_ID"); id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "worker"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// newMailer picks the mail transport from MAIL_DRIVER. Anything other than
+// "smtp" writes emails to MAIL_DIR for local runs.
+func newMailer() (mail.Mailer, error) {
+	opts := mail.Options{
+		Driver:   os.Getenv("MAIL_DRIVER"),
+		From:     os.Getenv("MAIL_FROM"),
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		Dir:      os.Getenv("MAIL_DIR"),
+	}
+	if opts.From == "" {
+		opts.From = "no-reply@timecapsule.local"
+	}
+	if opts.Dir == "" {
+		opts.Dir = "mail"
+	}
+	return mail.New(opts)
+}
+
+// newScrubberFromEnv configures the scrubber from STORAGE_SCRUB_EVERY (how
+// often each capsule is re-verified, default 30 days), STORAGE_SCRUB_RATE
+// (bytes per second, default 8 MiB, 0 for no limit) and OPERATOR_EMAIL, a
+// comma-separated list of addresses to report damaged capsules to.
+func newScrubberFromEnv(store database.Store, backend storage.Backend, releaser *keyReleaser, mailer mail.Mailer) (*scrubber, error) {
+	every := 30 * 24 * time.Hour
+	if v := os.Getenv("STORAGE_SCRUB_EVERY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid STORAGE_SCRUB_EVERY %q", v)
+		}
+		every = d
+	}
+	rate := int64(8 << 20)
+	if v := os.Getenv("STORAGE_SCRUB_RATE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid STORAGE_SCRUB_RATE %q", v)
+		}
+		rate = n
+	}
+
+	var operators []string
+	for _, addr := range strings.Split(os.Getenv("OPERATOR_EMAIL"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			operators = append(operators, addr)
+		}
+	}
+
+	// Encrypted capsules can only be checked with their keys; without them
+	// the scrubber skips those capsules. Time-locked capsules don't need the
+	// escrow key, which the scrubber is never given.
+	var keys storage.KeyManager
+	if releaser != nil {
+		keys = releaser.keys
+	} else if path := os.Getenv("KMS_KEY_FILE"); path != "" {
+		km, err := storage.NewLocalKeyManager(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load KMS_KEY_FILE: %w", err)
+		}
+		keys = km
+	}
+	return newScrubber(store, backend, keys, mailer, operators, every, rate), nil
+}
+
+// newStorage opens the same storage backend as the API, configured by the
+// same environment variables.
+func newStorage(ctx context.Context) (storage.Backend, error) {
+	opts := storage.Options{
+		Driver:   os.Getenv("STORAGE_DRIVER"),
+		Bucket:   os.Getenv("S3_BUCKET"),
+		Region:   os.Getenv("AWS_REGION"),
+		Endpoint: os.Getenv("S3_ENDPOINT"),
+		Dir:      os.Getenv("STORAGE_DIR"),
+	}
+	if opts.Bucket == "" {
+		opts.Bucket = "capsule-bucket"
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.Dir == "" {
+		opts.Dir = "data"
+	}
+	return storage.New(ctx, opts)
 }
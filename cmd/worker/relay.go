@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/broker"
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/events"
+)
+
+// unlockMessage is the body of the delayed message delivered at unlock time.
+type unlockMessage struct {
+	CapsuleID uuid.UUID `json:"capsule_id"`
+	UnlockAt  time.Time `json:"unlock_at"`
+}
+
+// relay moves pending outbox rows onto the broker. Several relays can run
+// against the same database: each batch is leased to workerID, so replicas
+// never publish the same row concurrently.
+//
+// With a notifier the relay wakes as soon as an outbox row commits and only
+// polls every idleInterval to pick up retries; while the notifier is
+// disconnected it falls back to polling every interval.
+type relay struct {
+	db           database.Store
+	publisher    broker.Publisher
+	notifier     *database.Notifier
+	workerID     string
+	batchSize    int32
+	lease        time.Duration
+	interval     time.Duration
+	idleInterval time.Duration
+	maxAttempts  int32
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	now          func() time.Time
+}
+
+func newRelay(db database.Store, publisher broker.Publisher, notifier *database.Notifier, workerID string) *relay {
+	return &relay{
+		db:           db,
+		publisher:    publisher,
+		notifier:     notifier,
+		workerID:     workerID,
+		batchSize:    100,
+		lease:        30 * time.Second,
+		interval:     2 * time.Second,
+		idleInterval: 30 * time.Second,
+		maxAttempts:  10,
+		baseBackoff:  5 * time.Second,
+		maxBackoff:   time.Hour,
+		now:          time.Now,
+	}
+}
+
+func (r *relay) run(ctx context.Context) {
+	var wake <-chan struct{}
+	if r.notifier != nil {
+		wake = r.notifier.C
+	}
+
+	for {
+		published, err := r.processBatch(ctx)
+		if err != nil {
+			log.Printf("relay: %v", err)
+		}
+		// A full batch means there is probably a backlog, so drain it
+		// before waiting for the next notification.
+		if published == int(r.batchSize) && ctx.Err() == nil {
+			continue
+		}
+
+		interval := r.interval
+		if r.notifier != nil && r.notifier.Connected() {
+			interval = r.idleInterval
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-wake:
+			timer.Stop()
+		}
+	}
+}
+
+// processBatch claims and publishes one batch of pending events and returns
+// how many were confirmed by the broker. Failed events are rescheduled with
+// backoff, or marked dead once they run out of attempts.
+func (r *relay) processBatch(ctx context.Context) (int, error) {
+	events, err := r.db.ClaimOutboxEvents(ctx, database.ClaimOutboxEventsParams{
+		WorkerID:     r.workerID,
+		LeaseSeconds: int32(r.lease / time.Second),
+		BatchSize:    r.batchSize,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("couldn't claim outbox events: %w", err)
+	}
+
+	published := 0
+	for _, ev := range events {
+		if err := r.publish(ctx, ev); err != nil {
+			log.Printf("relay: couldn't publish outbox event %s: %v", ev.ID, err)
+			if err := r.fail(ctx, ev, err); err != nil {
+				log.Printf("relay: couldn't record failure for outbox event %s: %v", ev.ID, err)
+			}
+			continue
+		}
+		published++
+	}
+	return published, nil
+}
+
+func (r *relay) publish(ctx context.Context, ev database.Outbox) error {
+	env, err := events.Decode(ev.Payload)
+	if err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+
+	switch env.Type {
+	case events.TypeCapsuleCreated:
+		err = r.publishUnlock(ctx, ev.ID, env)
+	default:
+		err = fmt.Errorf("no route for event type %q", env.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Only flip the row once the broker has confirmed the message. If this
+	// update fails the event is published again, so consumers must be idempotent.
+	return r.db.UpdateOutboxStatus(ctx, database.UpdateOutboxStatusParams{
+		ID:     ev.ID,
+		Status: sql.NullString{String: database.OutboxStatusPublished, Valid: true},
+	})
+}
+
+// publishUnlock schedules the delayed unlock message for a new capsule.
+func (r *relay) publishUnlock(ctx context.Context, id uuid.UUID, env events.Envelope) error {
+	var created events.CapsuleCreated
+	if err := env.DecodeBody(&created); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(unlockMessage{
+		CapsuleID: created.CapsuleID,
+		UnlockAt:  created.UnlockAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.publisher.Publish(ctx, broker.Message{
+		ID:    id.String(),
+		Body:  body,
+		Delay: created.UnlockAt.Sub(r.now()),
+	})
+}
+
+func (r *relay) fail(ctx context.Context, ev database.Outbox, cause error) error {
+	status := database.OutboxStatusPending
+	nextAttempt := sql.NullTime{Time: r.now().UTC().Add(r.backoff(ev.Attempts)), Valid: true}
+	if ev.Attempts+1 >= r.maxAttempts {
+		status = database.OutboxStatusDead
+		nextAttempt = sql.NullTime{}
+		log.Printf("relay: outbox event %s is dead after %d attempts", ev.ID, ev.Attempts+1)
+	}
+
+	return r.db.MarkOutboxEventFailed(ctx, database.MarkOutboxEventFailedParams{
+		ID:            ev.ID,
+		LastError:     sql.NullString{String: cause.Error(), Valid: true},
+		NextAttemptAt: nextAttempt,
+		Status:        sql.NullString{String: status, Valid: true},
+	})
+}
+
+func (r *relay) backoff(attempts int32) time.Duration {
+	return backoff(r.baseBackoff, r.maxBackoff, attempts)
+}
+
+// backoff returns the delay before the next attempt after the given number of
+// previous failures: exponential growth from base capped at max, with the
+// upper half jittered so failed batches don't retry in lockstep.
+func backoff(base, max time.Duration, attempts int32) time.Duration {
+	d := max
+	if attempts < 32 {
+		if exp := base << attempts; exp > 0 && exp < max {
+			d = exp
+		}
+	}
+	half := d / 2
+	return half + rand.N(half+1)
+}
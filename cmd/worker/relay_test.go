@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/broker"
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/events"
+)
+
+// relayStore hands out the rows in pending in order, as if they were the
+// unpublished outbox, and records what the relay marks each one as. It
+// shares calls with memPublisher, so a test can see whether an event was
+// marked before or after the broker confirmed it.
+type relayStore struct {
+	database.Store
+	pending []database.Outbox
+	status  map[uuid.UUID]string
+	failed  map[uuid.UUID]database.MarkOutboxEventFailedParams
+	calls   *[]string
+}
+
+func (s *relayStore) ClaimOutboxEvents(ctx context.Context, arg database.ClaimOutboxEventsParams) ([]database.Outbox, error) {
+	n := min(int(arg.BatchSize), len(s.pending))
+	claimed := s.pending[:n]
+	s.pending = s.pending[n:]
+	return claimed, nil
+}
+
+func (s *relayStore) UpdateOutboxStatus(ctx context.Context, arg database.UpdateOutboxStatusParams) error {
+	*s.calls = append(*s.calls, "mark "+arg.ID.String())
+	s.status[arg.ID] = arg.Status.String
+	return nil
+}
+
+func (s *relayStore) MarkOutboxEventFailed(ctx context.Context, arg database.MarkOutboxEventFailedParams) error {
+	*s.calls = append(*s.calls, "fail "+arg.ID.String())
+	s.failed[arg.ID] = arg
+	return nil
+}
+
+// memPublisher stands in for the broker. Messages whose id is in nack are
+// refused, as the broker does when it can't confirm them.
+type memPublisher struct {
+	mu        sync.Mutex
+	nack      map[string]bool
+	confirmed []broker.Message
+	calls     *[]string
+}
+
+func (p *memPublisher) Publish(ctx context.Context, msg broker.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	*p.calls = append(*p.calls, "publish "+msg.ID)
+	if p.nack[msg.ID] {
+		return errors.New("broker nacked the message")
+	}
+	p.confirmed = append(p.confirmed, msg)
+	return nil
+}
+
+func (p *memPublisher) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.confirmed)
+}
+
+func newTestRelay(t *testing.T, rows ...database.Outbox) (*relay, *relayStore, *memPublisher) {
+	t.Helper()
+	var calls []string
+	store := &relayStore{
+		pending: rows,
+		status:  map[uuid.UUID]string{},
+		failed:  map[uuid.UUID]database.MarkOutboxEventFailedParams{},
+		calls:   &calls,
+	}
+	pub := &memPublisher{nack: map[string]bool{}, calls: &calls}
+	r := newRelay(store, pub, nil, "test-worker")
+	return r, store, pub
+}
+
+func capsuleCreatedRow(t *testing.T, unlockAt time.Time, attempts int32) database.Outbox {
+	t.Helper()
+	capsuleID := uuid.New()
+	env, err := events.New(context.Background(), events.TypeCapsuleCreated, capsuleID, events.CapsuleCreated{
+		CapsuleID: capsuleID,
+		UserID:    uuid.New(),
+		UnlockAt:  unlockAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := events.Encode(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return database.Outbox{ID: uuid.New(), Payload: payload, Attempts: attempts}
+}
+
+func TestRelayPublishesUnlockMessage(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	unlockAt := now.Add(48 * time.Hour)
+	row := capsuleCreatedRow(t, unlockAt, 0)
+
+	r, store, pub := newTestRelay(t, row)
+	r.now = func() time.Time { return now }
+
+	published, err := r.processBatch(context.Background())
+	if err != nil {
+		t.Fatalf("processBatch: %v", err)
+	}
+	if published != 1 {
+		t.Fatalf("published = %d, want 1", published)
+	}
+	if len(pub.confirmed) != 1 {
+		t.Fatalf("broker got %d messages, want 1", len(pub.confirmed))
+	}
+
+	msg := pub.confirmed[0]
+	if msg.ID != row.ID.String() {
+		t.Errorf("message id = %q, want the outbox id %q", msg.ID, row.ID)
+	}
+	if msg.Delay != 48*time.Hour {
+		t.Errorf("delay = %v, want 48h", msg.Delay)
+	}
+	var body unlockMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		t.Fatalf("couldn't decode message body: %v", err)
+	}
+	if !body.UnlockAt.Equal(unlockAt) {
+		t.Errorf("unlock_at = %v, want %v", body.UnlockAt, unlockAt)
+	}
+	if got := store.status[row.ID]; got != database.OutboxStatusPublished {
+		t.Errorf("outbox status = %q, want %q", got, database.OutboxStatusPublished)
+	}
+}
+
+func TestRelayMarksPublishedOnlyAfterConfirm(t *testing.T) {
+	row := capsuleCreatedRow(t, time.Now().Add(time.Hour), 0)
+	r, store, _ := newTestRelay(t, row)
+
+	if _, err := r.processBatch(context.Background()); err != nil {
+		t.Fatalf("processBatch: %v", err)
+	}
+
+	want := []string{"publish " + row.ID.String(), "mark " + row.ID.String()}
+	if got := *store.calls; !slices.Equal(got, want) {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+}
+
+func TestRelayReschedulesNackedEvent(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	nacked := capsuleCreatedRow(t, now.Add(time.Hour), 2)
+	ok := capsuleCreatedRow(t, now.Add(time.Hour), 0)
+
+	r, store, pub := newTestRelay(t, nacked, ok)
+	r.now = func() time.Time { return now }
+	pub.nack[nacked.ID.String()] = true
+
+	published, err := r.processBatch(context.Background())
+	if err != nil {
+		t.Fatalf("processBatch: %v", err)
+	}
+	if published != 1 {
+		t.Errorf("published = %d, want 1", published)
+	}
+
+	if _, marked := store.status[nacked.ID]; marked {
+		t.Error("nacked event was marked published")
+	}
+	failure, recorded := store.failed[nacked.ID]
+	if !recorded {
+		t.Fatal("nacked event's failure wasn't recorded")
+	}
+	if failure.Status.String != database.OutboxStatusPending {
+		t.Errorf("status = %q, want %q", failure.Status.String, database.OutboxStatusPending)
+	}
+	if !failure.NextAttemptAt.Valid || !failure.NextAttemptAt.Time.After(now) {
+		t.Errorf("next attempt = %v, want a time after %v", failure.NextAttemptAt, now)
+	}
+
+	if got := store.status[ok.ID]; got != database.OutboxStatusPublished {
+		t.Errorf("the other event's status = %q, want %q", got, database.OutboxStatusPublished)
+	}
+}
+
+func TestRelayDeadLettersAfterMaxAttempts(t *testing.T) {
+	r, store, pub := newTestRelay(t)
+	row := capsuleCreatedRow(t, time.Now().Add(time.Hour), r.maxAttempts-1)
+	store.pending = []database.Outbox{row}
+	pub.nack[row.ID.String()] = true
+
+	if _, err := r.processBatch(context.Background()); err != nil {
+		t.Fatalf("processBatch: %v", err)
+	}
+
+	failure := store.failed[row.ID]
+	if failure.Status.String != database.OutboxStatusDead {
+		t.Errorf("status = %q, want %q", failure.Status.String, database.OutboxStatusDead)
+	}
+	if failure.NextAttemptAt.Valid {
+		t.Errorf("dead event has a next attempt at %v", failure.NextAttemptAt.Time)
+	}
+}
+
+func TestRelayDrainsFullBatchesWithoutWaiting(t *testing.T) {
+	rows := make([]database.Outbox, 25)
+	for i := range rows {
+		rows[i] = capsuleCreatedRow(t, time.Now().Add(time.Hour), 0)
+	}
+	r, store, pub := newTestRelay(t, rows...)
+	r.batchSize = 10
+	r.interval = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		r.run(ctx)
+		close(done)
+	}()
+
+	// The third batch is short, so the relay then sleeps for an hour; the
+	// backlog must be gone long before that.
+	for pub.count() < len(rows) && ctx.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if len(pub.confirmed) != len(rows) {
+		t.Errorf("published %d of %d events before the deadline", len(pub.confirmed), len(rows))
+	}
+	if len(store.pending) != 0 {
+		t.Errorf("%d events left in the outbox", len(store.pending))
+	}
+}
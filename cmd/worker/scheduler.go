@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mnhsh/time-capsule/internal/broker"
+	"github.com/mnhsh/time-capsule/internal/database"
+)
+
+// scheduler unlocks capsules straight from Postgres for deployments that run
+// without RabbitMQ. It sleeps until the earliest pending unlock_at (capped at
+// pollInterval) and, when notifier is non-nil, is woken early whenever a new
+// capsule is scheduled.
+type scheduler struct {
+	db           database.Store
+	unlocker     *unlocker
+	notifier     *database.Notifier
+	batchSize    int32
+	pollInterval time.Duration
+	minInterval  time.Duration
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	now          func() time.Time
+}
+
+func newScheduler(db database.Store, u *unlocker, notifier *database.Notifier) *scheduler {
+	return &scheduler{
+		db:           db,
+		unlocker:     u,
+		notifier:     notifier,
+		batchSize:    100,
+		pollInterval: time.Minute,
+		minInterval:  time.Second,
+		baseBackoff:  30 * time.Second,
+		maxBackoff:   6 * time.Hour,
+		now:          time.Now,
+	}
+}
+
+func (s *scheduler) run(ctx context.Context) {
+	var wake <-chan struct{}
+	if s.notifier != nil {
+		wake = s.notifier.C
+	}
+
+	for {
+		s.unlockDue(ctx)
+		if _, err := s.unlocker.announcePending(ctx, s.batchSize); err != nil {
+			log.Printf("scheduler: %v", err)
+		}
+
+		timer := time.NewTimer(s.nextWait(ctx))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-wake:
+			timer.Stop()
+		}
+	}
+}
+
+// unlockDue drains every capsule that is due right now. Each capsule is
+// unlocked in its own transaction, so a failure only holds back that one,
+// which then backs off before it is tried again.
+func (s *scheduler) unlockDue(ctx context.Context) {
+	for {
+		due, err := s.db.ListDueCapsules(ctx, s.batchSize)
+		if err != nil {
+			log.Printf("scheduler: couldn't list due capsules: %v", err)
+			return
+		}
+
+		opened := 0
+		for _, c := range due {
+			ok, err := s.unlocker.unlock(ctx, c.ID)
+			if err != nil {
+				log.Printf("scheduler: couldn't unlock capsule %s: %v", c.ID, err)
+				s.fail(ctx, c)
+				continue
+			}
+			if ok {
+				opened++
+			}
+		}
+
+		if len(due) < int(s.batchSize) || opened == 0 {
+			return
+		}
+	}
+}
+
+// fail schedules the next attempt at a capsule that couldn't be unlocked.
+func (s *scheduler) fail(ctx context.Context, c database.ListDueCapsulesRow) {
+	next := s.now().UTC().Add(backoff(s.baseBackoff, s.maxBackoff, c.UnlockAttempts))
+	err := s.db.RecordUnlockFailure(ctx, database.RecordUnlockFailureParams{
+		ID:                  c.ID,
+		NextUnlockAttemptAt: sql.NullTime{Time: next, Valid: true},
+	})
+	if err != nil {
+		log.Printf("scheduler: couldn't record failed unlock of capsule %s: %v", c.ID, err)
+	}
+}
+
+// nextWait returns how long to sleep before the next capsule is due.
+func (s *scheduler) nextWait(ctx context.Context) time.Duration {
+	wait := s.pollInterval
+
+	next, err := s.db.GetNextUnlockAt(ctx)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("scheduler: couldn't get next unlock time: %v", err)
+		}
+		return wait
+	}
+
+	if d := next.Sub(s.now()); d < wait {
+		wait = d
+	}
+	// Capsules that are due but whose failure couldn't be recorded shouldn't
+	// spin the loop.
+	if wait < s.minInterval {
+		wait = s.minInterval
+	}
+	return wait
+}
+
+// discardPublisher stands in for the broker in postgres mode, where the
+// capsule table itself is the schedule and outbox events only need draining.
+type discardPublisher struct{}
+
+func (discardPublisher) Publish(ctx context.Context, msg broker.Message) error {
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/mail"
+	"github.com/mnhsh/time-capsule/internal/storage"
+)
+
+// scrubber re-reads sealed capsules from storage and checks them against the
+// size and SHA-256 recorded at upload, so silent corruption is found while
+// there may still be a backup to restore from rather than when the capsule
+// opens. Time-locked capsules are checked against the SHA-256 of their
+// encrypted object instead, since their key mustn't be opened before unlock.
+type scrubber struct {
+	db      database.Store
+	storage storage.Backend
+	// keys decrypts content for checking. It may be nil, in which case
+	// capsules with a wrapped key are skipped.
+	keys      storage.KeyManager
+	mailer    mail.Mailer
+	operators []string
+	interval  time.Duration
+	// every is how long a verification stays current.
+	every     time.Duration
+	batchSize int32
+	// bytesPerSecond caps how fast objects are read, so a pass doesn't
+	// compete with users for the bucket.
+	bytesPerSecond int64
+	now            func() time.Time
+}
+
+type scrubReport struct {
+	checked int
+	skipped int
+	// failed lists capsules that went bad in this pass.
+	failed []database.Capsule
+}
+
+func newScrubber(db database.Store, backend storage.Backend, keys storage.KeyManager, mailer mail.Mailer, operators []string, every time.Duration, bytesPerSecond int64) *scrubber {
+	return &scrubber{
+		db:             db,
+		storage:        backend,
+		keys:           keys,
+		mailer:         mailer,
+		operators:      operators,
+		interval:       time.Hour,
+		every:          every,
+		batchSize:      100,
+		bytesPerSecond: bytesPerSecond,
+		now:            time.Now,
+	}
+}
+
+func (s *scrubber) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := s.scrub(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("scrubber: %v", err)
+		}
+		if report.checked > 0 || report.skipped > 0 {
+			log.Printf("scrubber: verified %d capsules, %d failed, %d skipped",
+				report.checked, len(report.failed), report.skipped)
+		}
+		if len(report.failed) > 0 {
+			s.notify(ctx, report.failed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrub makes one pass over every capsule that is due for verification.
+func (s *scrubber) scrub(ctx context.Context) (scrubReport, error) {
+	var report scrubReport
+	due := sql.NullTime{Time: s.now().Add(-s.every).UTC(), Valid: true}
+
+	var after uuid.UUID
+	for {
+		capsules, err := s.db.ListCapsulesToVerify(ctx, database.ListCapsulesToVerifyParams{
+			ID:             after,
+			LastVerifiedAt: due,
+			Limit:          s.batchSize,
+		})
+		if err != nil {
+			return report, fmt.Errorf("couldn't list capsules: %w", err)
+		}
+
+		for _, c := range capsules {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			// Archived objects can't be read without a restore, which costs
+			// more than checking them is worth; they're checked once the
+			// tiering job brings them back before unlock.
+			if storage.StorageClass(c.StorageClass).Archived() {
+				report.skipped++
+				continue
+			}
+			status, err := s.verify(ctx, c)
+			if err != nil {
+				report.skipped++
+				log.Printf("scrubber: couldn't verify capsule %s: %v", c.ID, err)
+				continue
+			}
+			err = s.db.RecordCapsuleVerification(ctx, database.RecordCapsuleVerificationParams{
+				ID:              c.ID,
+				LastVerifiedAt:  sql.NullTime{Time: s.now().UTC(), Valid: true},
+				IntegrityStatus: status,
+			})
+			if err != nil {
+				return report, fmt.Errorf("couldn't record verification of capsule %s: %w", c.ID, err)
+			}
+			report.checked++
+			if status != database.IntegrityStatusOK {
+				log.Printf("scrubber: capsule %s is %s (object %s)", c.ID, status, c.S3key)
+				// Only newly found problems are reported to operators.
+				if status != c.IntegrityStatus {
+					c.IntegrityStatus = status
+					report.failed = append(report.failed, c)
+				}
+			}
+		}
+
+		if len(capsules) < int(s.batchSize) {
+			return report, nil
+		}
+		after = capsules[len(capsules)-1].ID
+	}
+}
+
+// verify reads the capsule's object and returns its integrity status. An
+// error means the check itself couldn't be done and nothing was learned.
+func (s *scrubber) verify(ctx context.Context, c database.Capsule) (string, error) {
+	if c.EscrowedKey != nil && !c.ObjectSha256.Valid {
+		return "", errors.New("capsule is time-locked and its encrypted object has no recorded checksum")
+	}
+	dataKey, err := s.dataKey(ctx, c)
+	if err != nil {
+		return "", err
+	}
+
+	obj, err := s.storage.Get(ctx, c.S3key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return database.IntegrityStatusMissing, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer obj.Body.Close()
+
+	var body io.Reader = &throttledReader{ctx: ctx, r: obj.Body, rate: s.bytesPerSecond, start: time.Now()}
+	if dataKey != nil {
+		body, err = storage.DecryptReader(body, dataKey)
+		if errors.Is(err, storage.ErrDecrypt) {
+			return database.IntegrityStatusCorrupted, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	digest := storage.NewDigestReader(body)
+
+	_, err = io.Copy(io.Discard, digest)
+	if errors.Is(err, storage.ErrDecrypt) {
+		return database.IntegrityStatusCorrupted, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	got := digest.Digest()
+	if c.EscrowedKey != nil {
+		if got.SHA256 != c.ObjectSha256.String {
+			return database.IntegrityStatusCorrupted, nil
+		}
+		return database.IntegrityStatusOK, nil
+	}
+	if c.SizeBytes.Valid && got.Size != c.SizeBytes.Int64 {
+		return database.IntegrityStatusCorrupted, nil
+	}
+	if c.Sha256.Valid && got.SHA256 != c.Sha256.String {
+		return database.IntegrityStatusCorrupted, nil
+	}
+	return database.IntegrityStatusOK, nil
+}
+
+// dataKey returns the key the capsule's content is encrypted with, or nil if
+// the object is to be checked as stored: capsules from before encryption and
+// time-locked ones, whose escrowed key is never opened early.
+func (s *scrubber) dataKey(ctx context.Context, c database.Capsule) ([]byte, error) {
+	if c.WrappedKey == nil {
+		return nil, nil
+	}
+	if s.keys == nil {
+		return nil, errors.New("capsule is encrypted but KMS_KEY_FILE isn't set")
+	}
+	return s.keys.UnwrapDataKey(ctx, c.WrappedKey)
+}
+
+func (s *scrubber) notify(ctx context.Context, failed []database.Capsule) {
+	if len(s.operators) == 0 {
+		return
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "The storage scrubber found %d capsules whose content is no longer intact:\n\n", len(failed))
+	for _, c := range failed {
+		fmt.Fprintf(&body, "  %s  %-9s  object %s  (owner %s)\n", c.ID, c.IntegrityStatus, c.S3key, c.UserID)
+	}
+	body.WriteString("\nRestore the objects from a backup; the next pass verifies them again.\n")
+
+	for _, to := range s.operators {
+		err := s.mailer.Send(ctx, mail.Message{
+			To:      to,
+			Subject: fmt.Sprintf("Storage scrubber: %d damaged capsules", len(failed)),
+			Body:    body.String(),
+		})
+		if err != nil {
+			log.Printf("scrubber: couldn't notify %s: %v", to, err)
+		}
+	}
+}
+
+// throttledReader delays reads so that on average no more than rate bytes
+// are read per second. A rate of zero or less means no limit.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.rate <= 0 {
+		return t.r.Read(p)
+	}
+	// Keep single reads small enough that the pauses stay short.
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+
+	due := t.start.Add(time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return n, err
+}
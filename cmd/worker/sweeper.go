@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mnhsh/time-capsule/internal/database"
+)
+
+// sweeper is the safety net for lost delayed messages: it periodically finds
+// capsules that should have opened but didn't and unlocks them through the
+// same unlocker the consumer uses. It also retries unlock emails that failed.
+type sweeper struct {
+	db        database.Store
+	unlocker  *unlocker
+	batchSize int32
+	interval  time.Duration
+	// grace keeps the sweeper from racing the consumer on capsules whose
+	// message is simply still in flight.
+	grace time.Duration
+	now   func() time.Time
+}
+
+func newSweeper(db database.Store, u *unlocker) *sweeper {
+	return &sweeper{
+		db:        db,
+		unlocker:  u,
+		batchSize: 500,
+		interval:  5 * time.Minute,
+		grace:     5 * time.Minute,
+		now:       time.Now,
+	}
+}
+
+func (s *sweeper) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		recovered, err := s.sweep(ctx)
+		if err != nil {
+			log.Printf("sweeper: %v", err)
+		}
+		if recovered > 0 {
+			log.Printf("sweeper: recovered %d missed unlocks", recovered)
+		}
+		announced, err := s.unlocker.announcePending(ctx, s.batchSize)
+		if err != nil {
+			log.Printf("sweeper: %v", err)
+		}
+		if announced > 0 {
+			log.Printf("sweeper: sent %d unlock emails that had failed", announced)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep unlocks every overdue capsule and returns how many it recovered.
+func (s *sweeper) sweep(ctx context.Context) (int, error) {
+	cutoff := s.now().UTC().Add(-s.grace)
+	recovered := 0
+
+	for {
+		ids, err := s.db.GetOverdueCapsuleIDs(ctx, database.GetOverdueCapsuleIDsParams{
+			UnlockAt: cutoff,
+			Limit:    s.batchSize,
+		})
+		if err != nil {
+			return recovered, fmt.Errorf("couldn't get overdue capsules: %w", err)
+		}
+
+		// Capsules another worker is unlocking right now are skipped, and
+		// count as not recovered.
+		opened := 0
+		for _, id := range ids {
+			ok, err := s.unlocker.unlock(ctx, id)
+			if err != nil {
+				log.Printf("sweeper: couldn't unlock capsule %s: %v", id, err)
+				continue
+			}
+			if ok {
+				opened++
+			}
+		}
+		recovered += opened
+
+		// Stop on a short batch, or when nothing in a full batch could be
+		// unlocked, since the next query would return the same rows.
+		if len(ids) < int(s.batchSize) || opened == 0 {
+			return recovered, nil
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/storage"
+)
+
+// tierer moves the objects of sealed capsules between storage classes as
+// their unlock date approaches: colder while there's a long wait ahead, and
+// back to STANDARD, restoring archived objects first, ahead of the unlock.
+type tierer struct {
+	db        database.Store
+	storage   storage.Backend
+	policy    *storage.TieringPolicy
+	interval  time.Duration
+	batchSize int32
+	// restoreDays is how long S3 keeps a restored copy; it only needs to
+	// outlive the copy back to STANDARD.
+	restoreDays int32
+	now         func() time.Time
+}
+
+type tieringReport struct {
+	transitioned int
+	restoring    int
+	rehydrated   int
+}
+
+func newTierer(db database.Store, backend storage.Backend, policy *storage.TieringPolicy) *tierer {
+	return &tierer{
+		db:          db,
+		storage:     backend,
+		policy:      policy,
+		interval:    time.Hour,
+		batchSize:   100,
+		restoreDays: 7,
+		now:         time.Now,
+	}
+}
+
+func (t *tierer) run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := t.apply(ctx)
+		if errors.Is(err, storage.ErrTieringUnsupported) {
+			log.Printf("tiering: storage backend has no storage classes, stopping")
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("tiering: %v", err)
+		}
+		if report != (tieringReport{}) {
+			log.Printf("tiering: moved %d objects to colder classes, %d restoring, %d back in STANDARD",
+				report.transitioned, report.restoring, report.rehydrated)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// apply makes one pass over the capsules that haven't opened yet and the
+// opened ones still outside STANDARD. A failure for one capsule is logged and
+// doesn't stop the others.
+func (t *tierer) apply(ctx context.Context) (tieringReport, error) {
+	var report tieringReport
+	var after uuid.UUID
+	for {
+		capsules, err := t.db.ListCapsulesForTiering(ctx, database.ListCapsulesForTieringParams{
+			ID:    after,
+			Limit: t.batchSize,
+		})
+		if err != nil {
+			return report, fmt.Errorf("couldn't list capsules: %w", err)
+		}
+
+		for _, c := range capsules {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			err := t.tier(ctx, c, &report)
+			if errors.Is(err, storage.ErrTieringUnsupported) {
+				return report, err
+			}
+			if err != nil {
+				log.Printf("tiering: capsule %s: %v", c.ID, err)
+			}
+		}
+
+		if len(capsules) < int(t.batchSize) {
+			return report, nil
+		}
+		after = capsules[len(capsules)-1].ID
+	}
+}
+
+func (t *tierer) tier(ctx context.Context, c database.Capsule, report *tieringReport) error {
+	current := storage.StorageClass(c.StorageClass)
+	target := t.policy.ClassFor(c.UnlockAt.Sub(t.now()))
+	// An opened capsule's content must be readable, however it got here.
+	if c.IsUnlocked.Bool {
+		target = storage.StorageClassStandard
+	}
+
+	if target == storage.StorageClassStandard {
+		if current == storage.StorageClassStandard {
+			return nil
+		}
+		return t.rehydrate(ctx, c, current, report)
+	}
+	// Capsules only get colder until it's time to bring them back.
+	if !target.ColderThan(current) {
+		return nil
+	}
+	if err := t.transition(ctx, c, target); err != nil {
+		return err
+	}
+	report.transitioned++
+	return nil
+}
+
+// rehydrate brings the capsule's object back to STANDARD. Archived objects
+// are restored first, which takes hours, so this spans several passes.
+func (t *tierer) rehydrate(ctx context.Context, c database.Capsule, current storage.StorageClass, report *tieringReport) error {
+	if current.Archived() {
+		info, err := t.storage.Head(ctx, c.S3key)
+		if err != nil {
+			return fmt.Errorf("couldn't check restore of %s: %w", c.S3key, err)
+		}
+		switch {
+		case !info.StorageClass.Archived():
+			// Already copied back, but the row wasn't updated.
+		case info.Restore == storage.RestoreInProgress:
+			report.restoring++
+			return nil
+		case info.Restore == storage.RestoreNone:
+			if err := t.storage.Restore(ctx, c.S3key, t.restoreDays); err != nil {
+				return fmt.Errorf("couldn't restore %s: %w", c.S3key, err)
+			}
+			log.Printf("tiering: restoring capsule %s from %s ahead of its unlock at %s",
+				c.ID, current, c.UnlockAt.UTC().Format(time.RFC3339))
+			report.restoring++
+			return nil
+		}
+	}
+
+	if err := t.transition(ctx, c, storage.StorageClassStandard); err != nil {
+		return err
+	}
+	report.rehydrated++
+	return nil
+}
+
+// transition moves the object and records its new class. If the row can't be
+// updated the next pass finds the object already moved and tries again.
+func (t *tierer) transition(ctx context.Context, c database.Capsule, class storage.StorageClass) error {
+	info, err := t.storage.Head(ctx, c.S3key)
+	if err != nil {
+		return fmt.Errorf("couldn't check %s: %w", c.S3key, err)
+	}
+	if info.StorageClass != class {
+		if err := t.storage.Transition(ctx, c.S3key, class); err != nil {
+			return fmt.Errorf("couldn't move %s to %s: %w", c.S3key, class, err)
+		}
+	}
+	err = t.db.SetCapsuleStorageClass(ctx, database.SetCapsuleStorageClassParams{
+		ID:           c.ID,
+		StorageClass: string(class),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't record storage class: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/broker"
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/mail"
+)
+
+// unlocker opens capsules whose unlock time has passed and emails their owner.
+type unlocker struct {
+	db        database.Store
+	mailer    mail.Mailer
+	publisher broker.Publisher
+	// keys is nil unless time-lock mode is configured.
+	keys *keyReleaser
+	now  func() time.Time
+}
+
+func newUnlocker(db database.Store, mailer mail.Mailer, publisher broker.Publisher, keys *keyReleaser) *unlocker {
+	return &unlocker{
+		db:        db,
+		mailer:    mailer,
+		publisher: publisher,
+		keys:      keys,
+		now:       time.Now,
+	}
+}
+
+// handleMessage is the broker.Handler for the unlock queue.
+func (u *unlocker) handleMessage(ctx context.Context, msg broker.Message) error {
+	var m unlockMessage
+	if err := json.Unmarshal(msg.Body, &m); err != nil {
+		// Redelivering a malformed message will never succeed, so drop it.
+		log.Printf("unlocker: dropping malformed message %s: %v", msg.ID, err)
+		return nil
+	}
+
+	c, err := u.db.GetCapsuleForUnlock(ctx, m.CapsuleID)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("unlocker: capsule %s no longer exists", m.CapsuleID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't get capsule %s: %w", m.CapsuleID, err)
+	}
+
+	// The broker caps delays at broker.MaxDelay and clocks may drift, so the
+	// database is the source of truth for when the capsule opens.
+	if remaining := c.UnlockAt.Sub(u.now()); remaining > 0 {
+		return u.publisher.Publish(ctx, broker.Message{
+			ID:    msg.ID,
+			Body:  msg.Body,
+			Delay: remaining,
+		})
+	}
+
+	_, err = u.unlock(ctx, c.ID)
+	return err
+}
+
+// unlockEmailLease is how long a worker has to send an unlock email before
+// another may claim it. It outlasts the mailer's own send timeout.
+const unlockEmailLease = 10 * time.Minute
+
+// unlock opens the capsule unless another worker already has, and reports
+// whether this call did. Duplicate messages and the sweeper can race for the
+// same capsule; the row lock taken by UnlockCapsule lets only one through.
+// The owner is emailed once the unlock has committed; if that fails, the
+// capsule stays open and announcePending retries the email.
+func (u *unlocker) unlock(ctx context.Context, id uuid.UUID) (bool, error) {
+	ok, err := u.db.UnlockCapsule(ctx, id, func(q database.Querier, c database.Capsule) error {
+		return u.open(ctx, q, c)
+	})
+	if err != nil || !ok {
+		return ok, err
+	}
+	log.Printf("unlocker: capsule %s unlocked", id)
+
+	if _, err := u.announce(ctx, id); err != nil {
+		log.Printf("unlocker: couldn't email the owner of capsule %s: %v", id, err)
+	}
+	return true, nil
+}
+
+// open prepares a capsule locked in the caller's transaction q, which marks
+// it unlocked once open returns. Time-locked capsules get their key released
+// here, so the content is readable by the time the email lands.
+func (u *unlocker) open(ctx context.Context, q database.Querier, c database.Capsule) error {
+	if c.EscrowedKey == nil {
+		return nil
+	}
+	if u.keys == nil {
+		return fmt.Errorf("capsule %s is time-locked but ESCROW_PRIVATE_KEY_FILE isn't set", c.ID)
+	}
+	return u.keys.release(ctx, q, c)
+}
+
+// announce emails the owner of an open capsule and reports whether it did. It
+// does nothing when the email has gone out or another worker holds the lease
+// on it. No row lock is held while the mailer runs; a worker that dies between
+// sending and recording the email sends a duplicate once its lease runs out.
+func (u *unlocker) announce(ctx context.Context, id uuid.UUID) (bool, error) {
+	n, err := u.db.ClaimUnlockNotification(ctx, database.ClaimUnlockNotificationParams{
+		LeaseSeconds: int32(unlockEmailLease / time.Second),
+		ID:           id,
+	})
+	if err != nil {
+		return false, fmt.Errorf("couldn't claim unlock email: %w", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	c, err := u.db.GetCapsuleForUnlock(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("couldn't get capsule: %w", err)
+	}
+	user, err := u.db.GetUserByID(ctx, c.UserID)
+	if err != nil {
+		return false, fmt.Errorf("couldn't get owner: %w", err)
+	}
+	if err := u.mailer.Send(ctx, unlockEmail(user.Email, c)); err != nil {
+		return false, err
+	}
+	if err := u.db.MarkUnlockNotified(ctx, id); err != nil {
+		return true, fmt.Errorf("couldn't record unlock email: %w", err)
+	}
+	return true, nil
+}
+
+// announcePending retries the emails of capsules that opened without their
+// owner being told, and returns how many it sent. Each failure waits out its
+// lease before the next attempt.
+func (u *unlocker) announcePending(ctx context.Context, batchSize int32) (int, error) {
+	ids, err := u.db.ListUnannouncedCapsuleIDs(ctx, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't list unannounced capsules: %w", err)
+	}
+	sent := 0
+	for _, id := range ids {
+		ok, err := u.announce(ctx, id)
+		if err != nil {
+			log.Printf("unlocker: couldn't email the owner of capsule %s: %v", id, err)
+		}
+		if ok {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+func unlockEmail(to string, c database.Capsule) mail.Message {
+	title := c.Title.String
+	if title == "" {
+		title = "Untitled"
+	}
+	return mail.Message{
+		To:      to,
+		Subject: fmt.Sprintf("Your time capsule %q is open", title),
+		Body: fmt.Sprintf(
+			"The time capsule %q you sealed has reached its unlock date (%s) and is now available.\n\nCapsule ID: %s\n",
+			title,
+			c.UnlockAt.UTC().Format(time.RFC1123),
+			c.ID,
+		),
+	}
+}
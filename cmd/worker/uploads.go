@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/storage"
+)
+
+// pendingUploadExpiry is how old a direct upload that was never finalized
+// gets before it's dropped. The API's upload URLs last an hour; the rest
+// leaves time to finalize an upload that finished just before they expired.
+const pendingUploadExpiry = 24 * time.Hour
+
+// uploadExpirer drops direct uploads that were started and then abandoned:
+// the pending_upload row, the unfinished multipart upload, and whatever
+// plaintext object the client managed to store.
+type uploadExpirer struct {
+	db        database.Store
+	storage   storage.Backend
+	interval  time.Duration
+	expiry    time.Duration
+	batchSize int32
+	now       func() time.Time
+}
+
+func newUploadExpirer(db database.Store, backend storage.Backend) *uploadExpirer {
+	return &uploadExpirer{
+		db:        db,
+		storage:   backend,
+		interval:  time.Hour,
+		expiry:    pendingUploadExpiry,
+		batchSize: 100,
+		now:       time.Now,
+	}
+}
+
+func (e *uploadExpirer) run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		expired, err := e.expire(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("upload expiry: %v", err)
+		}
+		if expired > 0 {
+			log.Printf("upload expiry: dropped %d abandoned direct uploads", expired)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expire drops every pending upload past its expiry and returns how many it
+// dropped.
+func (e *uploadExpirer) expire(ctx context.Context) (int, error) {
+	cutoff := e.now().Add(-e.expiry).UTC()
+	expired := 0
+	for {
+		capsules, err := e.db.ListExpiredPendingCapsules(ctx, database.ListExpiredPendingCapsulesParams{
+			CreatedAt: cutoff,
+			Limit:     e.batchSize,
+		})
+		if err != nil {
+			return expired, fmt.Errorf("couldn't list pending uploads: %w", err)
+		}
+
+		for _, c := range capsules {
+			if ctx.Err() != nil {
+				return expired, ctx.Err()
+			}
+			// The row goes first: if the client finalizes at the last moment
+			// nothing is deleted, and if cleaning up storage fails below, the
+			// object is no longer referenced and the storage GC gets it.
+			n, err := e.db.DeletePendingCapsule(ctx, database.DeletePendingCapsuleParams{
+				ID:     c.ID,
+				UserID: c.UserID,
+			})
+			if err != nil {
+				return expired, fmt.Errorf("couldn't delete pending capsule %s: %w", c.ID, err)
+			}
+			if n == 0 {
+				continue
+			}
+			expired++
+
+			if c.UploadID.Valid {
+				if err := e.storage.AbortMultipartUpload(ctx, c.S3key, c.UploadID.String); err != nil {
+					log.Printf("upload expiry: couldn't abort multipart upload of capsule %s: %v", c.ID, err)
+				}
+			}
+			if err := e.storage.Delete(ctx, c.S3key); err != nil {
+				log.Printf("upload expiry: couldn't delete %s: %v", c.S3key, err)
+			}
+		}
+
+		if len(capsules) < int(e.batchSize) {
+			return expired, nil
+		}
+	}
+}
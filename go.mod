@@ -10,6 +10,7 @@ require (
 	github.com/golang-jwt/jwt/v5 v5.3.1
 	github.com/google/uuid v1.6.0
 	github.com/lib/pq v1.11.1
+	github.com/rabbitmq/amqp091-go v1.15.0
 )
 
 require (
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -18,6 +19,13 @@ type TokenType string
 
 const (
 	TokenTypeAccess TokenType = "capsule-access"
+	// TokenTypeEmailVerification tokens are emailed to confirm an address.
+	TokenTypeEmailVerification TokenType = "capsule-verify-email"
+	// TokenTypePasswordReset tokens are emailed to set a forgotten password.
+	TokenTypePasswordReset TokenType = "capsule-password-reset"
+	// TokenTypeMFAPending tokens stand for a login whose password checked
+	// out but whose second factor hasn't been given yet.
+	TokenTypeMFAPending TokenType = "capsule-mfa-pending"
 )
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
@@ -38,50 +46,119 @@ func CheckPasswordHash(password, hash string) (bool, error) {
 	return match, nil
 }
 
+// claims are the access token's registered claims plus the session the token
+// was issued to.
+type claims struct {
+	jwt.RegisteredClaims
+	SessionID string `json:"sid,omitempty"`
+}
+
 func MakeJwt(
 	userID uuid.UUID,
+	sessionID uuid.UUID,
 	tokenSecret string,
 	expiresIn time.Duration,
 ) (string, error) {
 	singingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   userID.String(),
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    string(TokenTypeAccess),
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   userID.String(),
+		},
+		SessionID: sessionID.String(),
 	})
 	return token.SignedString(singingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimStruct := jwt.RegisteredClaims{}
+// ValidateJWT returns the user and session an access token was issued to.
+// Tokens from before sessions existed have uuid.Nil for a session.
+func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, uuid.UUID, error) {
+	claimStruct := claims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, uuid.Nil, err
 	}
 
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, uuid.Nil, err
 	}
 
 	issuer, err := token.Claims.GetIssuer()
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, uuid.Nil, err
 	}
 	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+		return uuid.Nil, uuid.Nil, errors.New("invalid issuer")
 	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return uuid.Nil, uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	sessionID := uuid.Nil
+	if claimStruct.SessionID != "" {
+		sessionID, err = uuid.Parse(claimStruct.SessionID)
+		if err != nil {
+			return uuid.Nil, uuid.Nil, fmt.Errorf("invalid session ID: %w", err)
+		}
+	}
+	return id, sessionID, nil
+}
+
+// MakeSingleUseToken signs a token of the given type for userID. tokenID is
+// sent as the jti and names the row that makes the token single-use; the
+// signature only proves the token was issued here.
+func MakeSingleUseToken(
+	tokenType TokenType,
+	userID uuid.UUID,
+	tokenID uuid.UUID,
+	tokenSecret string,
+	expiresIn time.Duration,
+) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    string(tokenType),
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+		Subject:   userID.String(),
+		ID:        tokenID.String(),
+	})
+	return token.SignedString([]byte(tokenSecret))
+}
+
+// ValidateSingleUseToken checks a token made by MakeSingleUseToken and
+// returns its user and token ids. Whether it has been used is up to the
+// caller.
+func ValidateSingleUseToken(tokenString string, tokenType TokenType, tokenSecret string) (uuid.UUID, uuid.UUID, error) {
+	claimStruct := jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		&claimStruct,
+		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(string(tokenType)),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+
+	userID, err := uuid.Parse(claimStruct.Subject)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
 	}
-	return id, nil
+	tokenID, err := uuid.Parse(claimStruct.ID)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, fmt.Errorf("invalid token ID: %w", err)
+	}
+	return userID, tokenID, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -105,6 +182,13 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(token), nil
 }
 
+// HashRefreshToken returns the form a refresh token is stored in. Tokens are
+// random, so an unsalted SHA-256 is enough to make a leaked table useless.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
@@ -2,15 +2,24 @@ package auth
 
 import (
 	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
 	"net/http"
 
+	"github.com/google/uuid"
+
 	"github.com/mnhsh/time-capsule/internal/config"
+	"github.com/mnhsh/time-capsule/internal/events"
 	response "github.com/mnhsh/time-capsule/internal/response"
 )
 
 type contextKey string
 
-const UserIDKey contextKey = "userID"
+const (
+	UserIDKey    contextKey = "userID"
+	SessionIDKey contextKey = "sessionID"
+)
 
 func WithAuthMiddleware(cfg *config.Config, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -20,13 +29,67 @@ func WithAuthMiddleware(cfg *config.Config, next http.Handler) http.Handler {
 			return
 		}
 
-		userID, err := ValidateJWT(token, cfg.JWTSecret)
+		userID, sessionID, err := ValidateJWT(token, cfg.JWTSecret)
 		if err != nil {
 			response.RespondWithError(w, http.StatusUnauthorized, "Invalid Token", err)
 			return
 		}
 
+		// Access tokens outlive a revoke by up to their expiry unless the
+		// session is checked on every request.
+		if sessionID != uuid.Nil {
+			session, err := cfg.DB.GetSession(r.Context(), sessionID)
+			if errors.Is(err, sql.ErrNoRows) || (err == nil && (session.RevokedAt.Valid || session.UserID != userID)) {
+				response.RespondWithError(w, http.StatusUnauthorized, "Session has been signed out", err)
+				return
+			}
+			if err != nil {
+				response.RespondWithError(w, http.StatusInternalServerError, "Couldn't check session", err)
+				return
+			}
+		}
+
 		ctx := context.WithValue(r.Context(), UserIDKey, userID)
+		ctx = context.WithValue(ctx, SessionIDKey, sessionID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// WithAPIKeyMiddleware guards operator-only routes with cfg.AdminAPIKey. The
+// routes are disabled entirely when no key is configured.
+func WithAPIKeyMiddleware(cfg *config.Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.AdminAPIKey == "" {
+			response.RespondWithError(w, http.StatusForbidden, "Admin API disabled", errors.New("ADMIN_API_KEY is not set"))
+			return
+		}
+
+		key, err := GetAPIKey(r.Header)
+		if err != nil {
+			response.RespondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(key), []byte(cfg.AdminAPIKey)) != 1 {
+			response.RespondWithError(w, http.StatusUnauthorized, "Invalid API key", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequestIDMiddleware tags the request context with a correlation id, taken
+// from X-Request-ID when the client sends one, so events written while
+// handling the request can be traced back to it.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := events.WithCorrelationID(r.Context(), id)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -34,10 +97,13 @@ func WithAuthMiddleware(cfg *config.Config, next http.Handler) http.Handler {
 func CORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Capsule-Id")
 
-		if r.Method == "OPTIONS" {
+		// Only preflights are answered here; tus clients send plain OPTIONS
+		// requests for server discovery.
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
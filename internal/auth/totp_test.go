@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from RFC 6238 appendix B.
+var rfcSecret = []byte("12345678901234567890")
+
+// The appendix lists 8-digit codes; these are their last six digits.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		step := TOTPStep(time.Unix(v.unix, 0))
+		if got := TOTPCode(rfcSecret, step); got != v.code {
+			t.Errorf("code at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestValidateTOTPAcceptsRFC6238Codes(t *testing.T) {
+	for _, v := range rfcVectors {
+		now := time.Unix(v.unix, 0)
+		step, ok := ValidateTOTP(rfcSecret, v.code, now)
+		if !ok {
+			t.Errorf("code %s rejected at %d", v.code, v.unix)
+			continue
+		}
+		if want := TOTPStep(now); step != want {
+			t.Errorf("code %s matched step %d, want %d", v.code, step, want)
+		}
+	}
+}
+
+func TestValidateTOTPAllowsOneStepOfSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := TOTPStep(now)
+
+	for _, offset := range []int64{-1, 1} {
+		code := TOTPCode(rfcSecret, current+offset)
+		step, ok := ValidateTOTP(rfcSecret, code, now)
+		if !ok {
+			t.Errorf("code from step %+d rejected", offset)
+			continue
+		}
+		if step != current+offset {
+			t.Errorf("code from step %+d matched step %d, want %d", offset, step, current+offset)
+		}
+	}
+	for _, offset := range []int64{-2, 2} {
+		code := TOTPCode(rfcSecret, current+offset)
+		if _, ok := ValidateTOTP(rfcSecret, code, now); ok {
+			t.Errorf("code from step %+d accepted", offset)
+		}
+	}
+}
+
+func TestValidateTOTPRejectsMalformedCodes(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870822", "94287082", "abcdef"} {
+		if _, ok := ValidateTOTP(rfcSecret, code, now); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+	if _, ok := ValidateTOTP(rfcSecret, " 287 082 ", now); !ok {
+		t.Error("code with spaces rejected")
+	}
+}
+
+// Replays are caught by comparing the matched step with the last one used,
+// so a code must match the same step every time it's entered while valid.
+func TestValidateTOTPReplayMatchesSameStep(t *testing.T) {
+	issued := time.Unix(1111111109, 0)
+	first, ok := ValidateTOTP(rfcSecret, "081804", issued)
+	if !ok {
+		t.Fatal("code rejected")
+	}
+	replayed, ok := ValidateTOTP(rfcSecret, "081804", issued.Add(totpPeriod))
+	if !ok {
+		t.Fatal("code rejected within its skew window")
+	}
+	if replayed != first {
+		t.Errorf("replayed code matched step %d, want %d", replayed, first)
+	}
+}
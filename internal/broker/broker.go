@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DelayedExchange is the x-delayed-message exchange enabled in Dockerfile.rabbitmq.
+	DelayedExchange = "capsule.delayed"
+	UnlockQueue     = "capsule.unlock"
+	UnlockRouteKey  = "capsule.unlock"
+
+	// MaxDelay is the largest x-delay the delayed message plugin accepts (2^32-1 ms,
+	// roughly 49 days). Longer delays have to be re-scheduled by the consumer.
+	MaxDelay = time.Duration(1<<32-1) * time.Millisecond
+)
+
+// Message is a single event handed to a Publisher.
+type Message struct {
+	ID    string
+	Body  []byte
+	Delay time.Duration
+	// Attempts is how many times handling the message has failed so far.
+	Attempts int
+}
+
+// Publisher delivers messages to the broker. Publish must only return nil
+// once the broker has confirmed the message.
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+// Handler processes a delivered message. Returning an error hands the message
+// back to the broker, which redelivers it after a growing delay and gives up
+// after a few attempts.
+type Handler func(ctx context.Context, msg Message) error
+
+// Consumer delivers messages from the unlock queue to a Handler until ctx is
+// cancelled or the connection is lost.
+type Consumer interface {
+	Consume(ctx context.Context, h Handler) error
+}
@@ -0,0 +1,198 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const prefetchCount = 10
+
+// Failed deliveries are published again with retryBaseDelay doubling up to
+// retryMaxDelay, and dropped after maxAttempts. Capsules whose message is
+// dropped are picked up by the worker's sweeper.
+const (
+	maxAttempts    = 8
+	retryBaseDelay = 5 * time.Second
+	retryMaxDelay  = 10 * time.Minute
+	attemptsHeader = "x-attempts"
+)
+
+type RabbitMQ struct {
+	conn *amqp.Connection
+	ch   *amqp.Channel
+	mu   sync.Mutex // amqp channels are not safe for concurrent publishes
+}
+
+func NewRabbitMQ(url string) (*RabbitMQ, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := declareTopology(ch); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("couldn't enable publisher confirms: %w", err)
+	}
+
+	return &RabbitMQ{conn: conn, ch: ch}, nil
+}
+
+func declareTopology(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(
+		DelayedExchange,
+		"x-delayed-message",
+		true,  // durable
+		false, // autoDelete
+		false, // internal
+		false, // noWait
+		amqp.Table{"x-delayed-type": "direct"},
+	)
+	if err != nil {
+		return fmt.Errorf("couldn't declare exchange: %w", err)
+	}
+
+	// The queue is declared here as well so that messages published before the
+	// first consumer starts are not dropped by an unbound exchange.
+	_, err = ch.QueueDeclare(UnlockQueue, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("couldn't declare queue: %w", err)
+	}
+
+	err = ch.QueueBind(UnlockQueue, UnlockRouteKey, DelayedExchange, false, nil)
+	if err != nil {
+		return fmt.Errorf("couldn't bind queue: %w", err)
+	}
+	return nil
+}
+
+func (r *RabbitMQ) Publish(ctx context.Context, msg Message) error {
+	delay := msg.Delay
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > MaxDelay {
+		delay = MaxDelay
+	}
+
+	r.mu.Lock()
+	dc, err := r.ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		DelayedExchange,
+		UnlockRouteKey,
+		false, // mandatory is not supported by the delayed exchange
+		false,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    msg.ID,
+			Headers:      amqp.Table{"x-delay": delay.Milliseconds(), attemptsHeader: int32(msg.Attempts)},
+			Body:         msg.Body,
+		},
+	)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	acked, err := dc.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return fmt.Errorf("broker nacked message %s", msg.ID)
+	}
+	return nil
+}
+
+func (r *RabbitMQ) Consume(ctx context.Context, h Handler) error {
+	// Consumers get their own channel so acks never queue behind publishes.
+	ch, err := r.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := ch.Qos(prefetchCount, 0, false); err != nil {
+		return err
+	}
+
+	deliveries, err := ch.ConsumeWithContext(ctx, UnlockQueue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-deliveries:
+			if !ok {
+				return errors.New("delivery channel closed")
+			}
+			msg := Message{ID: d.MessageId, Body: d.Body, Attempts: attempts(d)}
+			err := h(ctx, msg)
+			if err != nil {
+				log.Printf("broker: handler failed for message %s: %v", d.MessageId, err)
+				r.retry(ctx, d, msg)
+				continue
+			}
+			d.Ack(false)
+		}
+	}
+}
+
+// retry schedules another delivery of a failed message. Requeueing it would
+// hand it straight back to the consumer, so it is published again with a
+// delay instead and the original is acked once the copy is confirmed.
+func (r *RabbitMQ) retry(ctx context.Context, d amqp.Delivery, msg Message) {
+	msg.Attempts++
+	if msg.Attempts >= maxAttempts {
+		log.Printf("broker: dropping message %s after %d attempts", msg.ID, msg.Attempts)
+		d.Ack(false)
+		return
+	}
+
+	msg.Delay = retryMaxDelay
+	if exp := retryBaseDelay << (msg.Attempts - 1); exp < retryMaxDelay {
+		msg.Delay = exp
+	}
+	if err := r.Publish(ctx, msg); err != nil {
+		// Without a confirmed copy the message can only go back on the queue.
+		log.Printf("broker: couldn't schedule retry of message %s: %v", msg.ID, err)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// attempts reads how many times a delivery has already failed.
+func attempts(d amqp.Delivery) int {
+	switch n := d.Headers[attemptsHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	}
+	return 0
+}
+
+func (r *RabbitMQ) Close() error {
+	return r.conn.Close()
+}
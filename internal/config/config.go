@@ -2,11 +2,23 @@ package config
 
 import (
 	"github.com/mnhsh/time-capsule/internal/database"
+	"github.com/mnhsh/time-capsule/internal/mail"
 	storage "github.com/mnhsh/time-capsule/internal/storage"
 )
 
 type Config struct {
-	DB        database.Store
-	JWTSecret string
-	Storage   storage.S3Storage
+	DB            database.Store
+	JWTSecret     string
+	Storage       storage.Backend
+	Keys          storage.KeyManager
+	Escrow        *storage.EscrowSealer // nil unless time-lock mode is on
+	AdminAPIKey   string
+	MaxUploadSize int64
+	// TrustProxy takes client addresses from X-Forwarded-For, which is only
+	// safe behind a proxy that sets it.
+	TrustProxy bool
+	Mailer     mail.Mailer
+	// AppURL is where links in account emails point, e.g.
+	// https://capsule.example.com. Without it the emails carry bare tokens.
+	AppURL string
 }
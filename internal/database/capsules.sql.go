@@ -13,20 +13,53 @@ import (
 	"github.com/google/uuid"
 )
 
+const claimUnlockNotification = `-- name: ClaimUnlockNotification :execrows
+UPDATE capsule
+SET unlock_notify_after = now() + $1::int * interval '1 second'
+WHERE id = $2
+  AND is_unlocked IS TRUE
+  AND unlock_notified_at IS NULL
+  AND (unlock_notify_after IS NULL OR unlock_notify_after < now())
+`
+
+type ClaimUnlockNotificationParams struct {
+	LeaseSeconds int32
+	ID           uuid.UUID
+}
+
+// Leases the unlock email of an open capsule to the caller, unless it has
+// gone out or another worker holds the lease. A lease that has run out (a
+// crashed worker or a failed send) can be claimed again.
+func (q *Queries) ClaimUnlockNotification(ctx context.Context, arg ClaimUnlockNotificationParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, claimUnlockNotification, arg.LeaseSeconds, arg.ID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const createCapsule = `-- name: CreateCapsule :one
-INSERT INTO capsule (id, user_id, title, created_at, s3key, unlock_at, is_unlocked)
-VALUES ($1, $2, $3, $4, $5, $6, $7)
-RETURNING id, user_id, title, created_at, s3key, unlock_at, is_unlocked
+INSERT INTO capsule (id, user_id, title, created_at, s3key, unlock_at, is_unlocked, upload_status, size_bytes, sha256, upload_id, wrapped_key, escrowed_key, content_type, object_sha256)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+RETURNING id, user_id, title, created_at, s3key, unlock_at, is_unlocked, upload_status, size_bytes, sha256, upload_id, wrapped_key, escrowed_key, content_type, last_verified_at, integrity_status, storage_class, unlock_attempts, next_unlock_attempt_at, object_sha256, unlock_notified_at, unlock_notify_after
 `
 
 type CreateCapsuleParams struct {
-	ID         uuid.UUID
-	UserID     uuid.UUID
-	Title      sql.NullString
-	CreatedAt  time.Time
-	S3key      string
-	UnlockAt   time.Time
-	IsUnlocked sql.NullBool
+	ID           uuid.UUID
+	UserID       uuid.UUID
+	Title        sql.NullString
+	CreatedAt    time.Time
+	S3key        string
+	UnlockAt     time.Time
+	IsUnlocked   sql.NullBool
+	UploadStatus string
+	SizeBytes    sql.NullInt64
+	Sha256       sql.NullString
+	UploadID     sql.NullString
+	WrappedKey   []byte
+	EscrowedKey  []byte
+	ContentType  sql.NullString
+	ObjectSha256 sql.NullString
 }
 
 func (q *Queries) CreateCapsule(ctx context.Context, arg CreateCapsuleParams) (Capsule, error) {
@@ -38,6 +71,14 @@ func (q *Queries) CreateCapsule(ctx context.Context, arg CreateCapsuleParams) (C
 		arg.S3key,
 		arg.UnlockAt,
 		arg.IsUnlocked,
+		arg.UploadStatus,
+		arg.SizeBytes,
+		arg.Sha256,
+		arg.UploadID,
+		arg.WrappedKey,
+		arg.EscrowedKey,
+		arg.ContentType,
+		arg.ObjectSha256,
 	)
 	var i Capsule
 	err := row.Scan(
@@ -48,38 +89,125 @@ func (q *Queries) CreateCapsule(ctx context.Context, arg CreateCapsuleParams) (C
 		&i.S3key,
 		&i.UnlockAt,
 		&i.IsUnlocked,
+		&i.UploadStatus,
+		&i.SizeBytes,
+		&i.Sha256,
+		&i.UploadID,
+		&i.WrappedKey,
+		&i.EscrowedKey,
+		&i.ContentType,
+		&i.LastVerifiedAt,
+		&i.IntegrityStatus,
+		&i.StorageClass,
+		&i.UnlockAttempts,
+		&i.NextUnlockAttemptAt,
+		&i.ObjectSha256,
+		&i.UnlockNotifiedAt,
+		&i.UnlockNotifyAfter,
 	)
 	return i, err
 }
 
-const getCapsuleForUnlock = `-- name: GetCapsuleForUnlock :one
-SELECT id, user_id, title, s3key, is_unlocked FROM capsule
-WHERE id = $1 LIMIT 1
+const deletePendingCapsule = `-- name: DeletePendingCapsule :execrows
+DELETE FROM capsule
+WHERE id = $1
+  AND user_id = $2
+  AND upload_status = 'pending_upload'
 `
 
-type GetCapsuleForUnlockRow struct {
-	ID         uuid.UUID
-	UserID     uuid.UUID
-	Title      sql.NullString
-	S3key      string
-	IsUnlocked sql.NullBool
+type DeletePendingCapsuleParams struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+}
+
+// Drops a direct upload that failed verification or was abandoned. No rows
+// means it was finalized in the meantime.
+func (q *Queries) DeletePendingCapsule(ctx context.Context, arg DeletePendingCapsuleParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deletePendingCapsule, arg.ID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
-func (q *Queries) GetCapsuleForUnlock(ctx context.Context, id uuid.UUID) (GetCapsuleForUnlockRow, error) {
+const getCapsuleByIDForUser = `-- name: GetCapsuleByIDForUser :one
+SELECT id, user_id, title, created_at, s3key, unlock_at, is_unlocked, upload_status, size_bytes, sha256, upload_id, wrapped_key, escrowed_key, content_type, last_verified_at, integrity_status, storage_class, unlock_attempts, next_unlock_attempt_at, object_sha256, unlock_notified_at, unlock_notify_after FROM capsule
+WHERE id = $1
+  AND user_id = $2
+`
+
+type GetCapsuleByIDForUserParams struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+}
+
+func (q *Queries) GetCapsuleByIDForUser(ctx context.Context, arg GetCapsuleByIDForUserParams) (Capsule, error) {
+	row := q.db.QueryRowContext(ctx, getCapsuleByIDForUser, arg.ID, arg.UserID)
+	var i Capsule
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Title,
+		&i.CreatedAt,
+		&i.S3key,
+		&i.UnlockAt,
+		&i.IsUnlocked,
+		&i.UploadStatus,
+		&i.SizeBytes,
+		&i.Sha256,
+		&i.UploadID,
+		&i.WrappedKey,
+		&i.EscrowedKey,
+		&i.ContentType,
+		&i.LastVerifiedAt,
+		&i.IntegrityStatus,
+		&i.StorageClass,
+		&i.UnlockAttempts,
+		&i.NextUnlockAttemptAt,
+		&i.ObjectSha256,
+		&i.UnlockNotifiedAt,
+		&i.UnlockNotifyAfter,
+	)
+	return i, err
+}
+
+const getCapsuleForUnlock = `-- name: GetCapsuleForUnlock :one
+SELECT id, user_id, title, created_at, s3key, unlock_at, is_unlocked, upload_status, size_bytes, sha256, upload_id, wrapped_key, escrowed_key, content_type, last_verified_at, integrity_status, storage_class, unlock_attempts, next_unlock_attempt_at, object_sha256, unlock_notified_at, unlock_notify_after FROM capsule
+WHERE id = $1 LIMIT 1
+`
+
+func (q *Queries) GetCapsuleForUnlock(ctx context.Context, id uuid.UUID) (Capsule, error) {
 	row := q.db.QueryRowContext(ctx, getCapsuleForUnlock, id)
-	var i GetCapsuleForUnlockRow
+	var i Capsule
 	err := row.Scan(
 		&i.ID,
 		&i.UserID,
 		&i.Title,
+		&i.CreatedAt,
 		&i.S3key,
+		&i.UnlockAt,
 		&i.IsUnlocked,
+		&i.UploadStatus,
+		&i.SizeBytes,
+		&i.Sha256,
+		&i.UploadID,
+		&i.WrappedKey,
+		&i.EscrowedKey,
+		&i.ContentType,
+		&i.LastVerifiedAt,
+		&i.IntegrityStatus,
+		&i.StorageClass,
+		&i.UnlockAttempts,
+		&i.NextUnlockAttemptAt,
+		&i.ObjectSha256,
+		&i.UnlockNotifiedAt,
+		&i.UnlockNotifyAfter,
 	)
 	return i, err
 }
 
 const getCapsulesByUserID = `-- name: GetCapsulesByUserID :many
-SELECT id, user_id, title, created_at, s3key, unlock_at, is_unlocked FROM capsule WHERE user_id = $1 ORDER BY created_at DESC
+SELECT id, user_id, title, created_at, s3key, unlock_at, is_unlocked, upload_status, size_bytes, sha256, upload_id, wrapped_key, escrowed_key, content_type, last_verified_at, integrity_status, storage_class, unlock_attempts, next_unlock_attempt_at, object_sha256, unlock_notified_at, unlock_notify_after FROM capsule WHERE user_id = $1 AND upload_status = 'complete' ORDER BY created_at DESC
 `
 
 func (q *Queries) GetCapsulesByUserID(ctx context.Context, userID uuid.UUID) ([]Capsule, error) {
@@ -99,6 +227,21 @@ func (q *Queries) GetCapsulesByUserID(ctx context.Context, userID uuid.UUID) ([]
 			&i.S3key,
 			&i.UnlockAt,
 			&i.IsUnlocked,
+			&i.UploadStatus,
+			&i.SizeBytes,
+			&i.Sha256,
+			&i.UploadID,
+			&i.WrappedKey,
+			&i.EscrowedKey,
+			&i.ContentType,
+			&i.LastVerifiedAt,
+			&i.IntegrityStatus,
+			&i.StorageClass,
+			&i.UnlockAttempts,
+			&i.NextUnlockAttemptAt,
+			&i.ObjectSha256,
+			&i.UnlockNotifiedAt,
+			&i.UnlockNotifyAfter,
 		); err != nil {
 			return nil, err
 		}
@@ -113,13 +256,554 @@ func (q *Queries) GetCapsulesByUserID(ctx context.Context, userID uuid.UUID) ([]
 	return items, nil
 }
 
-const markAsUnlocked = `-- name: MarkAsUnlocked :exec
+const getNextUnlockAt = `-- name: GetNextUnlockAt :one
+SELECT next_at FROM (
+    (SELECT unlock_at AS next_at FROM capsule
+     WHERE is_unlocked IS NOT TRUE
+       AND upload_status = 'complete'
+       AND next_unlock_attempt_at IS NULL
+     ORDER BY unlock_at ASC
+     LIMIT 1)
+    UNION ALL
+    (SELECT next_unlock_attempt_at AS next_at FROM capsule
+     WHERE is_unlocked IS NOT TRUE
+       AND upload_status = 'complete'
+       AND next_unlock_attempt_at IS NOT NULL
+     ORDER BY next_unlock_attempt_at ASC
+     LIMIT 1)
+) AS candidates
+ORDER BY next_at ASC
+LIMIT 1
+`
+
+// When the scheduler next has work: the earliest unlock_at, or retry time for
+// capsules that are backing off. Each half is the first entry of an index.
+func (q *Queries) GetNextUnlockAt(ctx context.Context) (time.Time, error) {
+	row := q.db.QueryRowContext(ctx, getNextUnlockAt)
+	var next_at time.Time
+	err := row.Scan(&next_at)
+	return next_at, err
+}
+
+const getOverdueCapsuleIDs = `-- name: GetOverdueCapsuleIDs :many
+SELECT id FROM capsule
+WHERE unlock_at <= $1
+  AND is_unlocked IS NOT TRUE
+  AND upload_status = 'complete'
+ORDER BY unlock_at ASC
+LIMIT $2
+`
+
+type GetOverdueCapsuleIDsParams struct {
+	UnlockAt time.Time
+	Limit    int32
+}
+
+func (q *Queries) GetOverdueCapsuleIDs(ctx context.Context, arg GetOverdueCapsuleIDsParams) ([]uuid.UUID, error) {
+	rows, err := q.db.QueryContext(ctx, getOverdueCapsuleIDs, arg.UnlockAt, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listCapsulesForTiering = `-- name: ListCapsulesForTiering :many
+SELECT id, user_id, title, created_at, s3key, unlock_at, is_unlocked, upload_status, size_bytes, sha256, upload_id, wrapped_key, escrowed_key, content_type, last_verified_at, integrity_status, storage_class, unlock_attempts, next_unlock_attempt_at, object_sha256, unlock_notified_at, unlock_notify_after FROM capsule
+WHERE id > $1
+  AND upload_status = 'complete'
+  AND (is_unlocked IS NOT TRUE OR storage_class <> 'STANDARD')
+ORDER BY id
+LIMIT $2
+`
+
+type ListCapsulesForTieringParams struct {
+	ID    uuid.UUID
+	Limit int32
+}
+
+// Pages through sealed capsules by id: those that haven't opened yet, and
+// opened ones whose object still has to come back to STANDARD.
+func (q *Queries) ListCapsulesForTiering(ctx context.Context, arg ListCapsulesForTieringParams) ([]Capsule, error) {
+	rows, err := q.db.QueryContext(ctx, listCapsulesForTiering, arg.ID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Capsule
+	for rows.Next() {
+		var i Capsule
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Title,
+			&i.CreatedAt,
+			&i.S3key,
+			&i.UnlockAt,
+			&i.IsUnlocked,
+			&i.UploadStatus,
+			&i.SizeBytes,
+			&i.Sha256,
+			&i.UploadID,
+			&i.WrappedKey,
+			&i.EscrowedKey,
+			&i.ContentType,
+			&i.LastVerifiedAt,
+			&i.IntegrityStatus,
+			&i.StorageClass,
+			&i.UnlockAttempts,
+			&i.NextUnlockAttemptAt,
+			&i.ObjectSha256,
+			&i.UnlockNotifiedAt,
+			&i.UnlockNotifyAfter,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listCapsulesToVerify = `-- name: ListCapsulesToVerify :many
+SELECT id, user_id, title, created_at, s3key, unlock_at, is_unlocked, upload_status, size_bytes, sha256, upload_id, wrapped_key, escrowed_key, content_type, last_verified_at, integrity_status, storage_class, unlock_attempts, next_unlock_attempt_at, object_sha256, unlock_notified_at, unlock_notify_after FROM capsule
+WHERE id > $1
+  AND upload_status = 'complete'
+  AND (last_verified_at IS NULL OR last_verified_at < $2)
+ORDER BY id
+LIMIT $3
+`
+
+type ListCapsulesToVerifyParams struct {
+	ID             uuid.UUID
+	LastVerifiedAt sql.NullTime
+	Limit          int32
+}
+
+// Pages through sealed capsules by id for the scrubber, skipping those that
+// were verified since $2.
+func (q *Queries) ListCapsulesToVerify(ctx context.Context, arg ListCapsulesToVerifyParams) ([]Capsule, error) {
+	rows, err := q.db.QueryContext(ctx, listCapsulesToVerify, arg.ID, arg.LastVerifiedAt, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Capsule
+	for rows.Next() {
+		var i Capsule
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Title,
+			&i.CreatedAt,
+			&i.S3key,
+			&i.UnlockAt,
+			&i.IsUnlocked,
+			&i.UploadStatus,
+			&i.SizeBytes,
+			&i.Sha256,
+			&i.UploadID,
+			&i.WrappedKey,
+			&i.EscrowedKey,
+			&i.ContentType,
+			&i.LastVerifiedAt,
+			&i.IntegrityStatus,
+			&i.StorageClass,
+			&i.UnlockAttempts,
+			&i.NextUnlockAttemptAt,
+			&i.ObjectSha256,
+			&i.UnlockNotifiedAt,
+			&i.UnlockNotifyAfter,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listDueCapsules = `-- name: ListDueCapsules :many
+SELECT id, unlock_attempts FROM capsule
+WHERE unlock_at <= now()
+  AND is_unlocked IS NOT TRUE
+  AND upload_status = 'complete'
+  AND (next_unlock_attempt_at IS NULL OR next_unlock_attempt_at <= now())
+ORDER BY unlock_at ASC
+LIMIT $1
+FOR UPDATE SKIP LOCKED
+`
+
+type ListDueCapsulesRow struct {
+	ID             uuid.UUID
+	UnlockAttempts int32
+}
+
+// Due capsules for the broker-less scheduler, leaving out those backing off
+// after a failed unlock and those another worker is unlocking right now.
+func (q *Queries) ListDueCapsules(ctx context.Context, limit int32) ([]ListDueCapsulesRow, error) {
+	rows, err := q.db.QueryContext(ctx, listDueCapsules, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListDueCapsulesRow
+	for rows.Next() {
+		var i ListDueCapsulesRow
+		if err := rows.Scan(&i.ID, &i.UnlockAttempts); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listExpiredPendingCapsules = `-- name: ListExpiredPendingCapsules :many
+SELECT id, user_id, title, created_at, s3key, unlock_at, is_unlocked, upload_status, size_bytes, sha256, upload_id, wrapped_key, escrowed_key, content_type, last_verified_at, integrity_status, storage_class, unlock_attempts, next_unlock_attempt_at, object_sha256, unlock_notified_at, unlock_notify_after FROM capsule
+WHERE upload_status = 'pending_upload'
+  AND created_at < $1
+ORDER BY created_at ASC
+LIMIT $2
+`
+
+type ListExpiredPendingCapsulesParams struct {
+	CreatedAt time.Time
+	Limit     int32
+}
+
+// Direct uploads started before $1 that were never finalized, oldest first.
+func (q *Queries) ListExpiredPendingCapsules(ctx context.Context, arg ListExpiredPendingCapsulesParams) ([]Capsule, error) {
+	rows, err := q.db.QueryContext(ctx, listExpiredPendingCapsules, arg.CreatedAt, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Capsule
+	for rows.Next() {
+		var i Capsule
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Title,
+			&i.CreatedAt,
+			&i.S3key,
+			&i.UnlockAt,
+			&i.IsUnlocked,
+			&i.UploadStatus,
+			&i.SizeBytes,
+			&i.Sha256,
+			&i.UploadID,
+			&i.WrappedKey,
+			&i.EscrowedKey,
+			&i.ContentType,
+			&i.LastVerifiedAt,
+			&i.IntegrityStatus,
+			&i.StorageClass,
+			&i.UnlockAttempts,
+			&i.NextUnlockAttemptAt,
+			&i.ObjectSha256,
+			&i.UnlockNotifiedAt,
+			&i.UnlockNotifyAfter,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listStorageKeysForUser = `-- name: ListStorageKeysForUser :many
+SELECT s3key FROM capsule
+WHERE user_id = $1
+  AND (upload_status <> 'pending_upload' OR created_at >= $2)
+UNION
+SELECT s3key FROM uploads WHERE user_id = $1
+`
+
+type ListStorageKeysForUserParams struct {
+	UserID    uuid.UUID
+	CreatedAt time.Time
+}
+
+// Every object key a user's rows still point to, including capsules and tus
+// uploads that are still in progress. Direct uploads started before $2 are
+// left out: they're abandoned and only wait for the worker to expire them.
+func (q *Queries) ListStorageKeysForUser(ctx context.Context, arg ListStorageKeysForUserParams) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, listStorageKeysForUser, arg.UserID, arg.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var s3key string
+		if err := rows.Scan(&s3key); err != nil {
+			return nil, err
+		}
+		items = append(items, s3key)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listUnannouncedCapsuleIDs = `-- name: ListUnannouncedCapsuleIDs :many
+SELECT id FROM capsule
+WHERE is_unlocked IS TRUE
+  AND unlock_notified_at IS NULL
+  AND (unlock_notify_after IS NULL OR unlock_notify_after < now())
+ORDER BY unlock_at ASC
+LIMIT $1
+`
+
+// Open capsules whose owner hasn't been emailed yet and that no worker holds
+// a lease on.
+func (q *Queries) ListUnannouncedCapsuleIDs(ctx context.Context, limit int32) ([]uuid.UUID, error) {
+	rows, err := q.db.QueryContext(ctx, listUnannouncedCapsuleIDs, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const lockCapsuleForUnlock = `-- name: LockCapsuleForUnlock :one
+SELECT id, user_id, title, created_at, s3key, unlock_at, is_unlocked, upload_status, size_bytes, sha256, upload_id, wrapped_key, escrowed_key, content_type, last_verified_at, integrity_status, storage_class, unlock_attempts, next_unlock_attempt_at, object_sha256, unlock_notified_at, unlock_notify_after FROM capsule
+WHERE id = $1
+  AND is_unlocked IS NOT TRUE
+FOR UPDATE SKIP LOCKED
+`
+
+// Locks a capsule that hasn't opened yet. A row another worker is already
+// unlocking is skipped, so no row means there is nothing left to do.
+func (q *Queries) LockCapsuleForUnlock(ctx context.Context, id uuid.UUID) (Capsule, error) {
+	row := q.db.QueryRowContext(ctx, lockCapsuleForUnlock, id)
+	var i Capsule
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Title,
+		&i.CreatedAt,
+		&i.S3key,
+		&i.UnlockAt,
+		&i.IsUnlocked,
+		&i.UploadStatus,
+		&i.SizeBytes,
+		&i.Sha256,
+		&i.UploadID,
+		&i.WrappedKey,
+		&i.EscrowedKey,
+		&i.ContentType,
+		&i.LastVerifiedAt,
+		&i.IntegrityStatus,
+		&i.StorageClass,
+		&i.UnlockAttempts,
+		&i.NextUnlockAttemptAt,
+		&i.ObjectSha256,
+		&i.UnlockNotifiedAt,
+		&i.UnlockNotifyAfter,
+	)
+	return i, err
+}
+
+const markAsUnlocked = `-- name: MarkAsUnlocked :execrows
 UPDATE capsule
 SET is_unlocked = true
 WHERE id = $1
+  AND is_unlocked IS NOT TRUE
 `
 
-func (q *Queries) MarkAsUnlocked(ctx context.Context, id uuid.UUID) error {
-	_, err := q.db.ExecContext(ctx, markAsUnlocked, id)
+func (q *Queries) MarkAsUnlocked(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, markAsUnlocked, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const markCapsuleUploaded = `-- name: MarkCapsuleUploaded :execrows
+UPDATE capsule
+SET
+    upload_status = 'complete',
+    upload_id = NULL,
+    wrapped_key = $3,
+    s3key = $4,
+    escrowed_key = $5,
+    sha256 = $6,
+    object_sha256 = $7
+WHERE id = $1
+  AND user_id = $2
+  AND upload_status = 'pending_upload'
+`
+
+type MarkCapsuleUploadedParams struct {
+	ID           uuid.UUID
+	UserID       uuid.UUID
+	WrappedKey   []byte
+	S3key        string
+	EscrowedKey  []byte
+	Sha256       sql.NullString
+	ObjectSha256 sql.NullString
+}
+
+func (q *Queries) MarkCapsuleUploaded(ctx context.Context, arg MarkCapsuleUploadedParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, markCapsuleUploaded,
+		arg.ID,
+		arg.UserID,
+		arg.WrappedKey,
+		arg.S3key,
+		arg.EscrowedKey,
+		arg.Sha256,
+		arg.ObjectSha256,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const markUnlockNotified = `-- name: MarkUnlockNotified :exec
+UPDATE capsule
+SET unlock_notified_at = now()
+WHERE id = $1
+`
+
+func (q *Queries) MarkUnlockNotified(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, markUnlockNotified, id)
+	return err
+}
+
+const notifyCapsuleScheduled = `-- name: NotifyCapsuleScheduled :exec
+SELECT pg_notify('capsule_scheduled', $1::text)
+`
+
+func (q *Queries) NotifyCapsuleScheduled(ctx context.Context, capsuleID string) error {
+	_, err := q.db.ExecContext(ctx, notifyCapsuleScheduled, capsuleID)
+	return err
+}
+
+const recordCapsuleVerification = `-- name: RecordCapsuleVerification :exec
+UPDATE capsule
+SET
+    last_verified_at = $2,
+    integrity_status = $3
+WHERE id = $1
+`
+
+type RecordCapsuleVerificationParams struct {
+	ID              uuid.UUID
+	LastVerifiedAt  sql.NullTime
+	IntegrityStatus string
+}
+
+func (q *Queries) RecordCapsuleVerification(ctx context.Context, arg RecordCapsuleVerificationParams) error {
+	_, err := q.db.ExecContext(ctx, recordCapsuleVerification, arg.ID, arg.LastVerifiedAt, arg.IntegrityStatus)
+	return err
+}
+
+const recordUnlockFailure = `-- name: RecordUnlockFailure :exec
+UPDATE capsule
+SET
+    unlock_attempts = unlock_attempts + 1,
+    next_unlock_attempt_at = $2
+WHERE id = $1
+`
+
+type RecordUnlockFailureParams struct {
+	ID                  uuid.UUID
+	NextUnlockAttemptAt sql.NullTime
+}
+
+func (q *Queries) RecordUnlockFailure(ctx context.Context, arg RecordUnlockFailureParams) error {
+	_, err := q.db.ExecContext(ctx, recordUnlockFailure, arg.ID, arg.NextUnlockAttemptAt)
+	return err
+}
+
+const releaseCapsuleKey = `-- name: ReleaseCapsuleKey :exec
+UPDATE capsule
+SET
+    wrapped_key = $2,
+    escrowed_key = NULL
+WHERE id = $1
+`
+
+type ReleaseCapsuleKeyParams struct {
+	ID         uuid.UUID
+	WrappedKey []byte
+}
+
+// Replaces a time-locked capsule's escrowed key with one the API can unwrap.
+func (q *Queries) ReleaseCapsuleKey(ctx context.Context, arg ReleaseCapsuleKeyParams) error {
+	_, err := q.db.ExecContext(ctx, releaseCapsuleKey, arg.ID, arg.WrappedKey)
+	return err
+}
+
+const setCapsuleStorageClass = `-- name: SetCapsuleStorageClass :exec
+UPDATE capsule
+SET storage_class = $2
+WHERE id = $1
+`
+
+type SetCapsuleStorageClassParams struct {
+	ID           uuid.UUID
+	StorageClass string
+}
+
+func (q *Queries) SetCapsuleStorageClass(ctx context.Context, arg SetCapsuleStorageClassParams) error {
+	_, err := q.db.ExecContext(ctx, setCapsuleStorageClass, arg.ID, arg.StorageClass)
 	return err
 }
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	CapsuleScheduledChannel = "capsule_scheduled"
+	OutboxPendingChannel    = "outbox_pending"
+)
+
+// Notifier delivers wake-ups for a Postgres NOTIFY channel. C receives a value
+// whenever a notification arrives, and also after the listener reconnects,
+// since notifications sent while it was down are lost. Bursts are coalesced
+// into a single wake-up.
+type Notifier struct {
+	C         <-chan struct{}
+	connected atomic.Bool
+}
+
+// Connected reports whether the listening connection is currently up. While
+// it is down, callers should fall back to polling.
+func (n *Notifier) Connected() bool {
+	return n.connected.Load()
+}
+
+// Listen subscribes to channel on a dedicated connection until ctx is done.
+func Listen(ctx context.Context, dbURL, channel string) (*Notifier, error) {
+	n := &Notifier{}
+	listener := pq.NewListener(dbURL, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+			n.connected.Store(true)
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			n.connected.Store(false)
+		}
+		if err != nil {
+			log.Printf("listener %s: %v", channel, err)
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	wake := make(chan struct{}, 1)
+	n.C = wake
+	go func() {
+		defer listener.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-listener.Notify:
+				// A nil notification means the connection was re-established.
+			}
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return n, nil
+}
@@ -12,36 +12,140 @@ import (
 	"github.com/google/uuid"
 )
 
+type AccountEmailSend struct {
+	UserID          uuid.UUID
+	Kind            string
+	LastSentAt      time.Time
+	WindowStartedAt time.Time
+	SentInWindow    int32
+}
+
 type Capsule struct {
+	ID                  uuid.UUID
+	UserID              uuid.UUID
+	Title               sql.NullString
+	CreatedAt           time.Time
+	S3key               string
+	UnlockAt            time.Time
+	IsUnlocked          sql.NullBool
+	UploadStatus        string
+	SizeBytes           sql.NullInt64
+	Sha256              sql.NullString
+	UploadID            sql.NullString
+	WrappedKey          []byte
+	EscrowedKey         []byte
+	ContentType         sql.NullString
+	LastVerifiedAt      sql.NullTime
+	IntegrityStatus     string
+	StorageClass        string
+	UnlockAttempts      int32
+	NextUnlockAttemptAt sql.NullTime
+	ObjectSha256        sql.NullString
+	UnlockNotifiedAt    sql.NullTime
+	UnlockNotifyAfter   sql.NullTime
+}
+
+type EmailVerification struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+}
+
+type MfaChallenge struct {
 	ID         uuid.UUID
 	UserID     uuid.UUID
-	Title      sql.NullString
 	CreatedAt  time.Time
-	S3key      string
-	UnlockAt   time.Time
-	IsUnlocked sql.NullBool
+	ExpiresAt  time.Time
+	Attempts   int32
+	UsedAt     sql.NullTime
+	DeviceName sql.NullString
 }
 
 type Outbox struct {
+	ID             uuid.UUID
+	Payload        json.RawMessage
+	Status         sql.NullString
+	CreatedAt      time.Time
+	ClaimedBy      sql.NullString
+	LeaseExpiresAt sql.NullTime
+	Attempts       int32
+	LastError      sql.NullString
+	NextAttemptAt  sql.NullTime
+}
+
+type PasswordReset struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+}
+
+type RecoveryCode struct {
 	ID        uuid.UUID
-	Payload   json.RawMessage
-	Status    sql.NullString
+	UserID    uuid.UUID
+	CodeHash  string
 	CreatedAt time.Time
+	UsedAt    sql.NullTime
 }
 
 type RefreshToken struct {
-	Token     string
+	TokenHash string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	UserID    uuid.UUID
 	ExpiresAt time.Time
 	RevokedAt sql.NullTime
+	FamilyID  uuid.UUID
+}
+
+type Session struct {
+	ID         uuid.UUID
+	UserID     uuid.UUID
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  sql.NullTime
+	DeviceName sql.NullString
+	UserAgent  sql.NullString
+	Ip         sql.NullString
+}
+
+type Upload struct {
+	ID           uuid.UUID
+	UserID       uuid.UUID
+	CapsuleID    uuid.UUID
+	S3key        string
+	S3UploadID   string
+	UploadLength int64
+	UploadOffset int64
+	TailSize     int64
+	Parts        json.RawMessage
+	Title        sql.NullString
+	UnlockAt     time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	CompletedAt  sql.NullTime
 }
 
 type User struct {
-	ID             uuid.UUID
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	Email          string
-	HashedPassword string
+	ID              uuid.UUID
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	Email           string
+	HashedPassword  string
+	EmailVerifiedAt sql.NullTime
+}
+
+type UserTotp struct {
+	UserID                 uuid.UUID
+	WrappedSecret          []byte
+	CreatedAt              time.Time
+	ConfirmedAt            sql.NullTime
+	LastUsedStep           sql.NullInt64
+	DisableAttempts        int32
+	DisableWindowStartedAt sql.NullTime
 }
@@ -14,10 +14,69 @@ import (
 	"github.com/google/uuid"
 )
 
+const claimOutboxEvents = `-- name: ClaimOutboxEvents :many
+UPDATE outbox
+SET
+    claimed_by = $1::text,
+    lease_expires_at = now() + $2::int * interval '1 second'
+WHERE id IN (
+    SELECT id FROM outbox
+    WHERE status = 'pending'
+      AND (lease_expires_at IS NULL OR lease_expires_at < now())
+      AND (next_attempt_at IS NULL OR next_attempt_at <= now())
+    ORDER BY created_at ASC
+    LIMIT $3::int
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING id, payload, status, created_at, claimed_by, lease_expires_at, attempts, last_error, next_attempt_at
+`
+
+type ClaimOutboxEventsParams struct {
+	WorkerID     string
+	LeaseSeconds int32
+	BatchSize    int32
+}
+
+// Leases a batch of pending events to one worker. Rows locked by another
+// transaction are skipped, and rows whose lease has expired (a crashed
+// worker) become claimable again.
+func (q *Queries) ClaimOutboxEvents(ctx context.Context, arg ClaimOutboxEventsParams) ([]Outbox, error) {
+	rows, err := q.db.QueryContext(ctx, claimOutboxEvents, arg.WorkerID, arg.LeaseSeconds, arg.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Outbox
+	for rows.Next() {
+		var i Outbox
+		if err := rows.Scan(
+			&i.ID,
+			&i.Payload,
+			&i.Status,
+			&i.CreatedAt,
+			&i.ClaimedBy,
+			&i.LeaseExpiresAt,
+			&i.Attempts,
+			&i.LastError,
+			&i.NextAttemptAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const createOutboxEvent = `-- name: CreateOutboxEvent :one
 INSERT INTO outbox (id, payload, status, created_at)
 VALUES ($1, $2, $3, $4)
-RETURNING id, payload, status, created_at
+RETURNING id, payload, status, created_at, claimed_by, lease_expires_at, attempts, last_error, next_attempt_at
 `
 
 type CreateOutboxEventParams struct {
@@ -40,12 +99,17 @@ func (q *Queries) CreateOutboxEvent(ctx context.Context, arg CreateOutboxEventPa
 		&i.Payload,
 		&i.Status,
 		&i.CreatedAt,
+		&i.ClaimedBy,
+		&i.LeaseExpiresAt,
+		&i.Attempts,
+		&i.LastError,
+		&i.NextAttemptAt,
 	)
 	return i, err
 }
 
 const getPendingOutboxEvents = `-- name: GetPendingOutboxEvents :many
-SELECT id, payload, status, created_at FROM outbox
+SELECT id, payload, status, created_at, claimed_by, lease_expires_at, attempts, last_error, next_attempt_at FROM outbox
 WHERE status = 'pending'
 ORDER BY created_at ASC
 LIMIT $1
@@ -65,6 +129,11 @@ func (q *Queries) GetPendingOutboxEvents(ctx context.Context, limit int32) ([]Ou
 			&i.Payload,
 			&i.Status,
 			&i.CreatedAt,
+			&i.ClaimedBy,
+			&i.LeaseExpiresAt,
+			&i.Attempts,
+			&i.LastError,
+			&i.NextAttemptAt,
 		); err != nil {
 			return nil, err
 		}
@@ -79,6 +148,107 @@ func (q *Queries) GetPendingOutboxEvents(ctx context.Context, limit int32) ([]Ou
 	return items, nil
 }
 
+const listDeadOutboxEvents = `-- name: ListDeadOutboxEvents :many
+SELECT id, payload, status, created_at, claimed_by, lease_expires_at, attempts, last_error, next_attempt_at FROM outbox
+WHERE status = 'dead'
+ORDER BY created_at ASC
+LIMIT $1
+`
+
+func (q *Queries) ListDeadOutboxEvents(ctx context.Context, limit int32) ([]Outbox, error) {
+	rows, err := q.db.QueryContext(ctx, listDeadOutboxEvents, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Outbox
+	for rows.Next() {
+		var i Outbox
+		if err := rows.Scan(
+			&i.ID,
+			&i.Payload,
+			&i.Status,
+			&i.CreatedAt,
+			&i.ClaimedBy,
+			&i.LeaseExpiresAt,
+			&i.Attempts,
+			&i.LastError,
+			&i.NextAttemptAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const markOutboxEventFailed = `-- name: MarkOutboxEventFailed :exec
+UPDATE outbox
+SET
+    attempts = attempts + 1,
+    last_error = $2,
+    next_attempt_at = $3,
+    status = $4,
+    claimed_by = NULL,
+    lease_expires_at = NULL
+WHERE id = $1
+`
+
+type MarkOutboxEventFailedParams struct {
+	ID            uuid.UUID
+	LastError     sql.NullString
+	NextAttemptAt sql.NullTime
+	Status        sql.NullString
+}
+
+// Records a failed publish attempt and releases the lease. The caller decides
+// whether the event goes back to 'pending' or becomes 'dead'.
+func (q *Queries) MarkOutboxEventFailed(ctx context.Context, arg MarkOutboxEventFailedParams) error {
+	_, err := q.db.ExecContext(ctx, markOutboxEventFailed,
+		arg.ID,
+		arg.LastError,
+		arg.NextAttemptAt,
+		arg.Status,
+	)
+	return err
+}
+
+const notifyOutboxPending = `-- name: NotifyOutboxPending :exec
+SELECT pg_notify('outbox_pending', $1::text)
+`
+
+func (q *Queries) NotifyOutboxPending(ctx context.Context, eventID string) error {
+	_, err := q.db.ExecContext(ctx, notifyOutboxPending, eventID)
+	return err
+}
+
+const redriveOutboxEvent = `-- name: RedriveOutboxEvent :execrows
+UPDATE outbox
+SET
+    status = 'pending',
+    attempts = 0,
+    last_error = NULL,
+    next_attempt_at = NULL,
+    claimed_by = NULL,
+    lease_expires_at = NULL
+WHERE id = $1
+  AND status = 'dead'
+`
+
+func (q *Queries) RedriveOutboxEvent(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, redriveOutboxEvent, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const updateOutboxStatus = `-- name: UpdateOutboxStatus :exec
 UPDATE outbox
 SET status = $2
@@ -6,23 +6,133 @@ package database
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type Querier interface {
+	// Counts an account email that is about to be sent, unless one of its kind
+	// went out after resend_after or the user has had max_sends of them in a
+	// window that started after window_start. A window that started before
+	// window_start is over, and the email starts a new one.
+	ClaimAccountEmail(ctx context.Context, arg ClaimAccountEmailParams) (int64, error)
+	// Uses up one attempt at the challenge, if it has any left.
+	ClaimMFAChallengeAttempt(ctx context.Context, arg ClaimMFAChallengeAttemptParams) (MfaChallenge, error)
+	// Leases a batch of pending events to one worker. Rows locked by another
+	// transaction are skipped, and rows whose lease has expired (a crashed
+	// worker) become claimable again.
+	ClaimOutboxEvents(ctx context.Context, arg ClaimOutboxEventsParams) ([]Outbox, error)
+	// Uses up one of the user's attempts at turning TOTP off, if they have any
+	// left. A window that started before window_start is over, and the attempt
+	// starts a new one at now.
+	ClaimTOTPDisableAttempt(ctx context.Context, arg ClaimTOTPDisableAttemptParams) (int64, error)
+	// Leases the unlock email of an open capsule to the caller, unless it has
+	// gone out or another worker holds the lease. A lease that has run out (a
+	// crashed worker or a failed send) can be claimed again.
+	ClaimUnlockNotification(ctx context.Context, arg ClaimUnlockNotificationParams) (int64, error)
+	ConfirmUserTOTP(ctx context.Context, arg ConfirmUserTOTPParams) (int64, error)
 	CreateCapsule(ctx context.Context, arg CreateCapsuleParams) (Capsule, error)
+	CreateEmailVerification(ctx context.Context, arg CreateEmailVerificationParams) (EmailVerification, error)
+	CreateMFAChallenge(ctx context.Context, arg CreateMFAChallengeParams) (MfaChallenge, error)
 	CreateOutboxEvent(ctx context.Context, arg CreateOutboxEventParams) (Outbox, error)
+	CreatePasswordReset(ctx context.Context, arg CreatePasswordResetParams) (PasswordReset, error)
+	CreateRecoveryCode(ctx context.Context, arg CreateRecoveryCodeParams) error
 	CreateRefreshToken(ctx context.Context, arg CreateRefreshTokenParams) (RefreshToken, error)
+	CreateSession(ctx context.Context, arg CreateSessionParams) (Session, error)
+	CreateUpload(ctx context.Context, arg CreateUploadParams) (Upload, error)
 	CreateUser(ctx context.Context, arg CreateUserParams) (User, error)
-	GetCapsuleForUnlock(ctx context.Context, id uuid.UUID) (GetCapsuleForUnlockRow, error)
+	// Drops a direct upload that failed verification or was abandoned. No rows
+	// means it was finalized in the meantime.
+	DeletePendingCapsule(ctx context.Context, arg DeletePendingCapsuleParams) (int64, error)
+	DeleteRecoveryCodes(ctx context.Context, userID uuid.UUID) error
+	DeleteUpload(ctx context.Context, id uuid.UUID) error
+	DeleteUserTOTP(ctx context.Context, userID uuid.UUID) error
+	// Voids every outstanding reset once the password has changed.
+	ExpireUserPasswordResets(ctx context.Context, userID uuid.UUID) error
+	GetAccountEmailSends(ctx context.Context, arg GetAccountEmailSendsParams) (AccountEmailSend, error)
+	GetCapsuleByIDForUser(ctx context.Context, arg GetCapsuleByIDForUserParams) (Capsule, error)
+	GetCapsuleForUnlock(ctx context.Context, id uuid.UUID) (Capsule, error)
 	GetCapsulesByUserID(ctx context.Context, userID uuid.UUID) ([]Capsule, error)
+	// When the scheduler next has work: the earliest unlock_at, or retry time for
+	// capsules that are backing off. Each half is the first entry of an index.
+	GetNextUnlockAt(ctx context.Context) (time.Time, error)
+	GetOverdueCapsuleIDs(ctx context.Context, arg GetOverdueCapsuleIDsParams) ([]uuid.UUID, error)
 	GetPendingOutboxEvents(ctx context.Context, limit int32) ([]Outbox, error)
+	GetRefreshToken(ctx context.Context, tokenHash string) (RefreshToken, error)
+	GetSession(ctx context.Context, id uuid.UUID) (Session, error)
+	GetUploadForUser(ctx context.Context, arg GetUploadForUserParams) (Upload, error)
 	GetUserByEmail(ctx context.Context, email string) (User, error)
-	GetUserByRefreshToken(ctx context.Context, token string) (User, error)
-	MarkAsUnlocked(ctx context.Context, id uuid.UUID) error
-	RevokeRefreshToken(ctx context.Context, token string) error
+	GetUserByID(ctx context.Context, id uuid.UUID) (User, error)
+	GetUserTOTP(ctx context.Context, userID uuid.UUID) (UserTotp, error)
+	ListActiveSessions(ctx context.Context, userID uuid.UUID) ([]Session, error)
+	// Pages through sealed capsules by id: those that haven't opened yet, and
+	// opened ones whose object still has to come back to STANDARD.
+	ListCapsulesForTiering(ctx context.Context, arg ListCapsulesForTieringParams) ([]Capsule, error)
+	// Pages through sealed capsules by id for the scrubber, skipping those that
+	// were verified since $2.
+	ListCapsulesToVerify(ctx context.Context, arg ListCapsulesToVerifyParams) ([]Capsule, error)
+	ListDeadOutboxEvents(ctx context.Context, limit int32) ([]Outbox, error)
+	// Due capsules for the broker-less scheduler, leaving out those backing off
+	// after a failed unlock and those another worker is unlocking right now.
+	ListDueCapsules(ctx context.Context, limit int32) ([]ListDueCapsulesRow, error)
+	// Direct uploads started before $1 that were never finalized, oldest first.
+	ListExpiredPendingCapsules(ctx context.Context, arg ListExpiredPendingCapsulesParams) ([]Capsule, error)
+	// Every object key a user's rows still point to, including capsules and tus
+	// uploads that are still in progress. Direct uploads started before $2 are
+	// left out: they're abandoned and only wait for the worker to expire them.
+	ListStorageKeysForUser(ctx context.Context, arg ListStorageKeysForUserParams) ([]string, error)
+	ListUserIDs(ctx context.Context) ([]uuid.UUID, error)
+	// Locks a capsule that hasn't opened yet. A row another worker is already
+	// unlocking is skipped, so no row means there is nothing left to do.
+	// Open capsules whose owner hasn't been emailed yet and that no worker holds
+	// a lease on.
+	ListUnannouncedCapsuleIDs(ctx context.Context, limit int32) ([]uuid.UUID, error)
+	LockCapsuleForUnlock(ctx context.Context, id uuid.UUID) (Capsule, error)
+	// Locks an upload for the request writing to it. A row another request is
+	// already writing to is skipped, so no row means the upload is busy or gone.
+	LockUploadForUser(ctx context.Context, arg LockUploadForUserParams) (Upload, error)
+	MarkAsUnlocked(ctx context.Context, id uuid.UUID) (int64, error)
+	MarkCapsuleUploaded(ctx context.Context, arg MarkCapsuleUploadedParams) (int64, error)
+	MarkEmailVerified(ctx context.Context, arg MarkEmailVerifiedParams) (int64, error)
+	// Records a failed publish attempt and releases the lease. The caller decides
+	// whether the event goes back to 'pending' or becomes 'dead'.
+	MarkOutboxEventFailed(ctx context.Context, arg MarkOutboxEventFailedParams) error
+	MarkUnlockNotified(ctx context.Context, id uuid.UUID) error
+	MarkUploadCompleted(ctx context.Context, id uuid.UUID) (int64, error)
+	NotifyCapsuleScheduled(ctx context.Context, capsuleID string) error
+	NotifyOutboxPending(ctx context.Context, eventID string) error
+	RecordCapsuleVerification(ctx context.Context, arg RecordCapsuleVerificationParams) error
+	RecordUnlockFailure(ctx context.Context, arg RecordUnlockFailureParams) error
+	RedriveOutboxEvent(ctx context.Context, id uuid.UUID) (int64, error)
+	// Replaces a time-locked capsule's escrowed key with one the API can unwrap.
+	ReleaseCapsuleKey(ctx context.Context, arg ReleaseCapsuleKeyParams) error
+	RevokeRefreshToken(ctx context.Context, tokenHash string) error
+	RevokeRefreshTokenFamily(ctx context.Context, familyID uuid.UUID) error
+	RevokeSession(ctx context.Context, arg RevokeSessionParams) (int64, error)
+	RevokeUserRefreshTokens(ctx context.Context, userID uuid.UUID) error
+	RevokeUserSessions(ctx context.Context, userID uuid.UUID) error
+	SetCapsuleStorageClass(ctx context.Context, arg SetCapsuleStorageClassParams) error
+	// Records a refresh: the session now lasts as long as its newest token.
+	TouchSession(ctx context.Context, arg TouchSessionParams) error
 	UpdateOutboxStatus(ctx context.Context, arg UpdateOutboxStatusParams) error
+	// Guarded by the offset the caller started from, so two overlapping PATCH
+	// requests can't both record progress.
+	UpdateUploadProgress(ctx context.Context, arg UpdateUploadProgressParams) (int64, error)
+	UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) error
+	// Starts enrollment, replacing an unconfirmed key. A confirmed key is left
+	// alone and no rows are affected.
+	UpsertUserTOTP(ctx context.Context, arg UpsertUserTOTPParams) (int64, error)
+	// Consumes an outstanding verification, returning the address it confirms.
+	UseEmailVerification(ctx context.Context, arg UseEmailVerificationParams) (EmailVerification, error)
+	UseMFAChallenge(ctx context.Context, arg UseMFAChallengeParams) (int64, error)
+	UsePasswordReset(ctx context.Context, arg UsePasswordResetParams) (PasswordReset, error)
+	UseRecoveryCode(ctx context.Context, arg UseRecoveryCodeParams) (int64, error)
+	// Revokes a valid token as it is exchanged for its successor. No row means
+	// the token is unknown, expired or was already used.
+	UseRefreshToken(ctx context.Context, tokenHash string) (RefreshToken, error)
+	// Accepts a code's time step only if it's later than the last one used.
+	UseTOTPStep(ctx context.Context, arg UseTOTPStepParams) (int64, error)
 }
 
 var _ Querier = (*Queries)(nil)
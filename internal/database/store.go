@@ -3,16 +3,61 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/mnhsh/time-capsule/internal/events"
+)
+
+const (
+	OutboxStatusPending   = "pending"
+	OutboxStatusPublished = "published"
+	OutboxStatusDead      = "dead"
+
+	UploadStatusPending  = "pending_upload"
+	UploadStatusComplete = "complete"
+
+	IntegrityStatusUnverified = "unverified"
+	IntegrityStatusOK         = "ok"
+	IntegrityStatusCorrupted  = "corrupted"
+	IntegrityStatusMissing    = "missing"
+
+	// Kinds of account email, each rate-limited on its own.
+	AccountEmailVerification  = "email_verification"
+	AccountEmailPasswordReset = "password_reset"
+)
+
+var (
+	ErrNoPendingUpload = errors.New("no pending upload for capsule")
+	// ErrUploadCompleted means a tus upload already has its capsule.
+	ErrUploadCompleted = errors.New("upload is already complete")
+	// ErrUploadBusy means another request is writing to a tus upload.
+	ErrUploadBusy = errors.New("upload is being written by another request")
+	// ErrRefreshTokenReused means a refresh token was presented after it had
+	// already been exchanged, so it has probably been stolen.
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
 )
 
 // Store provides all functions to execute db queries and transactions
 type Store interface {
 	Querier // This is the interface sqlc generated for you
 	CreateCapsuleWithOutbox(ctx context.Context, arg CreateCapsuleParams) error
+	UnlockCapsule(ctx context.Context, id uuid.UUID, fn func(Querier, Capsule) error) (bool, error)
+	FinalizeCapsuleUpload(ctx context.Context, arg MarkCapsuleUploadedParams) error
+	CompleteUpload(ctx context.Context, uploadID uuid.UUID, capParams CreateCapsuleParams) error
+	WriteUpload(ctx context.Context, id, userID uuid.UUID, fn func(Querier, Upload) error) error
+	RotateRefreshToken(ctx context.Context, oldHash string, next CreateRefreshTokenParams) (RefreshToken, error)
+	StartSession(ctx context.Context, session CreateSessionParams, token CreateRefreshTokenParams) (Session, error)
+	EndSession(ctx context.Context, userID, sessionID uuid.UUID) error
+	EndAllSessions(ctx context.Context, userID uuid.UUID) error
+	VerifyEmail(ctx context.Context, userID, verificationID uuid.UUID) error
+	ResetPassword(ctx context.Context, userID, resetID uuid.UUID, hashedPassword string) error
+	ChangePassword(ctx context.Context, userID uuid.UUID, hashedPassword string) error
+	ConfirmTOTP(ctx context.Context, userID uuid.UUID, step int64, recoveryCodeHashes []string) error
+	DisableTOTP(ctx context.Context, userID uuid.UUID) error
 }
 
 // SQLStore provides all functions to execute SQL queries and transactions
@@ -56,17 +101,351 @@ func (s *SQLStore) CreateCapsuleWithOutbox(ctx context.Context, capParams Create
 			return fmt.Errorf("failed to create capsule: %w", err)
 		}
 
-		// 2. Create the Outbox Event (The "To-Do" note for RabbitMQ)
-		_, err = q.CreateOutboxEvent(ctx, CreateOutboxEventParams{
-			ID:        uuid.New(),
-			Payload:   []byte(capParams.ID.String()), // We only need the ID to unlock it
-			Status:    sql.NullString{String: "pending", Valid: true},
-			CreatedAt: time.Now().UTC(),
+		// 2. Schedule its unlock
+		return scheduleCapsule(ctx, q, capParams.ID, capParams.UserID, capParams.UnlockAt)
+	})
+}
+
+// FinalizeCapsuleUpload moves a pending_upload capsule to complete, points it
+// at its encrypted object and data key, and schedules its unlock. It returns
+// ErrNoPendingUpload if the user has no pending capsule with that id.
+func (s *SQLStore) FinalizeCapsuleUpload(ctx context.Context, arg MarkCapsuleUploadedParams) error {
+	return s.execTx(ctx, func(q *Queries) error {
+		n, err := q.MarkCapsuleUploaded(ctx, arg)
+		if err != nil {
+			return fmt.Errorf("failed to mark capsule uploaded: %w", err)
+		}
+		if n == 0 {
+			return ErrNoPendingUpload
+		}
+
+		c, err := q.GetCapsuleForUnlock(ctx, arg.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get capsule: %w", err)
+		}
+		return scheduleCapsule(ctx, q, c.ID, c.UserID, c.UnlockAt)
+	})
+}
+
+// CompleteUpload marks a tus upload completed and creates its capsule in one
+// transaction, so a retried final PATCH finds either both or neither. It
+// returns ErrUploadCompleted if the upload was already completed.
+func (s *SQLStore) CompleteUpload(ctx context.Context, uploadID uuid.UUID, capParams CreateCapsuleParams) error {
+	return s.execTx(ctx, func(q *Queries) error {
+		n, err := q.MarkUploadCompleted(ctx, uploadID)
+		if err != nil {
+			return fmt.Errorf("failed to mark upload completed: %w", err)
+		}
+		if n == 0 {
+			return ErrUploadCompleted
+		}
+
+		if _, err := q.CreateCapsule(ctx, capParams); err != nil {
+			return fmt.Errorf("failed to create capsule: %w", err)
+		}
+		return scheduleCapsule(ctx, q, capParams.ID, capParams.UserID, capParams.UnlockAt)
+	})
+}
+
+// WriteUpload locks the user's tus upload for as long as fn runs, so
+// overlapping PATCH requests can't store the same parts or overwrite each
+// other's tail, and commits whatever progress fn records through q. It
+// returns ErrUploadBusy without calling fn when another request holds the
+// upload or it no longer exists.
+func (s *SQLStore) WriteUpload(ctx context.Context, id, userID uuid.UUID, fn func(Querier, Upload) error) error {
+	return s.execTx(ctx, func(q *Queries) error {
+		u, err := q.LockUploadForUser(ctx, LockUploadForUserParams{ID: id, UserID: userID})
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUploadBusy
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lock upload: %w", err)
+		}
+		return fn(q, u)
+	})
+}
+
+// RotateRefreshToken exchanges the refresh token with hash oldHash for next,
+// which joins the old token's family and belongs to the same user; the
+// family and user fields of next are filled in. It returns sql.ErrNoRows for
+// an unknown or expired token. Presenting a token that was already exchanged
+// revokes its whole family and returns ErrRefreshTokenReused: either the
+// legitimate client or an attacker holds a stolen token, and neither can be
+// told apart from the other.
+func (s *SQLStore) RotateRefreshToken(ctx context.Context, oldHash string, next CreateRefreshTokenParams) (RefreshToken, error) {
+	var (
+		issued RefreshToken
+		reused bool
+	)
+	err := s.execTx(ctx, func(q *Queries) error {
+		old, err := q.UseRefreshToken(ctx, oldHash)
+		if errors.Is(err, sql.ErrNoRows) {
+			old, err = q.GetRefreshToken(ctx, oldHash)
+			if err != nil {
+				return err
+			}
+			if !old.RevokedAt.Valid {
+				// Expired.
+				return sql.ErrNoRows
+			}
+			// Committed with the transaction; the error is reported after.
+			reused = true
+			return endSession(ctx, q, old.UserID, old.FamilyID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to use refresh token: %w", err)
+		}
+
+		next.UserID = old.UserID
+		next.FamilyID = old.FamilyID
+		issued, err = q.CreateRefreshToken(ctx, next)
+		if err != nil {
+			return fmt.Errorf("failed to create refresh token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if reused {
+		return RefreshToken{}, ErrRefreshTokenReused
+	}
+	return issued, nil
+}
+
+// StartSession records a login and issues its first refresh token, which
+// starts the session's token family.
+func (s *SQLStore) StartSession(ctx context.Context, session CreateSessionParams, token CreateRefreshTokenParams) (Session, error) {
+	var created Session
+	err := s.execTx(ctx, func(q *Queries) error {
+		var err error
+		created, err = q.CreateSession(ctx, session)
+		if err != nil {
+			return fmt.Errorf("failed to create session: %w", err)
+		}
+		token.UserID = session.UserID
+		token.FamilyID = session.ID
+		if _, err := q.CreateRefreshToken(ctx, token); err != nil {
+			return fmt.Errorf("failed to create refresh token: %w", err)
+		}
+		return nil
+	})
+	return created, err
+}
+
+// EndSession revokes one of the user's sessions and its refresh tokens. It
+// returns sql.ErrNoRows if the user has no active session with that id.
+func (s *SQLStore) EndSession(ctx context.Context, userID, sessionID uuid.UUID) error {
+	return s.execTx(ctx, func(q *Queries) error {
+		n, err := q.RevokeSession(ctx, RevokeSessionParams{ID: sessionID, UserID: userID})
+		if err != nil {
+			return fmt.Errorf("failed to revoke session: %w", err)
+		}
+		if n == 0 {
+			return sql.ErrNoRows
+		}
+		return q.RevokeRefreshTokenFamily(ctx, sessionID)
+	})
+}
+
+// EndAllSessions signs the user out everywhere.
+func (s *SQLStore) EndAllSessions(ctx context.Context, userID uuid.UUID) error {
+	return s.execTx(ctx, func(q *Queries) error {
+		if err := q.RevokeUserSessions(ctx, userID); err != nil {
+			return fmt.Errorf("failed to revoke sessions: %w", err)
+		}
+		return q.RevokeUserRefreshTokens(ctx, userID)
+	})
+}
+
+// VerifyEmail consumes a verification and marks the address it was sent to as
+// verified. It returns sql.ErrNoRows if the verification has already been
+// used, has expired, or was sent to an address the user no longer has.
+func (s *SQLStore) VerifyEmail(ctx context.Context, userID, verificationID uuid.UUID) error {
+	return s.execTx(ctx, func(q *Queries) error {
+		v, err := q.UseEmailVerification(ctx, UseEmailVerificationParams{ID: verificationID, UserID: userID})
+		if err != nil {
+			return err
+		}
+		n, err := q.MarkEmailVerified(ctx, MarkEmailVerifiedParams{ID: userID, Email: v.Email})
+		if err != nil {
+			return fmt.Errorf("failed to mark email verified: %w", err)
+		}
+		if n == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+// ResetPassword consumes a password reset and sets the new password. It
+// returns sql.ErrNoRows if the reset has already been used or has expired.
+func (s *SQLStore) ResetPassword(ctx context.Context, userID, resetID uuid.UUID, hashedPassword string) error {
+	return s.execTx(ctx, func(q *Queries) error {
+		if _, err := q.UsePasswordReset(ctx, UsePasswordResetParams{ID: resetID, UserID: userID}); err != nil {
+			return err
+		}
+		return setPassword(ctx, q, userID, hashedPassword)
+	})
+}
+
+// ChangePassword sets a new password for a signed-in user.
+func (s *SQLStore) ChangePassword(ctx context.Context, userID uuid.UUID, hashedPassword string) error {
+	return s.execTx(ctx, func(q *Queries) error {
+		return setPassword(ctx, q, userID, hashedPassword)
+	})
+}
+
+// setPassword replaces the user's password and signs them out everywhere:
+// whoever knew the old password may hold a session.
+func setPassword(ctx context.Context, q *Queries, userID uuid.UUID, hashedPassword string) error {
+	err := q.UpdateUserPassword(ctx, UpdateUserPasswordParams{ID: userID, HashedPassword: hashedPassword})
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if err := q.ExpireUserPasswordResets(ctx, userID); err != nil {
+		return fmt.Errorf("failed to expire password resets: %w", err)
+	}
+	if err := q.RevokeUserSessions(ctx, userID); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	if err := q.RevokeUserRefreshTokens(ctx, userID); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return nil
+}
+
+// ConfirmTOTP turns on two-factor login for a user whose enrollment code
+// checked out, and replaces their recovery codes. It returns sql.ErrNoRows if
+// there is no enrollment waiting to be confirmed.
+func (s *SQLStore) ConfirmTOTP(ctx context.Context, userID uuid.UUID, step int64, recoveryCodeHashes []string) error {
+	return s.execTx(ctx, func(q *Queries) error {
+		n, err := q.ConfirmUserTOTP(ctx, ConfirmUserTOTPParams{
+			UserID:       userID,
+			LastUsedStep: sql.NullInt64{Int64: step, Valid: true},
 		})
 		if err != nil {
-			return fmt.Errorf("failed to create outbox event: %w", err)
+			return fmt.Errorf("failed to confirm TOTP: %w", err)
+		}
+		if n == 0 {
+			return sql.ErrNoRows
+		}
+		if err := q.DeleteRecoveryCodes(ctx, userID); err != nil {
+			return fmt.Errorf("failed to delete recovery codes: %w", err)
+		}
+		for _, hash := range recoveryCodeHashes {
+			err := q.CreateRecoveryCode(ctx, CreateRecoveryCodeParams{
+				ID:       uuid.New(),
+				UserID:   userID,
+				CodeHash: hash,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create recovery code: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// DisableTOTP turns two-factor login off and drops the recovery codes.
+func (s *SQLStore) DisableTOTP(ctx context.Context, userID uuid.UUID) error {
+	return s.execTx(ctx, func(q *Queries) error {
+		if err := q.DeleteUserTOTP(ctx, userID); err != nil {
+			return fmt.Errorf("failed to delete TOTP key: %w", err)
 		}
+		return q.DeleteRecoveryCodes(ctx, userID)
+	})
+}
+
+func endSession(ctx context.Context, q *Queries, userID, sessionID uuid.UUID) error {
+	if _, err := q.RevokeSession(ctx, RevokeSessionParams{ID: sessionID, UserID: userID}); err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	return q.RevokeRefreshTokenFamily(ctx, sessionID)
+}
+
+// scheduleCapsule queues the unlock of a stored capsule.
+func scheduleCapsule(ctx context.Context, q *Queries, id, userID uuid.UUID, unlockAt time.Time) error {
+	// Wake any broker-less scheduler so it can recompute its next deadline
+	err := q.NotifyCapsuleScheduled(ctx, id.String())
+	if err != nil {
+		return fmt.Errorf("failed to notify scheduler: %w", err)
+	}
+
+	// Create the Outbox Event (The "To-Do" note for RabbitMQ)
+	return insertOutboxEvent(ctx, q, events.TypeCapsuleCreated, id, events.CapsuleCreated{
+		CapsuleID: id,
+		UserID:    userID,
+		UnlockAt:  unlockAt,
+	})
+}
 
+// UnlockCapsule locks the capsule, calls fn and marks it unlocked in one
+// transaction, so a capsule is only ever opened by one worker however many
+// unlock messages arrive for it. It returns false without calling fn when the
+// capsule is gone, already unlocked or being unlocked by another worker.
+func (s *SQLStore) UnlockCapsule(ctx context.Context, id uuid.UUID, fn func(Querier, Capsule) error) (bool, error) {
+	unlocked := false
+	err := s.execTx(ctx, func(q *Queries) error {
+		c, err := q.LockCapsuleForUnlock(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lock capsule: %w", err)
+		}
+		if err := fn(q, c); err != nil {
+			return err
+		}
+		if err := markUnlocked(ctx, q, id); err != nil {
+			return err
+		}
+		unlocked = true
 		return nil
 	})
+	return unlocked, err
+}
+
+// markUnlocked flips is_unlocked on a capsule the caller has locked. The
+// update is conditional as well, so a capsule can't be opened twice even by a
+// caller that forgot the lock.
+func markUnlocked(ctx context.Context, q *Queries, id uuid.UUID) error {
+	n, err := q.MarkAsUnlocked(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to mark capsule %s unlocked: %w", id, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("capsule %s was already unlocked", id)
+	}
+	return nil
+}
+
+// insertOutboxEvent wraps body in an events.Envelope and queues it in the
+// outbox. It must be called inside the transaction that made the change; the
+// NOTIFY it issues is only delivered to the relay once that transaction commits.
+func insertOutboxEvent(ctx context.Context, q *Queries, t events.Type, aggregateID uuid.UUID, body any) error {
+	env, err := events.New(ctx, t, aggregateID, body)
+	if err != nil {
+		return err
+	}
+	payload, err := events.Encode(env)
+	if err != nil {
+		return fmt.Errorf("failed to encode outbox payload: %w", err)
+	}
+
+	_, err = q.CreateOutboxEvent(ctx, CreateOutboxEventParams{
+		ID:        env.ID,
+		Payload:   payload,
+		Status:    sql.NullString{String: OutboxStatusPending, Valid: true},
+		CreatedAt: env.OccurredAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create outbox event: %w", err)
+	}
+
+	err = q.NotifyOutboxPending(ctx, env.ID.String())
+	if err != nil {
+		return fmt.Errorf("failed to notify outbox relay: %w", err)
+	}
+	return nil
 }
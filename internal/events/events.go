@@ -0,0 +1,94 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Type string
+
+const (
+	TypeCapsuleCreated Type = "capsule.created"
+)
+
+// SchemaVersion is the envelope version written by this build. Decode rejects
+// anything newer so an old worker never misreads an event it doesn't know.
+const SchemaVersion = 1
+
+// Envelope is the JSON document stored in outbox.payload.
+type Envelope struct {
+	ID            uuid.UUID       `json:"id"`
+	Type          Type            `json:"type"`
+	Version       int             `json:"version"`
+	AggregateID   uuid.UUID       `json:"aggregate_id"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	Body          json.RawMessage `json:"body"`
+}
+
+type CapsuleCreated struct {
+	CapsuleID uuid.UUID `json:"capsule_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	UnlockAt  time.Time `json:"unlock_at"`
+}
+
+// New wraps body in an envelope. The correlation id is taken from ctx.
+func New(ctx context.Context, t Type, aggregateID uuid.UUID, body any) (Envelope, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("couldn't encode %s body: %w", t, err)
+	}
+	return Envelope{
+		ID:            uuid.New(),
+		Type:          t,
+		Version:       SchemaVersion,
+		AggregateID:   aggregateID,
+		OccurredAt:    time.Now().UTC(),
+		CorrelationID: CorrelationID(ctx),
+		Body:          data,
+	}, nil
+}
+
+func Encode(e Envelope) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func Decode(data []byte) (Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Envelope{}, err
+	}
+	if e.Type == "" {
+		return Envelope{}, errors.New("event has no type")
+	}
+	if e.Version < 1 || e.Version > SchemaVersion {
+		return Envelope{}, fmt.Errorf("unsupported event version %d", e.Version)
+	}
+	return e, nil
+}
+
+// DecodeBody unmarshals the envelope body into v.
+func (e Envelope) DecodeBody(v any) error {
+	if err := json.Unmarshal(e.Body, v); err != nil {
+		return fmt.Errorf("couldn't decode %s body: %w", e.Type, err)
+	}
+	return nil
+}
+
+type contextKey string
+
+const correlationIDKey contextKey = "correlationID"
+
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey, id)
+}
+
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey).(string)
+	return id
+}
@@ -0,0 +1,66 @@
+package mail
+
+import (
+	"context"
+	"sync"
+)
+
+const DriverSMTP = "smtp"
+
+type Options struct {
+	Driver string
+	From   string
+
+	// SMTP
+	Host     string
+	Port     string
+	Username string
+	Password string
+
+	// Dir receives the messages of any other driver as .eml files.
+	Dir string
+}
+
+// New returns the mailer selected by opts.Driver. Anything other than "smtp"
+// writes messages to opts.Dir for local runs.
+func New(opts Options) (Mailer, error) {
+	if opts.Driver == DriverSMTP {
+		return NewSMTPMailer(opts.Host, opts.Port, opts.Username, opts.Password, opts.From), nil
+	}
+	return NewFileMailer(opts.Dir, opts.From)
+}
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends a single plain-text email.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// MemoryMailer keeps every message in memory. It is meant for tests.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns a copy of every message sent so far.
+func (m *MemoryMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.sent...)
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+)
+
+var ErrChecksumMismatch = errors.New("content doesn't match its recorded checksum")
+
+// Digest identifies a capsule's plaintext content, or the encrypted object it
+// is stored as.
+type Digest struct {
+	Size   int64
+	SHA256 string // hex
+}
+
+// DigestReader computes the Digest of everything read through it.
+type DigestReader struct {
+	r    io.Reader
+	h    hash.Hash
+	size int64
+}
+
+func NewDigestReader(r io.Reader) *DigestReader {
+	return &DigestReader{r: r, h: sha256.New()}
+}
+
+func (d *DigestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+// Digest is only complete once the underlying reader is exhausted.
+func (d *DigestReader) Digest() Digest {
+	return Digest{Size: d.size, SHA256: hex.EncodeToString(d.h.Sum(nil))}
+}
+
+// verifyingReader checks its content against an expected Digest. It holds
+// back the last byte it has read until the source is exhausted, so on a
+// mismatch the reader sees an error instead of complete, wrong content.
+type verifyingReader struct {
+	d       *DigestReader
+	want    Digest
+	pending byte
+	held    bool
+	done    bool
+	err     error
+}
+
+// VerifyingReader returns a reader that yields r unchanged but fails with
+// ErrChecksumMismatch, in place of io.EOF, if r doesn't match want.
+func VerifyingReader(r io.Reader, want Digest) io.Reader {
+	return &verifyingReader{d: NewDigestReader(r), want: want}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if v.done {
+		if v.held {
+			p[0] = v.pending
+			v.held = false
+			return 1, nil
+		}
+		return 0, v.err
+	}
+
+	n, err := v.d.Read(p)
+	out := n
+	if n > 0 {
+		// Pass on the byte held back last time and hold back the new last.
+		last := p[n-1]
+		if v.held {
+			copy(p[1:n], p[:n-1])
+			p[0] = v.pending
+		} else {
+			out = n - 1
+		}
+		v.pending = last
+		v.held = true
+	}
+
+	switch {
+	case err == io.EOF:
+		v.done = true
+		v.err = io.EOF
+		if v.d.Digest() != v.want {
+			v.held = false
+			v.err = ErrChecksumMismatch
+			return out, v.err
+		}
+		return out, nil
+	case err != nil:
+		v.done = true
+		v.held = false
+		v.err = err
+		return out, err
+	default:
+		return out, nil
+	}
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ChunkedUpload feeds a multipart upload with chunks of any size, as sent
+// by resumable upload clients. Bytes that don't yet fill a part are parked in
+// a temporary "<key>.tail" object until the next chunk arrives. The struct is
+// plain data so callers can persist it between requests.
+type ChunkedUpload struct {
+	Key      string
+	UploadID string
+	Parts    []Part
+	TailSize int64
+}
+
+func (u *ChunkedUpload) tailKey() string {
+	return u.Key + ".tail"
+}
+
+func StartChunkedUpload(ctx context.Context, s Backend, key, contentType string) (*ChunkedUpload, error) {
+	uploadID, err := s.CreateMultipartUpload(ctx, key, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkedUpload{Key: key, UploadID: uploadID}, nil
+}
+
+// AppendChunk reads body until EOF, uploading a part for every partSize bytes
+// and parking the remainder in the tail object. It returns how many bytes of
+// body were consumed; if body fails midway, everything read before the
+// failure is still kept and u reflects it, so the client can resume.
+func AppendChunk(ctx context.Context, s Backend, u *ChunkedUpload, body io.Reader, partSize int) (int64, error) {
+	if partSize < MinPartSize {
+		return 0, fmt.Errorf("part size %d is below the S3 minimum", partSize)
+	}
+
+	buf := make([]byte, partSize)
+	filled := 0
+	if u.TailSize > 0 {
+		obj, err := s.Get(ctx, u.tailKey())
+		if err != nil {
+			return 0, fmt.Errorf("couldn't read upload tail: %w", err)
+		}
+		filled, err = io.ReadFull(obj.Body, buf[:u.TailSize])
+		obj.Body.Close()
+		if err != nil {
+			return 0, fmt.Errorf("couldn't read upload tail: %w", err)
+		}
+	}
+	tailChanged := false
+
+	var written int64
+	var readErr error
+	for readErr == nil {
+		var n int
+		n, readErr = io.ReadFull(body, buf[filled:])
+		filled += n
+		written += int64(n)
+		if n > 0 {
+			tailChanged = true
+		}
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			readErr = io.EOF
+		}
+		if filled < partSize {
+			continue
+		}
+
+		number := int32(len(u.Parts) + 1)
+		part, err := s.UploadPart(ctx, u.Key, u.UploadID, number, bytes.NewReader(buf), int64(partSize))
+		if err != nil {
+			// The bytes of this part were read but not stored, so they don't count.
+			return written - int64(partSize) + u.TailSize, fmt.Errorf("couldn't upload part %d: %w", number, err)
+		}
+		u.Parts = append(u.Parts, part)
+		u.TailSize = 0
+		filled = 0
+	}
+
+	if tailChanged {
+		if filled > 0 {
+			if _, err := s.Put(ctx, u.tailKey(), "", bytes.NewReader(buf[:filled])); err != nil {
+				return written - int64(filled) + u.TailSize, fmt.Errorf("couldn't store upload tail: %w", err)
+			}
+		} else if err := s.Delete(ctx, u.tailKey()); err != nil {
+			return written, fmt.Errorf("couldn't remove upload tail: %w", err)
+		}
+		u.TailSize = int64(filled)
+	}
+
+	if errors.Is(readErr, io.EOF) {
+		return written, nil
+	}
+	return written, readErr
+}
+
+// FinishChunkedUpload uploads the tail as the final part and completes the
+// multipart upload.
+func FinishChunkedUpload(ctx context.Context, s Backend, u *ChunkedUpload) error {
+	if u.TailSize > 0 || len(u.Parts) == 0 {
+		var tail []byte
+		if u.TailSize > 0 {
+			obj, err := s.Get(ctx, u.tailKey())
+			if err != nil {
+				return fmt.Errorf("couldn't read upload tail: %w", err)
+			}
+			tail, err = io.ReadAll(obj.Body)
+			obj.Body.Close()
+			if err != nil {
+				return fmt.Errorf("couldn't read upload tail: %w", err)
+			}
+		}
+		number := int32(len(u.Parts) + 1)
+		part, err := s.UploadPart(ctx, u.Key, u.UploadID, number, bytes.NewReader(tail), int64(len(tail)))
+		if err != nil {
+			return fmt.Errorf("couldn't upload final part: %w", err)
+		}
+		u.Parts = append(u.Parts, part)
+	}
+
+	if err := s.CompleteMultipartUpload(ctx, u.Key, u.UploadID, u.Parts); err != nil {
+		return fmt.Errorf("couldn't complete multipart upload: %w", err)
+	}
+	if u.TailSize > 0 {
+		if err := s.Delete(ctx, u.tailKey()); err != nil {
+			return fmt.Errorf("couldn't remove upload tail: %w", err)
+		}
+		u.TailSize = 0
+	}
+	return nil
+}
+
+func AbortChunkedUpload(ctx context.Context, s Backend, u *ChunkedUpload) error {
+	err := s.AbortMultipartUpload(ctx, u.Key, u.UploadID)
+	if u.TailSize > 0 {
+		err = errors.Join(err, s.Delete(ctx, u.tailKey()))
+	}
+	return err
+}
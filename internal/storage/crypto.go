@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Capsule content is encrypted with AES-256-GCM in independent chunks so
+// objects of any size can be sealed and opened while streaming. The layout is
+//
+//	magic (4) | nonce prefix (7) | chunk 0 | chunk 1 | ... | final chunk
+//
+// Every chunk but the last holds encChunkSize bytes of plaintext plus the GCM
+// tag. Chunk nonces are the prefix, a big-endian chunk counter and a final
+// flag, so chunks can't be reordered, and truncating the object makes the
+// new last chunk fail authentication.
+
+const (
+	encMagic       = "TCE1"
+	encPrefixSize  = 7
+	encHeaderSize  = len(encMagic) + encPrefixSize
+	encChunkSize   = 64 << 10
+	encKeySize     = 32
+	encFinalChunk  = 1
+	encNormalChunk = 0
+)
+
+var ErrDecrypt = errors.New("encrypted content is corrupt or was tampered with")
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != encKeySize {
+		return nil, fmt.Errorf("data key must be %d bytes, got %d", encKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type chunkNonce [12]byte
+
+func (n *chunkNonce) set(counter uint32, final bool) {
+	binary.BigEndian.PutUint32(n[encPrefixSize:], counter)
+	n[11] = encNormalChunk
+	if final {
+		n[11] = encFinalChunk
+	}
+}
+
+type encryptReader struct {
+	src      io.Reader
+	aead     cipher.AEAD
+	nonce    chunkNonce
+	counter  uint32
+	plain    []byte
+	buffered int
+	sealed   []byte
+	out      []byte
+	done     bool
+}
+
+// EncryptReader returns a reader producing the encrypted form of r under key.
+// Errors from r are returned unchanged so callers can match them.
+func EncryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	e := &encryptReader{
+		src:  r,
+		aead: aead,
+		// One byte of lookahead tells whether a full chunk is the last one.
+		plain:  make([]byte, encChunkSize+1),
+		sealed: make([]byte, 0, encChunkSize+aead.Overhead()),
+	}
+	if _, err := rand.Read(e.nonce[:encPrefixSize]); err != nil {
+		return nil, err
+	}
+	e.out = append([]byte(encMagic), e.nonce[:encPrefixSize]...)
+	return e, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := readFull(e.src, e.plain[e.buffered:])
+		e.buffered += n
+		switch {
+		case err == nil:
+			if err := e.seal(e.plain[:encChunkSize], false); err != nil {
+				return 0, err
+			}
+			e.plain[0] = e.plain[encChunkSize]
+			e.buffered = 1
+		case err == io.EOF:
+			if err := e.seal(e.plain[:e.buffered], true); err != nil {
+				return 0, err
+			}
+			e.done = true
+		default:
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *encryptReader) seal(chunk []byte, final bool) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("content too large to encrypt")
+	}
+	e.nonce.set(e.counter, final)
+	e.counter++
+	e.out = e.aead.Seal(e.sealed[:0], e.nonce[:], chunk, nil)
+	return nil
+}
+
+type decryptReader struct {
+	src      io.Reader
+	aead     cipher.AEAD
+	nonce    chunkNonce
+	counter  uint32
+	sealed   []byte
+	buffered int
+	plain    []byte
+	out      []byte
+	done     bool
+}
+
+// DecryptReader returns a reader producing the plaintext of r, which must
+// have been written by EncryptReader with the same key. Reads fail with
+// ErrDecrypt if the content was modified or truncated.
+func DecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("couldn't read encryption header: %w", err)
+	}
+	if string(header[:len(encMagic)]) != encMagic {
+		return nil, ErrDecrypt
+	}
+	d := &decryptReader{
+		src:    r,
+		aead:   aead,
+		sealed: make([]byte, encChunkSize+aead.Overhead()+1),
+		plain:  make([]byte, 0, encChunkSize),
+	}
+	copy(d.nonce[:encPrefixSize], header[len(encMagic):])
+	return d, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		full := encChunkSize + d.aead.Overhead()
+		n, err := readFull(d.src, d.sealed[d.buffered:])
+		d.buffered += n
+		switch {
+		case err == nil:
+			if err := d.open(d.sealed[:full], false); err != nil {
+				return 0, err
+			}
+			d.sealed[0] = d.sealed[full]
+			d.buffered = 1
+		case err == io.EOF:
+			if err := d.open(d.sealed[:d.buffered], true); err != nil {
+				return 0, err
+			}
+			d.done = true
+		default:
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open(chunk []byte, final bool) error {
+	d.nonce.set(d.counter, final)
+	d.counter++
+	plain, err := d.aead.Open(d.plain[:0], d.nonce[:], chunk, nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.out = plain
+	return nil
+}
+
+// EncryptObject writes an encrypted copy of the plaintext object at src to
+// dst and returns the Digests of the plaintext and of the encrypted object.
+// It's for content that reached storage without passing through the API,
+// such as presigned and resumable uploads; the caller deletes src once
+// nothing refers to it anymore.
+func EncryptObject(ctx context.Context, b Backend, src, dst string, dataKey []byte) (plain, sealed Digest, err error) {
+	obj, err := b.Get(ctx, src)
+	if err != nil {
+		return Digest{}, Digest{}, err
+	}
+	defer obj.Body.Close()
+
+	plainDigest := NewDigestReader(obj.Body)
+	encrypted, err := EncryptReader(plainDigest, dataKey)
+	if err != nil {
+		return Digest{}, Digest{}, err
+	}
+	sealedDigest := NewDigestReader(encrypted)
+	if _, err := b.Put(ctx, dst, obj.ContentType, sealedDigest); err != nil {
+		return Digest{}, Digest{}, err
+	}
+	return plainDigest.Digest(), sealedDigest.Digest(), nil
+}
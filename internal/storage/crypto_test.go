@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestEncryptReaderRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	// Cover an exact chunk boundary as well as a short final chunk.
+	for _, size := range []int{0, 1, encChunkSize, 2*encChunkSize + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		enc, err := EncryptReader(bytes.NewReader(plain), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := io.ReadAll(enc)
+		if err != nil {
+			t.Fatalf("size %d: encrypt: %v", size, err)
+		}
+		dec, err := DecryptReader(bytes.NewReader(sealed), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(dec)
+		if err != nil {
+			t.Fatalf("size %d: decrypt: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: round trip changed the content", size)
+		}
+	}
+}
+
+func TestEncryptReaderFailsOnTruncatedSource(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	// A multipart part cut off mid-body reads as some data followed by
+	// io.ErrUnexpectedEOF. That must not be sealed as a complete object.
+	src := io.MultiReader(bytes.NewReader(make([]byte, 100)), iotest.ErrReader(io.ErrUnexpectedEOF))
+
+	enc, err := EncryptReader(src, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(enc); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("err = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestDecryptReaderRejectsTruncatedObject(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	enc, err := EncryptReader(bytes.NewReader(make([]byte, encChunkSize+10)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := DecryptReader(bytes.NewReader(sealed[:len(sealed)-5]), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(dec); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("err = %v, want ErrDecrypt", err)
+	}
+}
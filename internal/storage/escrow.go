@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Time-locked capsules seal their data key to an X25519 escrow key instead of
+// wrapping it with the KeyManager. The API only has the public half, so once
+// a capsule is stored nothing it holds can open it; the worker keeps the
+// private half and releases each capsule's key when it unlocks.
+//
+// Sealed keys are
+//
+//	version (1) | escrow key id (8) | ephemeral public key (32) | nonce (12) | sealed data key
+//
+// with the AES-256-GCM key derived by HKDF-SHA256 from the X25519 shared
+// secret. Keys are PEM files as produced by
+//
+//	openssl genpkey -algorithm X25519 -out escrow.pem
+//	openssl pkey -in escrow.pem -pubout -out escrow.pub.pem
+
+var ErrUnknownEscrowKey = errors.New("data key was sealed to an unknown escrow key")
+
+const (
+	escrowVersion = 1
+	escrowKeyInfo = "time-capsule escrow v1"
+)
+
+func escrowKeyID(pub *ecdh.PublicKey) []byte {
+	sum := sha256.Sum256(pub.Bytes())
+	return sum[:masterKeyIDSize]
+}
+
+func escrowCipherKey(secret, ephemeral, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	return hkdf.Key(sha256.New, secret, salt, escrowKeyInfo, encKeySize)
+}
+
+func readPEM(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	return block.Bytes, nil
+}
+
+// EscrowSealer seals data keys to the escrow public key.
+type EscrowSealer struct {
+	pub *ecdh.PublicKey
+}
+
+func NewEscrowSealer(publicKeyPath string) (*EscrowSealer, error) {
+	der, err := readPEM(publicKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read escrow public key: %w", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse escrow public key: %w", err)
+	}
+	pub, ok := key.(*ecdh.PublicKey)
+	if !ok || pub.Curve() != ecdh.X25519() {
+		return nil, errors.New("escrow public key must be an X25519 key")
+	}
+	return &EscrowSealer{pub: pub}, nil
+}
+
+func (s *EscrowSealer) Seal(dataKey []byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ephemeral.ECDH(s.pub)
+	if err != nil {
+		return nil, err
+	}
+	key, err := escrowCipherKey(secret, ephemeral.PublicKey().Bytes(), s.pub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{escrowVersion}, escrowKeyID(s.pub)...)
+	header = append(header, ephemeral.PublicKey().Bytes()...)
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, dataKey, header), nil
+}
+
+// EscrowOpener recovers data keys sealed by an EscrowSealer. Only the worker
+// should be configured with one.
+type EscrowOpener struct {
+	priv *ecdh.PrivateKey
+}
+
+func NewEscrowOpener(privateKeyPath string) (*EscrowOpener, error) {
+	der, err := readPEM(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read escrow private key: %w", err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse escrow private key: %w", err)
+	}
+	priv, ok := key.(*ecdh.PrivateKey)
+	if !ok || priv.Curve() != ecdh.X25519() {
+		return nil, errors.New("escrow private key must be an X25519 key")
+	}
+	return &EscrowOpener{priv: priv}, nil
+}
+
+func (o *EscrowOpener) Open(sealed []byte) ([]byte, error) {
+	const pubSize = 32
+	headerSize := 1 + masterKeyIDSize + pubSize
+	if len(sealed) < headerSize || sealed[0] != escrowVersion {
+		return nil, ErrDecrypt
+	}
+	header := sealed[:headerSize]
+	if !bytes.Equal(header[1:1+masterKeyIDSize], escrowKeyID(o.priv.PublicKey())) {
+		return nil, ErrUnknownEscrowKey
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(header[1+masterKeyIDSize:])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	secret, err := o.priv.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	key, err := escrowCipherKey(secret, ephemeral.Bytes(), o.priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	rest := sealed[headerSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	dataKey, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return dataKey, nil
+}
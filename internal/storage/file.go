@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileStorage keeps objects as files under a root directory, for single-node
+// deployments and local development. It doesn't record content types.
+// Writes go through <root>/.tmp and are renamed into place, so readers never
+// see a partial object; multipart uploads are staged in <root>/.multipart.
+type FileStorage struct {
+	root string
+}
+
+const (
+	fileTmpDir       = ".tmp"
+	fileMultipartDir = ".multipart"
+)
+
+func NewFileStorage(root string) (*FileStorage, error) {
+	if root == "" {
+		return nil, errors.New("storage directory is required")
+	}
+	for _, dir := range []string{root, filepath.Join(root, fileTmpDir), filepath.Join(root, fileMultipartDir)} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return &FileStorage{root: root}, nil
+}
+
+// path maps key to a file under root, rejecting keys that would escape it or
+// collide with the staging directories.
+func (s *FileStorage) path(key string) (string, error) {
+	p := filepath.FromSlash(key)
+	if !filepath.IsLocal(p) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.root, p), nil
+}
+
+// writeFile copies body into a temporary file and renames it to path.
+func (s *FileStorage) writeFile(path string, body io.Reader) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(filepath.Join(s.root, fileTmpDir), "put-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, body)
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(f.Name(), path)
+}
+
+func (s *FileStorage) Put(ctx context.Context, key, contentType string, body io.Reader) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	return s.writeFile(path, body)
+}
+
+func (s *FileStorage) Get(ctx context.Context, key string) (*Object, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Object{Body: f, ContentLength: fi.Size()}, nil
+}
+
+func (s *FileStorage) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime(), StorageClass: StorageClassStandard}, nil
+}
+
+func (s *FileStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if strings.HasPrefix(key, ".") && key != "." {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime(), StorageClass: StorageClassStandard})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *FileStorage) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+func (s *FileStorage) PresignPut(ctx context.Context, key, contentType string, size int64, checksumSHA256 string, expires time.Duration) (*PresignedRequest, error) {
+	return nil, ErrPresignUnsupported
+}
+
+func (s *FileStorage) PresignUploadPart(ctx context.Context, key, uploadID string, number int32, size int64, expires time.Duration) (*PresignedRequest, error) {
+	return nil, ErrPresignUnsupported
+}
+
+func (s *FileStorage) Transition(ctx context.Context, key string, class StorageClass) error {
+	return ErrTieringUnsupported
+}
+
+func (s *FileStorage) Restore(ctx context.Context, key string, days int32) error {
+	return ErrTieringUnsupported
+}
+
+// uploadDir returns the staging directory of an upload after checking that
+// it was started for key.
+func (s *FileStorage) uploadDir(key, uploadID string) (string, error) {
+	if _, err := uuid.Parse(uploadID); err != nil {
+		return "", fmt.Errorf("no such upload %q", uploadID)
+	}
+	dir := filepath.Join(s.root, fileMultipartDir, uploadID)
+	owner, err := os.ReadFile(filepath.Join(dir, "key"))
+	if err != nil || string(owner) != key {
+		return "", fmt.Errorf("no such upload %q", uploadID)
+	}
+	return dir, nil
+}
+
+func (s *FileStorage) CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	uploadID := uuid.NewString()
+	dir := filepath.Join(s.root, fileMultipartDir, uploadID)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key"), []byte(key), 0o600); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+func (s *FileStorage) UploadPart(ctx context.Context, key, uploadID string, number int32, body io.ReadSeeker, size int64) (Part, error) {
+	dir, err := s.uploadDir(key, uploadID)
+	if err != nil {
+		return Part{}, err
+	}
+	h := md5.New()
+	n, err := s.writeFile(filepath.Join(dir, strconv.Itoa(int(number))), io.TeeReader(io.LimitReader(body, size), h))
+	if err != nil {
+		return Part{}, err
+	}
+	if n != size {
+		return Part{}, fmt.Errorf("part %d: got %d bytes, want %d", number, n, size)
+	}
+	return Part{Number: number, ETag: formatETag(h.Sum(nil))}, nil
+}
+
+func (s *FileStorage) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) error {
+	dir, err := s.uploadDir(key, uploadID)
+	if err != nil {
+		return err
+	}
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	files := make([]io.Reader, 0, len(parts))
+	for _, p := range parts {
+		f, err := os.Open(filepath.Join(dir, strconv.Itoa(int(p.Number))))
+		if err != nil {
+			return fmt.Errorf("invalid part %d: %w", p.Number, err)
+		}
+		defer f.Close()
+
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		if formatETag(h.Sum(nil)) != p.ETag {
+			return fmt.Errorf("invalid part %d", p.Number)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	if _, err := s.writeFile(path, io.MultiReader(files...)); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *FileStorage) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	dir, err := s.uploadDir(key, uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryStorage keeps objects in memory. It's meant for tests and local
+// development; nothing survives a restart.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+	uploads map[string]*memoryUpload
+	now     func() time.Time
+}
+
+type memoryObject struct {
+	data         []byte
+	contentType  string
+	lastModified time.Time
+}
+
+type memoryUpload struct {
+	key         string
+	contentType string
+	parts       map[int32][]byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		objects: map[string]memoryObject{},
+		uploads: map[string]*memoryUpload{},
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStorage) Put(ctx context.Context, key, contentType string, body io.Reader) (int64, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = memoryObject{data: data, contentType: contentType, lastModified: s.now()}
+	return int64(len(data)), nil
+}
+
+func (s *MemoryStorage) Get(ctx context.Context, key string) (*Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &Object{
+		Body:          io.NopCloser(bytes.NewReader(o.data)),
+		ContentLength: int64(len(o.data)),
+		ContentType:   o.contentType,
+	}, nil
+}
+
+func (s *MemoryStorage) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	info := o.info(key)
+	return &info, nil
+}
+
+func (s *MemoryStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *MemoryStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var objects []ObjectInfo
+	for key, o := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, o.info(key))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (o memoryObject) info(key string) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         int64(len(o.data)),
+		ContentType:  o.contentType,
+		LastModified: o.lastModified,
+		StorageClass: StorageClassStandard,
+	}
+}
+
+func (s *MemoryStorage) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+func (s *MemoryStorage) PresignPut(ctx context.Context, key, contentType string, size int64, checksumSHA256 string, expires time.Duration) (*PresignedRequest, error) {
+	return nil, ErrPresignUnsupported
+}
+
+func (s *MemoryStorage) PresignUploadPart(ctx context.Context, key, uploadID string, number int32, size int64, expires time.Duration) (*PresignedRequest, error) {
+	return nil, ErrPresignUnsupported
+}
+
+func (s *MemoryStorage) Transition(ctx context.Context, key string, class StorageClass) error {
+	return ErrTieringUnsupported
+}
+
+func (s *MemoryStorage) Restore(ctx context.Context, key string, days int32) error {
+	return ErrTieringUnsupported
+}
+
+func (s *MemoryStorage) CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uploadID := uuid.NewString()
+	s.uploads[uploadID] = &memoryUpload{key: key, contentType: contentType, parts: map[int32][]byte{}}
+	return uploadID, nil
+}
+
+func (s *MemoryStorage) UploadPart(ctx context.Context, key, uploadID string, number int32, body io.ReadSeeker, size int64) (Part, error) {
+	data, err := io.ReadAll(io.LimitReader(body, size))
+	if err != nil {
+		return Part{}, err
+	}
+	if int64(len(data)) != size {
+		return Part{}, fmt.Errorf("part %d: got %d bytes, want %d", number, len(data), size)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := s.upload(key, uploadID)
+	if err != nil {
+		return Part{}, err
+	}
+	u.parts[number] = data
+	return Part{Number: number, ETag: partETag(data)}, nil
+}
+
+func (s *MemoryStorage) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := s.upload(key, uploadID)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, p := range parts {
+		data, ok := u.parts[p.Number]
+		if !ok || partETag(data) != p.ETag {
+			return fmt.Errorf("invalid part %d", p.Number)
+		}
+		buf.Write(data)
+	}
+	s.objects[key] = memoryObject{data: buf.Bytes(), contentType: u.contentType, lastModified: s.now()}
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func (s *MemoryStorage) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.upload(key, uploadID); err != nil {
+		return err
+	}
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func (s *MemoryStorage) upload(key, uploadID string) (*memoryUpload, error) {
+	u, ok := s.uploads[uploadID]
+	if !ok || u.key != key {
+		return nil, fmt.Errorf("no such upload %q", uploadID)
+	}
+	return u, nil
+}
+
+func partETag(data []byte) string {
+	sum := md5.Sum(data)
+	return formatETag(sum[:])
+}
+
+// formatETag mimics the quoted MD5 S3 returns for a part.
+func formatETag(md5Sum []byte) string {
+	return `"` + hex.EncodeToString(md5Sum) + `"`
+}
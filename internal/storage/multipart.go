@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// MinPartSize is the smallest part S3 accepts for every part but the last.
+const MinPartSize = 5 << 20
+
+type Part struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+	// ChecksumSHA256 is only set for parts of uploads that S3 checksums.
+	ChecksumSHA256 string `json:"checksum_sha256,omitempty"`
+}
+
+func (s *S3Storage) CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	return s.createMultipartUpload(ctx, key, contentType, "")
+}
+
+// createMultipartUpload starts an upload whose parts S3 verifies with
+// algorithm, if one is given.
+func (s *S3Storage) createMultipartUpload(ctx context.Context, key, contentType string, algorithm types.ChecksumAlgorithm) (string, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		ChecksumAlgorithm: algorithm,
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	out, err := s.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.UploadId), nil
+}
+
+func (s *S3Storage) UploadPart(ctx context.Context, key, uploadID string, number int32, body io.ReadSeeker, size int64) (Part, error) {
+	return s.uploadPart(ctx, key, uploadID, number, body, size, "")
+}
+
+func (s *S3Storage) uploadPart(ctx context.Context, key, uploadID string, number int32, body io.ReadSeeker, size int64, algorithm types.ChecksumAlgorithm) (Part, error) {
+	out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		UploadId:          aws.String(uploadID),
+		PartNumber:        aws.Int32(number),
+		Body:              body,
+		ContentLength:     aws.Int64(size),
+		ChecksumAlgorithm: algorithm,
+	})
+	if err != nil {
+		return Part{}, err
+	}
+	return Part{
+		Number:         number,
+		ETag:           aws.ToString(out.ETag),
+		ChecksumSHA256: aws.ToString(out.ChecksumSHA256),
+	}, nil
+}
+
+func (s *S3Storage) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		part := types.CompletedPart{
+			PartNumber: aws.Int32(p.Number),
+			ETag:       aws.String(p.ETag),
+		}
+		if p.ChecksumSHA256 != "" {
+			part.ChecksumSHA256 = aws.String(p.ChecksumSHA256)
+		}
+		completed = append(completed, part)
+	}
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+func (s *S3Storage) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return err
+}
+
+// uploadStream copies body into key as a multipart upload, holding at most
+// partSize bytes in memory, and returns the number of bytes written. Every
+// part carries a SHA-256 checksum that S3 verifies and keeps. The upload is
+// aborted if reading body or any S3 call fails, and the read error is
+// returned unwrapped so callers can match it.
+func (s *S3Storage) uploadStream(ctx context.Context, key, contentType string, body io.Reader, partSize int) (int64, error) {
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+
+	uploadID, err := s.createMultipartUpload(ctx, key, contentType, types.ChecksumAlgorithmSha256)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't start multipart upload: %w", err)
+	}
+
+	abort := func(cause error) (int64, error) {
+		// Use a fresh context so a cancelled request still cleans up its parts.
+		if err := s.AbortMultipartUpload(context.WithoutCancel(ctx), key, uploadID); err != nil {
+			return 0, errors.Join(cause, fmt.Errorf("couldn't abort multipart upload: %w", err))
+		}
+		return 0, cause
+	}
+
+	var (
+		parts []Part
+		total int64
+		buf   = make([]byte, partSize)
+	)
+	for number := int32(1); ; number++ {
+		n, readErr := readFull(body, buf)
+		if readErr != nil && readErr != io.EOF {
+			return abort(readErr)
+		}
+		// S3 needs at least one part, even for an empty object.
+		if n > 0 || len(parts) == 0 {
+			part, err := s.uploadPart(ctx, key, uploadID, number, bytes.NewReader(buf[:n]), int64(n), types.ChecksumAlgorithmSha256)
+			if err != nil {
+				return abort(fmt.Errorf("couldn't upload part %d: %w", number, err))
+			}
+			parts = append(parts, part)
+			total += int64(n)
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	if err := s.CompleteMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		return abort(fmt.Errorf("couldn't complete multipart upload: %w", err))
+	}
+	return total, nil
+}
+
+// readFull fills buf from r like io.ReadFull, except that r's own error is
+// returned as is. Only io.EOF means the input ended; a stream cut off part
+// way, such as a truncated multipart body, fails with io.ErrUnexpectedEOF
+// instead of passing for a short final read.
+func readFull(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// PresignedRequest is a request a client can make directly against S3.
+// Header holds the headers that were signed and must be sent unchanged.
+type PresignedRequest struct {
+	URL    string
+	Method string
+	Header http.Header
+}
+
+// PresignPut returns a PUT request for a single-part upload of exactly size
+// bytes. When checksumSHA256 (base64) is set, S3 rejects a body that doesn't
+// match it.
+func (s *S3Storage) PresignPut(ctx context.Context, key, contentType string, size int64, checksumSHA256 string, expires time.Duration) (*PresignedRequest, error) {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		ContentLength: aws.Int64(size),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	if checksumSHA256 != "" {
+		input.ChecksumSHA256 = aws.String(checksumSHA256)
+	}
+
+	req, err := s3.NewPresignClient(s.client).PresignPutObject(ctx, input, s3.WithPresignExpires(expires))
+	if err != nil {
+		return nil, err
+	}
+	return &PresignedRequest{URL: req.URL, Method: req.Method, Header: req.SignedHeader}, nil
+}
+
+// PresignUploadPart returns a PUT request for one part of a multipart upload
+// started with CreateMultipartUpload.
+func (s *S3Storage) PresignUploadPart(ctx context.Context, key, uploadID string, number int32, size int64, expires time.Duration) (*PresignedRequest, error) {
+	req, err := s3.NewPresignClient(s.client).PresignUploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int32(number),
+		ContentLength: aws.Int64(size),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return nil, err
+	}
+	return &PresignedRequest{URL: req.URL, Method: req.Method, Header: req.SignedHeader}, nil
+}
+
+// Head returns the object's metadata, or ErrNotFound if it doesn't exist.
+func (s *S3Storage) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	// S3 leaves the storage class out for STANDARD objects.
+	class := StorageClass(out.StorageClass)
+	if class == "" {
+		class = StorageClassStandard
+	}
+	return &ObjectInfo{
+		Key:            key,
+		Size:           aws.ToInt64(out.ContentLength),
+		ContentType:    aws.ToString(out.ContentType),
+		LastModified:   aws.ToTime(out.LastModified),
+		ChecksumSHA256: aws.ToString(out.ChecksumSHA256),
+		StorageClass:   class,
+		Restore:        parseRestore(out.Restore),
+	}, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
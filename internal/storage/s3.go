@@ -2,11 +2,14 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type S3Storage struct {
@@ -14,16 +17,17 @@ type S3Storage struct {
 	bucket string
 }
 
-func NewS3Storage(ctx context.Context, bucket, region string, isLocal bool) (*S3Storage, error) {
+// NewS3Storage uses the default AWS credential chain. A non-empty endpoint
+// points the client at an S3-compatible service such as LocalStack or MinIO.
+func NewS3Storage(ctx context.Context, bucket, region, endpoint string) (*S3Storage, error) {
 	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
 	if err != nil {
 		return nil, err
 	}
 
 	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		if isLocal {
-			// Point to LocalStack instead of actual AWS
-			o.BaseEndpoint = aws.String("http://localhost:4566")
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
 			o.UsePathStyle = true
 		}
 	})
@@ -31,11 +35,89 @@ func NewS3Storage(ctx context.Context, bucket, region string, isLocal bool) (*S3
 	return &S3Storage{client: client, bucket: bucket}, nil
 }
 
-func (s *S3Storage) Upload(ctx context.Context, key string, body io.Reader) error {
-	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+// Put sends seekable bodies in a single request and streams anything else
+// as a multipart upload.
+func (s *S3Storage) Put(ctx context.Context, key, contentType string, body io.Reader) (int64, error) {
+	rs, ok := body.(io.ReadSeeker)
+	if !ok {
+		return s.uploadStream(ctx, key, contentType, body, MinPartSize)
+	}
+
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          rs,
+		ContentLength: aws.Int64(size),
+		// S3 rejects the body if it doesn't match and keeps the checksum.
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	if _, err := s.client.PutObject(ctx, input); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (*Object, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
-		Body:   body,
 	})
-	return err
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ErrNotFound
+		}
+		return nil, mapArchived(err)
+	}
+	return &Object{
+		Body:          out.Body,
+		ContentLength: aws.ToInt64(out.ContentLength),
+		ContentType:   aws.ToString(out.ContentType),
+	}, nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(o.Key),
+				Size:         aws.ToInt64(o.Size),
+				LastModified: aws.ToTime(o.LastModified),
+				StorageClass: StorageClass(o.StorageClass),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// PresignGet returns a GET URL for the object that stops working after
+// expires.
+func (s *S3Storage) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	req, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
 }
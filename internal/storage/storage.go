@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrPresignUnsupported = errors.New("storage backend can't presign requests")
+
+// Backend stores capsule content. Keys are slash-separated paths such as
+// "<userID>/<uuid>". Get and Head return ErrNotFound for missing keys, and
+// backends that can't hand out direct URLs return ErrPresignUnsupported from
+// the Presign methods. Backends without storage classes keep everything in
+// STANDARD and return ErrTieringUnsupported from Transition and Restore.
+type Backend interface {
+	// Put stores body under key and returns its size. Read errors from body
+	// are returned unwrapped so callers can match them.
+	Put(ctx context.Context, key, contentType string, body io.Reader) (int64, error)
+	// Get opens the object for reading. The caller must close Body.
+	Get(ctx context.Context, key string) (*Object, error)
+	Head(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// List returns every object whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+
+	PresignGet(ctx context.Context, key string, expires time.Duration) (string, error)
+	PresignPut(ctx context.Context, key, contentType string, size int64, checksumSHA256 string, expires time.Duration) (*PresignedRequest, error)
+	PresignUploadPart(ctx context.Context, key, uploadID string, number int32, size int64, expires time.Duration) (*PresignedRequest, error)
+
+	Transition(ctx context.Context, key string, class StorageClass) error
+	Restore(ctx context.Context, key string, days int32) error
+
+	Multipart
+}
+
+// Multipart assembles an object from parts uploaded separately, following
+// the S3 multipart upload model.
+type Multipart interface {
+	CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error)
+	UploadPart(ctx context.Context, key, uploadID string, number int32, body io.ReadSeeker, size int64) (Part, error)
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) error
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+}
+
+type Object struct {
+	Body          io.ReadCloser
+	ContentLength int64
+	ContentType   string
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+	// ChecksumSHA256 is the base64 SHA-256 S3 stored for the object, if the
+	// upload supplied one.
+	ChecksumSHA256 string
+	StorageClass   StorageClass
+	// Restore is only set for archived objects.
+	Restore RestoreStatus
+}
+
+const (
+	DriverS3         = "s3"
+	DriverFilesystem = "filesystem"
+	DriverMemory     = "memory"
+)
+
+type Options struct {
+	Driver string
+
+	// S3
+	Bucket string
+	Region string
+	// Endpoint overrides the AWS endpoint, e.g. http://localhost:4566 for
+	// LocalStack. Path-style addressing is used when it's set.
+	Endpoint string
+
+	// Filesystem
+	Dir string
+}
+
+// New returns the backend selected by opts.Driver, defaulting to S3.
+func New(ctx context.Context, opts Options) (Backend, error) {
+	switch opts.Driver {
+	case "", DriverS3:
+		return NewS3Storage(ctx, opts.Bucket, opts.Region, opts.Endpoint)
+	case DriverFilesystem:
+		return NewFileStorage(opts.Dir)
+	case DriverMemory:
+		return NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", opts.Driver)
+	}
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	ErrTieringUnsupported = errors.New("storage backend doesn't support storage classes")
+	// ErrArchived is returned by Get for an object in an archive class that
+	// hasn't been restored.
+	ErrArchived = errors.New("object is archived and must be restored first")
+)
+
+// StorageClass is an S3 storage class.
+type StorageClass string
+
+const (
+	StorageClassStandard    StorageClass = "STANDARD"
+	StorageClassStandardIA  StorageClass = "STANDARD_IA"
+	StorageClassGlacierIR   StorageClass = "GLACIER_IR"
+	StorageClassGlacier     StorageClass = "GLACIER"
+	StorageClassDeepArchive StorageClass = "DEEP_ARCHIVE"
+)
+
+// storageClassRank orders the supported classes from warmest to coldest.
+var storageClassRank = map[StorageClass]int{
+	StorageClassStandard:    0,
+	StorageClassStandardIA:  1,
+	StorageClassGlacierIR:   2,
+	StorageClassGlacier:     3,
+	StorageClassDeepArchive: 4,
+}
+
+func (c StorageClass) Valid() bool {
+	_, ok := storageClassRank[c]
+	return ok
+}
+
+// Archived reports whether objects in the class have to be restored before
+// they can be read.
+func (c StorageClass) Archived() bool {
+	return c == StorageClassGlacier || c == StorageClassDeepArchive
+}
+
+func (c StorageClass) ColderThan(other StorageClass) bool {
+	return storageClassRank[c] > storageClassRank[other]
+}
+
+// RestoreStatus describes the temporary copy S3 keeps of a restored archived
+// object.
+type RestoreStatus string
+
+const (
+	RestoreNone       RestoreStatus = ""
+	RestoreInProgress RestoreStatus = "in-progress"
+	RestoreDone       RestoreStatus = "done"
+)
+
+// Tier sends capsules with at least MinRemaining left until they unlock to
+// Class.
+type Tier struct {
+	Class        StorageClass
+	MinRemaining time.Duration
+}
+
+// TieringPolicy picks the storage class for a sealed capsule from the time
+// left until it unlocks. Capsules are only ever moved to colder classes until
+// RestoreLead before unlock, when they're all brought back to STANDARD so the
+// content is downloadable the day the capsule opens.
+type TieringPolicy struct {
+	// Tiers is sorted by MinRemaining.
+	Tiers       []Tier
+	RestoreLead time.Duration
+}
+
+// ParseTieringPolicy reads tiers written as comma-separated CLASS=duration
+// pairs, e.g.
+//
+//	STANDARD_IA=720h,GLACIER_IR=2160h,DEEP_ARCHIVE=8760h
+//
+// Archive classes must start well past restoreLead, or capsules would be
+// restored as soon as they're archived.
+func ParseTieringPolicy(tiers string, restoreLead time.Duration) (*TieringPolicy, error) {
+	p := &TieringPolicy{RestoreLead: restoreLead}
+	for _, field := range strings.Split(tiers, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("tier %q must be CLASS=duration", field)
+		}
+		class := StorageClass(strings.ToUpper(strings.TrimSpace(name)))
+		if !class.Valid() || class == StorageClassStandard {
+			return nil, fmt.Errorf("unsupported storage class %q", name)
+		}
+		minRemaining, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || minRemaining <= 0 {
+			return nil, fmt.Errorf("invalid duration for %s: %q", class, value)
+		}
+		if minRemaining <= restoreLead {
+			return nil, fmt.Errorf("%s starts at %s, which must be longer than the restore lead of %s", class, minRemaining, restoreLead)
+		}
+		p.Tiers = append(p.Tiers, Tier{Class: class, MinRemaining: minRemaining})
+	}
+
+	sort.Slice(p.Tiers, func(i, j int) bool { return p.Tiers[i].MinRemaining < p.Tiers[j].MinRemaining })
+	for i := 1; i < len(p.Tiers); i++ {
+		if !p.Tiers[i].Class.ColderThan(p.Tiers[i-1].Class) {
+			return nil, fmt.Errorf("%s must be colder than %s, which starts sooner", p.Tiers[i].Class, p.Tiers[i-1].Class)
+		}
+	}
+	return p, nil
+}
+
+// ClassFor returns the class a capsule with remaining time until unlock
+// belongs in.
+func (p *TieringPolicy) ClassFor(remaining time.Duration) StorageClass {
+	class := StorageClassStandard
+	if remaining <= p.RestoreLead {
+		return class
+	}
+	for _, t := range p.Tiers {
+		if remaining >= t.MinRemaining {
+			class = t.Class
+		}
+	}
+	return class
+}
+
+// singleCopyLimit is the largest object CopyObject accepts; anything bigger
+// is copied in parts.
+const (
+	singleCopyLimit = 5 << 30
+	copyPartSize    = 512 << 20
+)
+
+// Transition rewrites the object in place in another storage class. Archived
+// objects have to be restored first.
+func (s *S3Storage) Transition(ctx context.Context, key string, class StorageClass) error {
+	info, err := s.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+	if info.Size > singleCopyLimit {
+		return s.copyLarge(ctx, key, info, class)
+	}
+	_, err = s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(s.copySource(key)),
+		StorageClass:      types.StorageClass(class),
+		MetadataDirective: types.MetadataDirectiveCopy,
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	})
+	if err != nil {
+		return mapArchived(err)
+	}
+	return nil
+}
+
+// copyLarge is Transition for objects over singleCopyLimit.
+func (s *S3Storage) copyLarge(ctx context.Context, key string, info *ObjectInfo, class StorageClass) error {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		StorageClass:      types.StorageClass(class),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	}
+	if info.ContentType != "" {
+		input.ContentType = aws.String(info.ContentType)
+	}
+	created, err := s.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return fmt.Errorf("couldn't start multipart copy: %w", err)
+	}
+	uploadID := aws.ToString(created.UploadId)
+
+	abort := func(cause error) error {
+		if err := s.AbortMultipartUpload(context.WithoutCancel(ctx), key, uploadID); err != nil {
+			return errors.Join(cause, fmt.Errorf("couldn't abort multipart copy: %w", err))
+		}
+		return cause
+	}
+
+	var parts []Part
+	for number, offset := int32(1), int64(0); offset < info.Size; number, offset = number+1, offset+copyPartSize {
+		end := min(offset+copyPartSize, info.Size) - 1
+		out, err := s.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(key),
+			UploadId:        aws.String(uploadID),
+			PartNumber:      aws.Int32(number),
+			CopySource:      aws.String(s.copySource(key)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		})
+		if err != nil {
+			return abort(fmt.Errorf("couldn't copy part %d: %w", number, mapArchived(err)))
+		}
+		parts = append(parts, Part{
+			Number:         number,
+			ETag:           aws.ToString(out.CopyPartResult.ETag),
+			ChecksumSHA256: aws.ToString(out.CopyPartResult.ChecksumSHA256),
+		})
+	}
+
+	if err := s.CompleteMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		return abort(fmt.Errorf("couldn't complete multipart copy: %w", err))
+	}
+	return nil
+}
+
+// Restore asks S3 for a temporary readable copy of an archived object, kept
+// for days. Restores of DEEP_ARCHIVE objects take up to 12 hours.
+func (s *S3Storage) Restore(ctx context.Context, key string, days int32) error {
+	_, err := s.client.RestoreObject(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &types.RestoreRequest{
+			Days:                 aws.Int32(days),
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: types.TierStandard},
+		},
+	})
+	return err
+}
+
+func (s *S3Storage) copySource(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return s.bucket + "/" + strings.Join(segments, "/")
+}
+
+// parseRestore reads the x-amz-restore header, e.g.
+// `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`.
+func parseRestore(header *string) RestoreStatus {
+	switch {
+	case header == nil:
+		return RestoreNone
+	case strings.Contains(*header, `ongoing-request="true"`):
+		return RestoreInProgress
+	default:
+		return RestoreDone
+	}
+}
+
+func mapArchived(err error) error {
+	var invalidState *types.InvalidObjectState
+	if errors.As(err, &invalidState) {
+		return ErrArchived
+	}
+	return err
+}
@@ -0,0 +1,3 @@
+#!/bin/sh
+# Run by LocalStack once S3 is ready.
+awslocal s3 mb s3://capsule-bucket
@@ -0,0 +1,28 @@
+-- name: ClaimAccountEmail :execrows
+-- Counts an account email that is about to be sent, unless one of its kind
+-- went out after resend_after or the user has had max_sends of them in a
+-- window that started after window_start. A window that started before
+-- window_start is over, and the email starts a new one.
+INSERT INTO account_email_sends (user_id, kind, last_sent_at, window_started_at, sent_in_window)
+VALUES (sqlc.arg(user_id), sqlc.arg(kind), sqlc.arg(now)::timestamp, sqlc.arg(now)::timestamp, 1)
+ON CONFLICT (user_id, kind) DO UPDATE
+SET
+    last_sent_at = EXCLUDED.last_sent_at,
+    window_started_at = CASE
+        WHEN account_email_sends.window_started_at > sqlc.arg(window_start)::timestamp THEN account_email_sends.window_started_at
+        ELSE EXCLUDED.window_started_at
+    END,
+    sent_in_window = CASE
+        WHEN account_email_sends.window_started_at > sqlc.arg(window_start)::timestamp THEN account_email_sends.sent_in_window + 1
+        ELSE 1
+    END
+WHERE account_email_sends.last_sent_at <= sqlc.arg(resend_after)::timestamp
+  AND (
+    account_email_sends.window_started_at <= sqlc.arg(window_start)::timestamp
+    OR account_email_sends.sent_in_window < sqlc.arg(max_sends)::int
+  );
+
+-- name: GetAccountEmailSends :one
+SELECT * FROM account_email_sends
+WHERE user_id = $1
+  AND kind = $2;
@@ -1,16 +1,187 @@
 -- name: CreateCapsule :one
-INSERT INTO capsule (id, user_id, title, created_at, s3key, unlock_at, is_unlocked)
-VALUES ($1, $2, $3, $4, $5, $6, $7)
+INSERT INTO capsule (id, user_id, title, created_at, s3key, unlock_at, is_unlocked, upload_status, size_bytes, sha256, upload_id, wrapped_key, escrowed_key, content_type, object_sha256)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 RETURNING *;
 
 -- name: GetCapsuleForUnlock :one
-SELECT id, user_id, title, s3key, is_unlocked FROM capsule
+SELECT * FROM capsule
 WHERE id = $1 LIMIT 1;
 
--- name: MarkAsUnlocked :exec
+-- name: LockCapsuleForUnlock :one
+-- Locks a capsule that hasn't opened yet. A row another worker is already
+-- unlocking is skipped, so no row means there is nothing left to do.
+SELECT * FROM capsule
+WHERE id = $1
+  AND is_unlocked IS NOT TRUE
+FOR UPDATE SKIP LOCKED;
+
+-- name: MarkAsUnlocked :execrows
 UPDATE capsule
 SET is_unlocked = true
+WHERE id = $1
+  AND is_unlocked IS NOT TRUE;
+
+-- name: ClaimUnlockNotification :execrows
+-- Leases the unlock email of an open capsule to the caller, unless it has
+-- gone out or another worker holds the lease. A lease that has run out (a
+-- crashed worker or a failed send) can be claimed again.
+UPDATE capsule
+SET unlock_notify_after = now() + sqlc.arg(lease_seconds)::int * interval '1 second'
+WHERE id = sqlc.arg(id)
+  AND is_unlocked IS TRUE
+  AND unlock_notified_at IS NULL
+  AND (unlock_notify_after IS NULL OR unlock_notify_after < now());
+
+-- name: MarkUnlockNotified :exec
+UPDATE capsule
+SET unlock_notified_at = now()
 WHERE id = $1;
 
+-- name: ListUnannouncedCapsuleIDs :many
+-- Open capsules whose owner hasn't been emailed yet and that no worker holds
+-- a lease on.
+SELECT id FROM capsule
+WHERE is_unlocked IS TRUE
+  AND unlock_notified_at IS NULL
+  AND (unlock_notify_after IS NULL OR unlock_notify_after < now())
+ORDER BY unlock_at ASC
+LIMIT $1;
+
 -- name: GetCapsulesByUserID :many
-SELECT * FROM capsule WHERE user_id = $1 ORDER BY created_at DESC;
+SELECT * FROM capsule WHERE user_id = $1 AND upload_status = 'complete' ORDER BY created_at DESC;
+
+-- name: GetOverdueCapsuleIDs :many
+SELECT id FROM capsule
+WHERE unlock_at <= $1
+  AND is_unlocked IS NOT TRUE
+  AND upload_status = 'complete'
+ORDER BY unlock_at ASC
+LIMIT $2;
+
+-- name: ListCapsulesToVerify :many
+-- Pages through sealed capsules by id for the scrubber, skipping those that
+-- were verified since $2.
+SELECT * FROM capsule
+WHERE id > $1
+  AND upload_status = 'complete'
+  AND (last_verified_at IS NULL OR last_verified_at < $2)
+ORDER BY id
+LIMIT $3;
+
+-- name: ListCapsulesForTiering :many
+-- Pages through sealed capsules by id: those that haven't opened yet, and
+-- opened ones whose object still has to come back to STANDARD.
+SELECT * FROM capsule
+WHERE id > $1
+  AND upload_status = 'complete'
+  AND (is_unlocked IS NOT TRUE OR storage_class <> 'STANDARD')
+ORDER BY id
+LIMIT $2;
+
+-- name: ListStorageKeysForUser :many
+-- Every object key a user's rows still point to, including capsules and tus
+-- uploads that are still in progress. Direct uploads started before $2 are
+-- left out: they're abandoned and only wait for the worker to expire them.
+SELECT s3key FROM capsule
+WHERE user_id = $1
+  AND (upload_status <> 'pending_upload' OR created_at >= $2)
+UNION
+SELECT s3key FROM uploads WHERE user_id = $1;
+
+-- name: ListDueCapsules :many
+-- Due capsules for the broker-less scheduler, leaving out those backing off
+-- after a failed unlock and those another worker is unlocking right now.
+SELECT id, unlock_attempts FROM capsule
+WHERE unlock_at <= now()
+  AND is_unlocked IS NOT TRUE
+  AND upload_status = 'complete'
+  AND (next_unlock_attempt_at IS NULL OR next_unlock_attempt_at <= now())
+ORDER BY unlock_at ASC
+LIMIT $1
+FOR UPDATE SKIP LOCKED;
+
+-- name: RecordUnlockFailure :exec
+UPDATE capsule
+SET
+    unlock_attempts = unlock_attempts + 1,
+    next_unlock_attempt_at = $2
+WHERE id = $1;
+
+-- name: GetNextUnlockAt :one
+-- When the scheduler next has work: the earliest unlock_at, or retry time for
+-- capsules that are backing off. Each half is the first entry of an index.
+SELECT next_at FROM (
+    (SELECT unlock_at AS next_at FROM capsule
+     WHERE is_unlocked IS NOT TRUE
+       AND upload_status = 'complete'
+       AND next_unlock_attempt_at IS NULL
+     ORDER BY unlock_at ASC
+     LIMIT 1)
+    UNION ALL
+    (SELECT next_unlock_attempt_at AS next_at FROM capsule
+     WHERE is_unlocked IS NOT TRUE
+       AND upload_status = 'complete'
+       AND next_unlock_attempt_at IS NOT NULL
+     ORDER BY next_unlock_attempt_at ASC
+     LIMIT 1)
+) AS candidates
+ORDER BY next_at ASC
+LIMIT 1;
+
+-- name: NotifyCapsuleScheduled :exec
+SELECT pg_notify('capsule_scheduled', sqlc.arg(capsule_id)::text);
+
+-- name: GetCapsuleByIDForUser :one
+SELECT * FROM capsule
+WHERE id = $1
+  AND user_id = $2;
+
+-- name: MarkCapsuleUploaded :execrows
+UPDATE capsule
+SET
+    upload_status = 'complete',
+    upload_id = NULL,
+    wrapped_key = $3,
+    s3key = $4,
+    escrowed_key = $5,
+    sha256 = $6,
+    object_sha256 = $7
+WHERE id = $1
+  AND user_id = $2
+  AND upload_status = 'pending_upload';
+
+-- name: DeletePendingCapsule :execrows
+-- Drops a direct upload that failed verification or was abandoned. No rows
+-- means it was finalized in the meantime.
+DELETE FROM capsule
+WHERE id = $1
+  AND user_id = $2
+  AND upload_status = 'pending_upload';
+
+-- name: ListExpiredPendingCapsules :many
+-- Direct uploads started before $1 that were never finalized, oldest first.
+SELECT * FROM capsule
+WHERE upload_status = 'pending_upload'
+  AND created_at < $1
+ORDER BY created_at ASC
+LIMIT $2;
+
+-- name: RecordCapsuleVerification :exec
+UPDATE capsule
+SET
+    last_verified_at = $2,
+    integrity_status = $3
+WHERE id = $1;
+
+-- name: ReleaseCapsuleKey :exec
+-- Replaces a time-locked capsule's escrowed key with one the API can unwrap.
+UPDATE capsule
+SET
+    wrapped_key = $2,
+    escrowed_key = NULL
+WHERE id = $1;
+
+-- name: SetCapsuleStorageClass :exec
+UPDATE capsule
+SET storage_class = $2
+WHERE id = $1;
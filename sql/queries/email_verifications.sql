@@ -0,0 +1,14 @@
+-- name: CreateEmailVerification :one
+INSERT INTO email_verifications (id, user_id, email, created_at, expires_at)
+VALUES ($1, $2, $3, now(), $4)
+RETURNING *;
+
+-- name: UseEmailVerification :one
+-- Consumes an outstanding verification, returning the address it confirms.
+UPDATE email_verifications
+SET used_at = now()
+WHERE id = $1
+  AND user_id = $2
+  AND used_at IS NULL
+  AND expires_at > now()
+RETURNING *;
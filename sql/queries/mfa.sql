@@ -0,0 +1,92 @@
+-- name: ClaimMFAChallengeAttempt :one
+-- Uses up one attempt at the challenge, if it has any left.
+UPDATE mfa_challenges
+SET attempts = attempts + 1
+WHERE id = sqlc.arg(id)
+  AND user_id = sqlc.arg(user_id)
+  AND used_at IS NULL
+  AND expires_at > now()
+  AND attempts < sqlc.arg(max_attempts)::int
+RETURNING *;
+
+-- name: ClaimTOTPDisableAttempt :execrows
+-- Uses up one of the user's attempts at turning TOTP off, if they have any
+-- left. A window that started before window_start is over, and the attempt
+-- starts a new one at now.
+UPDATE user_totp
+SET
+    disable_attempts = CASE
+        WHEN disable_window_started_at > sqlc.arg(window_start)::timestamp THEN disable_attempts + 1
+        ELSE 1
+    END,
+    disable_window_started_at = CASE
+        WHEN disable_window_started_at > sqlc.arg(window_start)::timestamp THEN disable_window_started_at
+        ELSE sqlc.arg(now)::timestamp
+    END
+WHERE user_id = sqlc.arg(user_id)
+  AND confirmed_at IS NOT NULL
+  AND (
+    disable_window_started_at IS NULL
+    OR disable_window_started_at <= sqlc.arg(window_start)::timestamp
+    OR disable_attempts < sqlc.arg(max_attempts)::int
+  );
+
+-- name: ConfirmUserTOTP :execrows
+UPDATE user_totp
+SET
+    confirmed_at = now(),
+    last_used_step = $2
+WHERE user_id = $1
+  AND confirmed_at IS NULL;
+
+-- name: CreateMFAChallenge :one
+INSERT INTO mfa_challenges (id, user_id, created_at, expires_at, device_name)
+VALUES ($1, $2, now(), $3, $4)
+RETURNING *;
+
+-- name: CreateRecoveryCode :exec
+INSERT INTO recovery_codes (id, user_id, code_hash, created_at)
+VALUES ($1, $2, $3, now());
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM recovery_codes WHERE user_id = $1;
+
+-- name: DeleteUserTOTP :exec
+DELETE FROM user_totp WHERE user_id = $1;
+
+-- name: GetUserTOTP :one
+SELECT * FROM user_totp WHERE user_id = $1;
+
+-- name: UpsertUserTOTP :execrows
+-- Starts enrollment, replacing an unconfirmed key. A confirmed key is left
+-- alone and no rows are affected.
+INSERT INTO user_totp (user_id, wrapped_secret, created_at)
+VALUES ($1, $2, now())
+ON CONFLICT (user_id) DO UPDATE
+SET
+    wrapped_secret = EXCLUDED.wrapped_secret,
+    created_at = EXCLUDED.created_at,
+    last_used_step = NULL
+WHERE user_totp.confirmed_at IS NULL;
+
+-- name: UseMFAChallenge :execrows
+UPDATE mfa_challenges
+SET used_at = now()
+WHERE id = $1
+  AND user_id = $2
+  AND used_at IS NULL;
+
+-- name: UseRecoveryCode :execrows
+UPDATE recovery_codes
+SET used_at = now()
+WHERE user_id = $1
+  AND code_hash = $2
+  AND used_at IS NULL;
+
+-- name: UseTOTPStep :execrows
+-- Accepts a code's time step only if it's later than the last one used.
+UPDATE user_totp
+SET last_used_step = $2
+WHERE user_id = $1
+  AND confirmed_at IS NOT NULL
+  AND (last_used_step IS NULL OR last_used_step < $2);
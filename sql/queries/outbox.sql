@@ -13,3 +13,56 @@ LIMIT $1;
 UPDATE outbox
 SET status = $2
 WHERE id = $1;
+
+-- name: ClaimOutboxEvents :many
+-- Leases a batch of pending events to one worker. Rows locked by another
+-- transaction are skipped, and rows whose lease has expired (a crashed
+-- worker) become claimable again.
+UPDATE outbox
+SET
+    claimed_by = sqlc.arg(worker_id)::text,
+    lease_expires_at = now() + sqlc.arg(lease_seconds)::int * interval '1 second'
+WHERE id IN (
+    SELECT id FROM outbox
+    WHERE status = 'pending'
+      AND (lease_expires_at IS NULL OR lease_expires_at < now())
+      AND (next_attempt_at IS NULL OR next_attempt_at <= now())
+    ORDER BY created_at ASC
+    LIMIT sqlc.arg(batch_size)::int
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING *;
+
+-- name: MarkOutboxEventFailed :exec
+-- Records a failed publish attempt and releases the lease. The caller decides
+-- whether the event goes back to 'pending' or becomes 'dead'.
+UPDATE outbox
+SET
+    attempts = attempts + 1,
+    last_error = $2,
+    next_attempt_at = $3,
+    status = $4,
+    claimed_by = NULL,
+    lease_expires_at = NULL
+WHERE id = $1;
+
+-- name: ListDeadOutboxEvents :many
+SELECT * FROM outbox
+WHERE status = 'dead'
+ORDER BY created_at ASC
+LIMIT $1;
+
+-- name: RedriveOutboxEvent :execrows
+UPDATE outbox
+SET
+    status = 'pending',
+    attempts = 0,
+    last_error = NULL,
+    next_attempt_at = NULL,
+    claimed_by = NULL,
+    lease_expires_at = NULL
+WHERE id = $1
+  AND status = 'dead';
+
+-- name: NotifyOutboxPending :exec
+SELECT pg_notify('outbox_pending', sqlc.arg(event_id)::text);
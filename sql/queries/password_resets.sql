@@ -0,0 +1,20 @@
+-- name: CreatePasswordReset :one
+INSERT INTO password_resets (id, user_id, created_at, expires_at)
+VALUES ($1, $2, now(), $3)
+RETURNING *;
+
+-- name: ExpireUserPasswordResets :exec
+-- Voids every outstanding reset once the password has changed.
+UPDATE password_resets
+SET used_at = now()
+WHERE user_id = $1
+  AND used_at IS NULL;
+
+-- name: UsePasswordReset :one
+UPDATE password_resets
+SET used_at = now()
+WHERE id = $1
+  AND user_id = $2
+  AND used_at IS NULL
+  AND expires_at > now()
+RETURNING *;
@@ -1,36 +1,58 @@
 -- name: CreateRefreshToken :one
 INSERT INTO refresh_tokens (
-  token,
+  token_hash,
   created_at,
   updated_at,
   user_id,
-  expires_at
+  expires_at,
+  family_id
 ) VALUES (
   $1,
   now(),
   now(),
   $2,
-  $3
+  $3,
+  $4
 )
-RETURNING token, created_at, updated_at, user_id, expires_at, revoked_at;
+RETURNING token_hash, created_at, updated_at, user_id, expires_at, revoked_at, family_id;
 
 -- name: RevokeRefreshToken :exec
 UPDATE refresh_tokens
 SET
     revoked_at = now(),
     updated_at = now()
-WHERE token = $1
+WHERE token_hash = $1
   AND revoked_at IS NULL;
 
--- name: GetUserByRefreshToken :one
-SELECT
-    u.id,
-    u.created_at,
-    u.updated_at,
-    u.email,
-    u.hashed_password
-FROM refresh_tokens rt
-JOIN users u ON u.id = rt.user_id
-WHERE rt.token = $1
-  AND rt.revoked_at IS NULL
-  AND rt.expires_at > now();
+-- name: UseRefreshToken :one
+-- Revokes a valid token as it is exchanged for its successor. No row means
+-- the token is unknown, expired or was already used.
+UPDATE refresh_tokens
+SET
+    revoked_at = now(),
+    updated_at = now()
+WHERE token_hash = $1
+  AND revoked_at IS NULL
+  AND expires_at > now()
+RETURNING token_hash, created_at, updated_at, user_id, expires_at, revoked_at, family_id;
+
+-- name: GetRefreshToken :one
+SELECT token_hash, created_at, updated_at, user_id, expires_at, revoked_at, family_id
+FROM refresh_tokens
+WHERE token_hash = $1;
+
+-- name: RevokeRefreshTokenFamily :exec
+UPDATE refresh_tokens
+SET
+    revoked_at = now(),
+    updated_at = now()
+WHERE family_id = $1
+  AND revoked_at IS NULL;
+
+-- name: RevokeUserRefreshTokens :exec
+UPDATE refresh_tokens
+SET
+    revoked_at = now(),
+    updated_at = now()
+WHERE user_id = $1
+  AND revoked_at IS NULL;
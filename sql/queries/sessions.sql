@@ -0,0 +1,38 @@
+-- name: CreateSession :one
+INSERT INTO sessions (id, user_id, created_at, last_used_at, expires_at, device_name, user_agent, ip)
+VALUES ($1, $2, now(), now(), $3, $4, $5, $6)
+RETURNING *;
+
+-- name: GetSession :one
+SELECT * FROM sessions
+WHERE id = $1;
+
+-- name: ListActiveSessions :many
+SELECT * FROM sessions
+WHERE user_id = $1
+  AND revoked_at IS NULL
+  AND expires_at > now()
+ORDER BY last_used_at DESC;
+
+-- name: RevokeSession :execrows
+UPDATE sessions
+SET revoked_at = now()
+WHERE id = $1
+  AND user_id = $2
+  AND revoked_at IS NULL;
+
+-- name: RevokeUserSessions :exec
+UPDATE sessions
+SET revoked_at = now()
+WHERE user_id = $1
+  AND revoked_at IS NULL;
+
+-- name: TouchSession :exec
+-- Records a refresh: the session now lasts as long as its newest token.
+UPDATE sessions
+SET
+    last_used_at = now(),
+    expires_at = $2,
+    user_agent = $3,
+    ip = $4
+WHERE id = $1;
@@ -0,0 +1,41 @@
+-- name: CreateUpload :one
+INSERT INTO uploads (id, user_id, capsule_id, s3key, s3_upload_id, upload_length, title, unlock_at, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+RETURNING *;
+
+-- name: GetUploadForUser :one
+SELECT * FROM uploads
+WHERE id = $1
+  AND user_id = $2;
+
+-- name: LockUploadForUser :one
+-- Locks an upload for the request writing to it. A row another request is
+-- already writing to is skipped, so no row means the upload is busy or gone.
+SELECT * FROM uploads
+WHERE id = $1
+  AND user_id = $2
+FOR UPDATE SKIP LOCKED;
+
+-- name: UpdateUploadProgress :execrows
+-- Guarded by the offset the caller started from, so two overlapping PATCH
+-- requests can't both record progress.
+UPDATE uploads
+SET
+    upload_offset = sqlc.arg(upload_offset),
+    tail_size = sqlc.arg(tail_size),
+    parts = sqlc.arg(parts),
+    updated_at = now()
+WHERE id = sqlc.arg(id)
+  AND upload_offset = sqlc.arg(expected_offset);
+
+-- name: MarkUploadCompleted :execrows
+UPDATE uploads
+SET
+    completed_at = now(),
+    updated_at = now()
+WHERE id = $1
+  AND completed_at IS NULL;
+
+-- name: DeleteUpload :exec
+DELETE FROM uploads
+WHERE id = $1;
@@ -5,3 +5,24 @@ RETURNING *;
 
 -- name: GetUserByEmail :one
 SELECT * FROM users WHERE email = $1;
+
+-- name: GetUserByID :one
+SELECT * FROM users WHERE id = $1;
+
+-- name: ListUserIDs :many
+SELECT id FROM users ORDER BY id;
+
+-- name: MarkEmailVerified :execrows
+UPDATE users
+SET
+    email_verified_at = COALESCE(email_verified_at, now()),
+    updated_at = now()
+WHERE id = $1
+  AND email = $2;
+
+-- name: UpdateUserPassword :exec
+UPDATE users
+SET
+    hashed_password = $2,
+    updated_at = now()
+WHERE id = $1;
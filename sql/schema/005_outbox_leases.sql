@@ -0,0 +1,13 @@
+-- +goose Up
+ALTER TABLE outbox
+    ADD COLUMN claimed_by TEXT,
+    ADD COLUMN lease_expires_at TIMESTAMP;
+
+CREATE INDEX outbox_pending_idx ON outbox (created_at) WHERE status = 'pending';
+
+-- +goose Down
+DROP INDEX outbox_pending_idx;
+
+ALTER TABLE outbox
+    DROP COLUMN lease_expires_at,
+    DROP COLUMN claimed_by;
@@ -0,0 +1,15 @@
+-- +goose Up
+ALTER TABLE outbox
+    ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN last_error TEXT,
+    ADD COLUMN next_attempt_at TIMESTAMP;
+
+CREATE INDEX outbox_dead_idx ON outbox (created_at) WHERE status = 'dead';
+
+-- +goose Down
+DROP INDEX outbox_dead_idx;
+
+ALTER TABLE outbox
+    DROP COLUMN next_attempt_at,
+    DROP COLUMN last_error,
+    DROP COLUMN attempts;
@@ -0,0 +1,24 @@
+-- +goose Up
+-- Older rows hold the bare capsule id as a JSON string. Wrap them in the
+-- version 1 capsule.created envelope (see internal/events).
+UPDATE outbox o
+SET payload = jsonb_build_object(
+    'id', o.id,
+    'type', 'capsule.created',
+    'version', 1,
+    'aggregate_id', c.id,
+    'occurred_at', to_char(o.created_at, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+    'body', jsonb_build_object(
+        'capsule_id', c.id,
+        'user_id', c.user_id,
+        'unlock_at', to_char(c.unlock_at, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')
+    )
+)
+FROM capsule c
+WHERE jsonb_typeof(o.payload) = 'string'
+  AND c.id = (o.payload #>> '{}')::uuid;
+
+-- +goose Down
+UPDATE outbox
+SET payload = payload -> 'aggregate_id'
+WHERE payload ->> 'type' = 'capsule.created';
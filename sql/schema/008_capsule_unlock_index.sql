@@ -0,0 +1,5 @@
+-- +goose Up
+CREATE INDEX capsule_locked_unlock_at_idx ON capsule (unlock_at) WHERE is_unlocked IS NOT TRUE;
+
+-- +goose Down
+DROP INDEX capsule_locked_unlock_at_idx;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- Direct-to-S3 uploads create the capsule row before the object exists.
+-- Such rows stay 'pending_upload' until the client finalizes the upload.
+ALTER TABLE capsule
+    ADD COLUMN upload_status TEXT NOT NULL DEFAULT 'complete',
+    ADD COLUMN size_bytes BIGINT,
+    ADD COLUMN sha256 TEXT,
+    ADD COLUMN upload_id TEXT;
+
+-- +goose Down
+ALTER TABLE capsule
+    DROP COLUMN upload_id,
+    DROP COLUMN sha256,
+    DROP COLUMN size_bytes,
+    DROP COLUMN upload_status;
@@ -0,0 +1,22 @@
+-- +goose Up
+-- Resumable (tus) uploads in progress. Each row tracks an S3 multipart upload;
+-- bytes that don't yet fill a part live in a temporary tail object.
+CREATE TABLE uploads (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    capsule_id UUID NOT NULL,
+    s3key TEXT NOT NULL,
+    s3_upload_id TEXT NOT NULL,
+    upload_length BIGINT NOT NULL,
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    tail_size BIGINT NOT NULL DEFAULT 0,
+    parts JSONB NOT NULL DEFAULT '[]',
+    title TEXT,
+    unlock_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE uploads;
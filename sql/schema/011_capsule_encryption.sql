@@ -0,0 +1,9 @@
+-- +goose Up
+-- Per-capsule data key, wrapped by the master key. NULL for capsules stored
+-- before encryption was introduced, which are still served as plaintext.
+ALTER TABLE capsule
+    ADD COLUMN wrapped_key BYTEA;
+
+-- +goose Down
+ALTER TABLE capsule
+    DROP COLUMN wrapped_key;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- Time-locked capsules keep their data key sealed to the worker's escrow key
+-- until unlock, when the worker moves it into wrapped_key. At most one of the
+-- two columns is set.
+ALTER TABLE capsule
+    ADD COLUMN escrowed_key BYTEA;
+
+-- +goose Down
+ALTER TABLE capsule
+    DROP COLUMN escrowed_key;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- The media type the client declared for the sealed file, sent back as the
+-- Content-Type of downloads.
+ALTER TABLE capsule
+    ADD COLUMN content_type TEXT;
+
+-- +goose Down
+ALTER TABLE capsule
+    DROP COLUMN content_type;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- The worker's scrubber re-reads sealed objects and records what it found.
+-- 'unverified' capsules haven't been checked yet.
+ALTER TABLE capsule
+    ADD COLUMN last_verified_at TIMESTAMP,
+    ADD COLUMN integrity_status TEXT NOT NULL DEFAULT 'unverified'
+        CHECK (integrity_status IN ('unverified', 'ok', 'corrupted', 'missing'));
+
+-- +goose Down
+ALTER TABLE capsule
+    DROP COLUMN integrity_status,
+    DROP COLUMN last_verified_at;
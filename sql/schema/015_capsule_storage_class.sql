@@ -0,0 +1,8 @@
+-- +goose Up
+-- The S3 storage class the worker's tiering job last moved the object to.
+ALTER TABLE capsule
+    ADD COLUMN storage_class TEXT NOT NULL DEFAULT 'STANDARD';
+
+-- +goose Down
+ALTER TABLE capsule
+    DROP COLUMN storage_class;
@@ -0,0 +1,18 @@
+-- +goose Up
+-- Refresh tokens are stored as the hex SHA-256 of the token, and every token
+-- descends from a login through a family that is revoked as a whole when a
+-- rotated token is presented again.
+ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash;
+UPDATE refresh_tokens SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex');
+
+ALTER TABLE refresh_tokens ADD COLUMN family_id UUID;
+UPDATE refresh_tokens SET family_id = gen_random_uuid();
+ALTER TABLE refresh_tokens ALTER COLUMN family_id SET NOT NULL;
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+-- +goose Down
+-- Hashes can't be turned back into tokens, so everyone signs in again.
+DELETE FROM refresh_tokens;
+DROP INDEX refresh_tokens_family_id_idx;
+ALTER TABLE refresh_tokens DROP COLUMN family_id;
+ALTER TABLE refresh_tokens RENAME COLUMN token_hash TO token;
@@ -0,0 +1,38 @@
+-- +goose Up
+-- A session is everything that descends from one login: its refresh token
+-- family and the access tokens issued alongside. Revoking it signs that
+-- device out.
+CREATE TABLE sessions (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    device_name TEXT,
+    user_agent TEXT,
+    ip TEXT
+);
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+-- Token families from before sessions existed become sessions without
+-- device details.
+INSERT INTO sessions (id, user_id, created_at, last_used_at, expires_at, revoked_at)
+SELECT
+    family_id,
+    user_id,
+    min(created_at),
+    max(updated_at),
+    max(expires_at),
+    CASE WHEN bool_and(revoked_at IS NOT NULL) THEN max(revoked_at) END
+FROM refresh_tokens
+GROUP BY family_id, user_id;
+
+ALTER TABLE refresh_tokens
+    ADD CONSTRAINT refresh_tokens_family_id_fkey
+    FOREIGN KEY (family_id) REFERENCES sessions(id) ON DELETE CASCADE;
+
+-- +goose Down
+ALTER TABLE refresh_tokens DROP CONSTRAINT refresh_tokens_family_id_fkey;
+DROP TABLE sessions;
@@ -0,0 +1,26 @@
+-- +goose Up
+-- Accounts start unverified and can't create capsules until the address has
+-- been confirmed: the product depends on mail reaching it years later.
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP;
+
+-- Accounts from before verification existed are grandfathered in, so they
+-- keep being able to create capsules. Their address is taken as confirmed
+-- from the day they signed up.
+UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL;
+
+-- Verification tokens are signed JWTs whose jti is the row id; the row makes
+-- each token single-use and rate-limits resends.
+CREATE TABLE email_verifications (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX email_verifications_user_id_created_at_idx ON email_verifications (user_id, created_at);
+
+-- +goose Down
+DROP TABLE email_verifications;
+ALTER TABLE users DROP COLUMN email_verified_at;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- Like email verifications, reset tokens are signed JWTs whose jti is the row
+-- id, so each one works once and resets can be rate-limited per user.
+CREATE TABLE password_resets (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX password_resets_user_id_created_at_idx ON password_resets (user_id, created_at);
+
+-- +goose Down
+DROP TABLE password_resets;
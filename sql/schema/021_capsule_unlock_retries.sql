@@ -0,0 +1,18 @@
+-- +goose Up
+-- The broker-less scheduler backs off capsules that fail to unlock, such as
+-- one whose owner's mail server keeps refusing, instead of retrying them on
+-- every pass.
+ALTER TABLE capsule
+    ADD COLUMN unlock_attempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN next_unlock_attempt_at TIMESTAMP;
+
+-- Lets the scheduler find the earliest retry without scanning every sealed
+-- capsule; capsule_locked_unlock_at_idx covers the rest.
+CREATE INDEX capsule_unlock_retry_idx ON capsule (next_unlock_attempt_at)
+    WHERE is_unlocked IS NOT TRUE AND next_unlock_attempt_at IS NOT NULL;
+
+-- +goose Down
+DROP INDEX capsule_unlock_retry_idx;
+ALTER TABLE capsule
+    DROP COLUMN next_unlock_attempt_at,
+    DROP COLUMN unlock_attempts;
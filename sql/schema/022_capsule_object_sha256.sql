@@ -0,0 +1,10 @@
+-- +goose Up
+-- SHA-256 of the stored object, i.e. the ciphertext, recorded when it is
+-- written. The scrubber checks time-locked capsules against it, since their
+-- keys may not be opened before unlock_at.
+ALTER TABLE capsule
+    ADD COLUMN object_sha256 TEXT;
+
+-- +goose Down
+ALTER TABLE capsule
+    DROP COLUMN object_sha256;
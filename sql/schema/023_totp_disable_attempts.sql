@@ -0,0 +1,12 @@
+-- +goose Up
+-- Turning TOTP off takes a code, so guesses at it are limited per user the
+-- way mfa_challenges limits them per login. Attempts are counted in a window
+-- that starts at the first one.
+ALTER TABLE user_totp
+    ADD COLUMN disable_attempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN disable_window_started_at TIMESTAMP;
+
+-- +goose Down
+ALTER TABLE user_totp
+    DROP COLUMN disable_window_started_at,
+    DROP COLUMN disable_attempts;
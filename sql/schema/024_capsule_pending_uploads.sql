@@ -0,0 +1,8 @@
+-- +goose Up
+-- The worker expires direct uploads that were started and never finalized;
+-- this keeps finding them from scanning every capsule.
+CREATE INDEX capsule_pending_upload_created_at_idx ON capsule (created_at)
+    WHERE upload_status = 'pending_upload';
+
+-- +goose Down
+DROP INDEX capsule_pending_upload_created_at_idx;
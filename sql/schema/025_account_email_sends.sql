@@ -0,0 +1,16 @@
+-- +goose Up
+-- Account emails are rate-limited per user and kind of email. The counters
+-- live in one row so a request can check and bump them in a single
+-- statement; counting email_verifications or password_resets first let
+-- concurrent requests all get past the limit.
+CREATE TABLE account_email_sends (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    last_sent_at TIMESTAMP NOT NULL,
+    window_started_at TIMESTAMP NOT NULL,
+    sent_in_window INT NOT NULL,
+    PRIMARY KEY (user_id, kind)
+);
+
+-- +goose Down
+DROP TABLE account_email_sends;
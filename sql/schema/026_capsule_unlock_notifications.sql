@@ -0,0 +1,19 @@
+-- +goose Up
+-- The unlock email goes out after the unlock commits, so a capsule can be
+-- open before its owner has been told. unlock_notify_after leases the email
+-- to one worker, and once the lease runs out another one retries it.
+ALTER TABLE capsule
+    ADD COLUMN unlock_notified_at TIMESTAMP,
+    ADD COLUMN unlock_notify_after TIMESTAMP;
+
+-- Capsules opened before now were announced inside the unlock itself.
+UPDATE capsule SET unlock_notified_at = now() WHERE is_unlocked IS TRUE;
+
+CREATE INDEX capsule_unannounced_idx ON capsule (unlock_at)
+    WHERE is_unlocked IS TRUE AND unlock_notified_at IS NULL;
+
+-- +goose Down
+DROP INDEX capsule_unannounced_idx;
+ALTER TABLE capsule
+    DROP COLUMN unlock_notify_after,
+    DROP COLUMN unlock_notified_at;